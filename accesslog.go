@@ -0,0 +1,141 @@
+package switchboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat selects how access log entries are written.
+type AccessLogFormat int
+
+const (
+	// JSONLogFormat writes each entry as a line of JSON.
+	JSONLogFormat AccessLogFormat = iota
+
+	// CommonLogFormat writes each entry in the Common Log Format, followed by
+	// the route, timing and request ID fields.
+	CommonLogFormat
+)
+
+// AccessLogEntry describes a completed request.
+type AccessLogEntry struct {
+	Time           time.Time `json:"time"`
+	RemoteAddr     string    `json:"remote_addr"`
+	Method         string    `json:"method"`
+	URI            string    `json:"uri"`
+	Protocol       string    `json:"protocol"`
+	Status         int       `json:"status"`
+	BytesIn        int64     `json:"bytes_in"`
+	BytesOut       int64     `json:"bytes_out"`
+	Pattern        string    `json:"pattern,omitempty"`
+	ServiceID      string    `json:"service_id,omitempty"`
+	ServiceName    string    `json:"service_name,omitempty"`
+	ServiceVersion string    `json:"service_version,omitempty"`
+	Address        string    `json:"address,omitempty"`
+	UpstreamMillis float64   `json:"upstream_ms"`
+	TotalMillis    float64   `json:"total_ms"`
+	Retries        int       `json:"retries"`
+	Cache          string    `json:"cache,omitempty"`
+	Coalesced      bool      `json:"coalesced,omitempty"`
+	Fault          string    `json:"fault,omitempty"`
+	Static         bool      `json:"static,omitempty"`
+	RequestID      string    `json:"request_id"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// AccessLog returns middleware that writes an entry to writer after each
+// request completes.  Entries are written whole, so writer may be shared
+// with other loggers.
+func AccessLog(writer io.Writer, format AccessLogFormat) *Middleware {
+	var mutex sync.Mutex
+	return &Middleware{
+		Complete: func(request *http.Request, route *Route) {
+			entry := &AccessLogEntry{
+				Time:           route.Start,
+				RemoteAddr:     request.RemoteAddr,
+				Method:         request.Method,
+				URI:            request.URL.RequestURI(),
+				Protocol:       request.Proto,
+				Status:         route.Status,
+				BytesIn:        route.BytesIn,
+				BytesOut:       route.BytesOut,
+				Pattern:        route.Pattern,
+				Address:        route.Address,
+				UpstreamMillis: milliseconds(route.Upstream),
+				TotalMillis:    milliseconds(time.Since(route.Start)),
+				Retries:        route.Retries,
+				Cache:          route.Cache,
+				Coalesced:      route.Coalesced,
+				Fault:          route.Fault,
+				Static:         route.Static,
+				RequestID:      route.RequestID}
+			if route.Service != nil {
+				entry.ServiceID = route.Service.ID
+				entry.ServiceName = route.Service.LogicalName()
+				entry.ServiceVersion = route.Service.Version
+			}
+			if route.Err != nil {
+				entry.Error = route.Err.Error()
+			} else if route.Refusal != nil {
+				entry.Error = route.Refusal.Error()
+			}
+
+			var line []byte
+			if format == CommonLogFormat {
+				line = []byte(entry.common())
+			} else {
+				line, _ = json.Marshal(entry)
+				line = append(line, '\n')
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			writer.Write(line)
+		}}
+}
+
+// Common formats the entry in the Common Log Format followed by the quoted
+// pattern, the service ID, address, bytes in, upstream and total latency in
+// milliseconds, retries and request ID.  Missing values are written as "-".
+func (entry *AccessLogEntry) common() string {
+	host := entry.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	bytesOut := "-"
+	if entry.BytesOut > 0 {
+		bytesOut = strconv.FormatInt(entry.BytesOut, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] %q %d %s %q %s %s %d %.3f %.3f %d %s\n",
+		orDash(host),
+		entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		entry.Method+" "+entry.URI+" "+entry.Protocol,
+		entry.Status,
+		bytesOut,
+		entry.Pattern,
+		orDash(entry.ServiceID),
+		orDash(entry.Address),
+		entry.BytesIn,
+		entry.UpstreamMillis,
+		entry.TotalMillis,
+		entry.Retries,
+		orDash(entry.RequestID))
+}
+
+// OrDash returns value, or "-" if value is empty.
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// Milliseconds converts a duration to fractional milliseconds.
+func milliseconds(duration time.Duration) float64 {
+	return float64(duration) / float64(time.Millisecond)
+}
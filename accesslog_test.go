@@ -0,0 +1,75 @@
+package switchboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type AccessLogTest struct{}
+
+var _ = Suite(&AccessLogTest{})
+
+// AccessLog writes a JSON entry describing the route, backend and timing of
+// each request.
+func (s *AccessLogTest) TestJSON(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello, world!")
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("POST", "http://example.com/user/1?q=1", strings.NewReader("body"))
+	c.Assert(err, IsNil)
+	request.RemoteAddr = "10.0.0.1:1234"
+	request.Header.Set("X-Request-ID", "request-id")
+
+	output := &bytes.Buffer{}
+	mux := NewExchangeServeMux()
+	mux.Use(AccessLog(output, JSONLogFormat))
+	mux.AddService(&ServiceRecord{
+		ID:      "users",
+		Address: server.URL,
+		Routes:  Routes{"POST": []string{"/user/:id"}}})
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+
+	var entry AccessLogEntry
+	err = json.Unmarshal(output.Bytes(), &entry)
+	c.Assert(err, IsNil)
+	c.Assert(entry.RemoteAddr, Equals, "10.0.0.1:1234")
+	c.Assert(entry.Method, Equals, "POST")
+	c.Assert(entry.URI, Equals, "/user/1?q=1")
+	c.Assert(entry.Status, Equals, http.StatusOK)
+	c.Assert(entry.BytesIn, Equals, int64(4))
+	c.Assert(entry.BytesOut, Equals, int64(14))
+	c.Assert(entry.Pattern, Equals, "/user/:id")
+	c.Assert(entry.ServiceID, Equals, "users")
+	c.Assert(entry.Address, Equals, server.URL)
+	c.Assert(entry.UpstreamMillis > 0, Equals, true)
+	c.Assert(entry.TotalMillis >= entry.UpstreamMillis, Equals, true)
+	c.Assert(entry.RequestID, Equals, "request-id")
+}
+
+// AccessLog writes entries in the Common Log Format followed by extended
+// fields, using "-" for missing values.
+func (s *AccessLogTest) TestCommon(c *C) {
+	entry := &AccessLogEntry{
+		Time:           time.Date(2014, 7, 10, 13, 55, 36, 0, time.UTC),
+		RemoteAddr:     "10.0.0.1:1234",
+		Method:         "GET",
+		URI:            "/unknown",
+		Protocol:       "HTTP/1.1",
+		Status:         http.StatusNotFound,
+		UpstreamMillis: 0,
+		TotalMillis:    1.5,
+		RequestID:      "request-id"}
+	c.Assert(entry.common(), Equals,
+		`10.0.0.1 - - [10/Jul/2014:13:55:36 +0000] "GET /unknown HTTP/1.1" 404 - "" - - 0 0.000 1.500 0 request-id`+"\n")
+}
@@ -0,0 +1,57 @@
+package switchboard
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// ParseAddress parses the address of a backend service.  Addresses are
+// absolute http or https URLs and may include a base path, which requests
+// are proxied under, and a query, which is added to every request.
+func ParseAddress(address string) (*url.URL, error) {
+	base, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, errors.New("Address " + address + " must use the http or https scheme")
+	}
+	if base.Host == "" {
+		return nil, errors.New("Address " + address + " has no host")
+	}
+	if base.Fragment != "" {
+		return nil, errors.New("Address " + address + " must not have a fragment")
+	}
+	return base, nil
+}
+
+// BackendURL returns the URL to proxy a request to a backend service at
+// address.  path is the escaped URL path of the request, which is joined to
+// the address's base path with exactly one slash between them.  Escaped
+// segments, such as %2F, are preserved.  The address's query, if any, comes
+// before rawQuery.
+func backendURL(address, path, rawQuery string) (*url.URL, error) {
+	base, err := ParseAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	escaped := strings.TrimSuffix(base.EscapedPath(), "/") + ensureSlash(path)
+	unescaped, err := url.PathUnescape(escaped)
+	if err != nil {
+		return nil, err
+	}
+	target := *base
+	target.Path = unescaped
+	target.RawPath = escaped
+	if target.EscapedPath() != escaped {
+		return nil, errors.New("Path " + path + " is not escaped correctly")
+	}
+	switch {
+	case base.RawQuery == "":
+		target.RawQuery = rawQuery
+	case rawQuery != "":
+		target.RawQuery = base.RawQuery + "&" + rawQuery
+	}
+	return &target, nil
+}
@@ -0,0 +1,95 @@
+package switchboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+type AddressTest struct{}
+
+var _ = Suite(&AddressTest{})
+
+// ParseAddress accepts absolute http and https URLs with optional base
+// paths and rejects anything else.
+func (s *AddressTest) TestParseAddress(c *C) {
+	base, err := ParseAddress("https://localhost:8080/api")
+	c.Assert(err, IsNil)
+	c.Assert(base.Host, Equals, "localhost:8080")
+	c.Assert(base.Path, Equals, "/api")
+
+	_, err = ParseAddress("localhost:8080")
+	c.Assert(err, ErrorMatches, "Address localhost:8080 must use the http or https scheme")
+	_, err = ParseAddress("http:///api")
+	c.Assert(err, ErrorMatches, "Address http:///api has no host")
+	_, err = ParseAddress("http://localhost/api#users")
+	c.Assert(err, ErrorMatches, "Address http://localhost/api#users must not have a fragment")
+	_, err = ParseAddress("http://local host")
+	c.Assert(err, NotNil)
+}
+
+// BackendURL joins the base path and request path with a single slash and
+// combines queries.
+func (s *AddressTest) TestBackendURL(c *C) {
+	tests := []struct {
+		address, path, query, expected string
+	}{
+		{"http://localhost:8080", "/users", "", "http://localhost:8080/users"},
+		{"http://localhost:8080/", "/users", "", "http://localhost:8080/users"},
+		{"http://localhost:8080/api", "/users", "", "http://localhost:8080/api/users"},
+		{"http://localhost:8080/api/", "/users", "q=1", "http://localhost:8080/api/users?q=1"},
+		{"http://localhost:8080/api", "/", "", "http://localhost:8080/api/"},
+		{"http://localhost:8080/api?key=a", "/users", "q=1", "http://localhost:8080/api/users?key=a&q=1"},
+		{"http://localhost:8080/api?key=a", "/users", "", "http://localhost:8080/api/users?key=a"},
+		{"http://localhost:8080/a%20b", "/x%2Fy", "", "http://localhost:8080/a%20b/x%2Fy"},
+	}
+	for _, test := range tests {
+		target, err := backendURL(test.address, test.path, test.query)
+		c.Assert(err, IsNil)
+		c.Assert(target.String(), Equals, test.expected, Commentf("%v", test))
+	}
+
+	_, err := backendURL("http://localhost:8080", "/%zz", "")
+	c.Assert(err, NotNil)
+}
+
+// ServeHTTP preserves escaped path segments and proxies requests under the
+// address's base path.
+func (s *AddressTest) TestServeHTTPWithBasePath(c *C) {
+	paths := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			paths <- request.URL.RequestURI()
+		}))
+	defer server.Close()
+	mux := NewExchangeServeMux()
+	mux.Add("GET", "/files/", server.URL+"/api/")
+
+	writer := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com/files/a%2Fb?q=1", nil)
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(<-paths, Equals, "/api/files/a%2Fb?q=1")
+}
+
+// ServeHTTP responds with an error when the address is invalid.
+func (s *AddressTest) TestServeHTTPWithInvalidAddress(c *C) {
+	mux := NewExchangeServeMux()
+	mux.Add("GET", "/users", "localhost:8080")
+	writer := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com/users", nil)
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusInternalServerError)
+}
+
+// Exchanges refuse services with invalid addresses.
+func (s *AddressTest) TestExchangeRegisterValidatesAddress(c *C) {
+	exchange := NewExchange("test", nil, NewExchangeServeMux())
+	service := &ServiceRecord{
+		ID:      "users",
+		Address: "localhost:8080",
+		Routes:  Routes{"GET": []string{"/users"}}}
+	c.Assert(exchange.Register(service), ErrorMatches, "Address .* must use the http or https scheme")
+	c.Assert(exchange.Services(), HasLen, 0)
+}
@@ -0,0 +1,419 @@
+package switchboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RouteState describes a pattern in the route table, the backend service
+// addresses registered to handle it, how requests are spread across them and
+// whether it has a static response.
+type RouteState struct {
+	Method    string         `json:"method"`
+	Pattern   string         `json:"pattern"`
+	Addresses []AddressState `json:"addresses"`
+	Static    bool           `json:"static,omitempty"`
+
+	// Selection is "random" if requests are sent to a random address, or
+	// "traffic-policy" if Policies first narrow the addresses of their
+	// services to the versions they choose.
+	Selection string           `json:"selection,omitempty"`
+	Policies  []*TrafficPolicy `json:"traffic_policies,omitempty"`
+}
+
+// AddressState describes a backend service address and its health, as
+// observed from requests proxied to it.  An address is healthy until a
+// request to it fails and becomes healthy again after a request succeeds.
+type AddressState struct {
+	Address     string     `json:"address"`
+	ServiceID   string     `json:"service_id,omitempty"`
+	ServiceName string     `json:"service_name,omitempty"`
+	Version     string     `json:"version,omitempty"`
+	Healthy     bool       `json:"healthy"`
+	Failures    int        `json:"consecutive_failures"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+}
+
+// ServiceGroup describes the registered instances of a logical service.
+type ServiceGroup struct {
+	Name      string           `json:"name"`
+	Versions  []string         `json:"versions"`
+	Instances []*ServiceRecord `json:"instances"`
+}
+
+// ExchangeState is a snapshot of what an exchange knows about the world.
+type ExchangeState struct {
+	Namespace string           `json:"namespace"`
+	WaitIndex uint64           `json:"wait_index"`
+	Routes    []RouteState     `json:"routes"`
+	Services  []*ServiceRecord `json:"services"`
+	Groups    []ServiceGroup   `json:"groups"`
+	Conflicts []*Conflict      `json:"conflicts"`
+	Rejected  []*ServiceRecord `json:"rejected_services"`
+	Policies  []*TrafficPolicy `json:"traffic_policies"`
+	Mirrors   []MirrorState    `json:"mirrors"`
+	Faults    []FaultRule      `json:"faults"`
+
+	Quarantined []QuarantinedRecord `json:"quarantined"`
+}
+
+// RouteTable returns a snapshot of the route table, sorted by method.
+// Patterns for each method are listed in the order they're matched.
+func (mux *ExchangeServeMux) RouteTable() []RouteState {
+	mux.rw.RLock()
+	defer mux.rw.RUnlock()
+	mux.healthMutex.Lock()
+	defer mux.healthMutex.Unlock()
+
+	methods := make([]string, 0, len(mux.routes))
+	for method := range mux.routes {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+
+	table := make([]RouteState, 0)
+	for _, method := range methods {
+		for _, handler := range mux.routes[method] {
+			route := RouteState{Method: method, Pattern: handler.pattern, Static: handler.static != nil}
+			for _, address := range handler.addresses {
+				route.Addresses = append(route.Addresses, mux.addressState(address))
+			}
+			if len(handler.addresses) > 0 {
+				route.Selection, route.Policies = mux.selection(handler)
+			}
+			table = append(table, route)
+		}
+	}
+	return table
+}
+
+// Selection describes how an address is chosen for requests to a pattern
+// handler and returns the traffic policies that apply to its addresses,
+// sorted by service name.  The caller must hold the read lock.
+func (mux *ExchangeServeMux) selection(handler *patternHandler) (string, []*TrafficPolicy) {
+	policies := make([]*TrafficPolicy, 0)
+	for _, address := range handler.addresses {
+		service, present := mux.services[address]
+		if !present || service.LogicalName() == "" {
+			continue
+		}
+		policy, present := mux.policies[service.LogicalName()]
+		if present && !containsPolicy(policies, policy) {
+			policies = append(policies, policy)
+		}
+	}
+	if len(policies) == 0 {
+		return "random", nil
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Service < policies[j].Service })
+	return "traffic-policy", policies
+}
+
+// ContainsPolicy returns true if policies contains policy.
+func containsPolicy(policies []*TrafficPolicy, policy *TrafficPolicy) bool {
+	for _, existing := range policies {
+		if existing == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// AddressState describes an address.  The caller must hold the read lock and
+// the health lock.
+func (mux *ExchangeServeMux) addressState(address string) AddressState {
+	state := AddressState{Address: address, Healthy: true}
+	if service, present := mux.services[address]; present {
+		state.ServiceID = service.ID
+		state.ServiceName = service.LogicalName()
+		state.Version = service.Version
+	}
+	if health, present := mux.health[address]; present {
+		state.Healthy = health.failures == 0
+		state.Failures = health.failures
+		state.LastError = health.lastError
+		if !health.lastFailure.IsZero() {
+			lastFailure := health.lastFailure
+			state.LastFailure = &lastFailure
+		}
+		if !health.lastSuccess.IsZero() {
+			lastSuccess := health.lastSuccess
+			state.LastSuccess = &lastSuccess
+		}
+	}
+	return state
+}
+
+// State returns a snapshot of the exchange's services, watch index, route
+// table, route conflicts, services refused by conflicts, traffic policies,
+// mirrored routes, fault rules and quarantined service records.
+func (exchange *Exchange) State() *ExchangeState {
+	return &ExchangeState{
+		Namespace: exchange.namespace,
+		WaitIndex: exchange.WaitIndex(),
+		Routes:    exchange.mux.RouteTable(),
+		Services:  exchange.Services(),
+		Groups:    exchange.ServiceGroups(),
+		Conflicts: exchange.Conflicts(),
+		Rejected:  exchange.Rejected(),
+		Policies:  exchange.mux.TrafficPolicies(),
+		Mirrors:   exchange.mux.Mirrors(),
+		Faults:    exchange.mux.Faults(),
+
+		Quarantined: exchange.Quarantined()}
+}
+
+// ServiceGroups returns the registered services grouped by logical service,
+// sorted by name.
+func (exchange *Exchange) ServiceGroups() []ServiceGroup {
+	indexes := make(map[string]int)
+	groups := make([]ServiceGroup, 0)
+	for _, service := range exchange.Services() {
+		name := service.LogicalName()
+		index, present := indexes[name]
+		if !present {
+			index = len(groups)
+			indexes[name] = index
+			groups = append(groups, ServiceGroup{Name: name, Versions: make([]string, 0)})
+		}
+		group := &groups[index]
+		group.Instances = append(group.Instances, service)
+		if service.Version != "" && !contains(group.Versions, service.Version) {
+			group.Versions = append(group.Versions, service.Version)
+		}
+	}
+	for _, group := range groups {
+		sort.Strings(group.Versions)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	return groups
+}
+
+// Contains returns true if values contains value.
+func contains(values []string, value string) bool {
+	for _, existing := range values {
+		if existing == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Admin is an http.Handler that reports the state of an exchange as JSON.
+// It exposes private routing details and should be mounted on a separate
+// listener that isn't reachable by API consumers.  Endpoints respond to
+// other methods with 405 Method Not Allowed.  It serves:
+//
+//	GET /          the complete ExchangeState
+//	GET /routes    the route table with per-address health and selection
+//	GET /services  the registered service records
+//	GET /groups    the registered service records grouped by logical service
+//	GET /watch     the etcd watch index
+//	GET /conflicts routes claimed by more than one service
+//	GET /policies  traffic policies that split requests between versions
+//	GET /mirrors   routes mirrored to shadow services, with comparison stats
+//	GET /faults    fault rules injected into requests
+//	POST /faults   install the FaultRule in the JSON request body
+//	DELETE /faults?name=NAME
+//	               remove the fault rule called NAME
+//	GET /quarantine service records held because they failed verification
+//	GET /cache     the keys of cached responses
+//	POST /cache/purge?pattern=PATTERN
+//	               remove cached responses for URLs that match PATTERN
+//	GET /explain   how a request would be routed; see ServeExplain
+//	GET /metrics   metrics in the Prometheus text format, if configured
+type Admin struct {
+	exchange *Exchange
+	handlers *http.ServeMux
+}
+
+// NewAdmin creates an admin handler for an exchange.  metrics may be nil if
+// metrics aren't being collected.
+func NewAdmin(exchange *Exchange, metrics *Metrics) *Admin {
+	admin := &Admin{exchange: exchange, handlers: http.NewServeMux()}
+	admin.handlers.HandleFunc("/", onlyGet(admin.serveState))
+	admin.handlers.HandleFunc("/routes", onlyGet(admin.serveRoutes))
+	admin.handlers.HandleFunc("/services", onlyGet(admin.serveServices))
+	admin.handlers.HandleFunc("/groups", onlyGet(admin.serveGroups))
+	admin.handlers.HandleFunc("/watch", onlyGet(admin.serveWatch))
+	admin.handlers.HandleFunc("/conflicts", onlyGet(admin.serveConflicts))
+	admin.handlers.HandleFunc("/policies", onlyGet(admin.servePolicies))
+	admin.handlers.HandleFunc("/mirrors", onlyGet(admin.serveMirrors))
+	admin.handlers.HandleFunc("/faults", admin.serveFaults)
+	admin.handlers.HandleFunc("/quarantine", onlyGet(admin.serveQuarantine))
+	admin.handlers.HandleFunc("/cache", onlyGet(admin.serveCache))
+	admin.handlers.HandleFunc("/cache/purge", admin.servePurge)
+	admin.handlers.HandleFunc("/explain", onlyGet(admin.serveExplain))
+	if metrics != nil {
+		admin.handlers.HandleFunc("/metrics", onlyGet(metrics.ServeHTTP))
+	}
+	return admin
+}
+
+// ServeHTTP dispatches the request to the handler for its path.
+func (admin *Admin) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	admin.handlers.ServeHTTP(writer, request)
+}
+
+// OnlyGet wraps the handler for an endpoint that only serves GET requests,
+// so requests with other methods are refused.
+func onlyGet(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != "GET" {
+			writer.Header().Set("Allow", "GET")
+			writeJSON(writer, http.StatusMethodNotAllowed, map[string]string{"error": "endpoint requires GET"})
+			return
+		}
+		handler(writer, request)
+	}
+}
+
+// ServeState writes the complete exchange state.
+func (admin *Admin) serveState(writer http.ResponseWriter, request *http.Request) {
+	if request.URL.Path != "/" {
+		http.NotFound(writer, request)
+		return
+	}
+	writeJSON(writer, http.StatusOK, admin.exchange.State())
+}
+
+// ServeRoutes writes the route table.
+func (admin *Admin) serveRoutes(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, admin.exchange.mux.RouteTable())
+}
+
+// ServeServices writes the registered service records.
+func (admin *Admin) serveServices(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, admin.exchange.Services())
+}
+
+// ServeGroups writes the registered service records grouped by logical
+// service.
+func (admin *Admin) serveGroups(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, admin.exchange.ServiceGroups())
+}
+
+// ServeWatch writes the etcd watch index.
+func (admin *Admin) serveWatch(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, map[string]uint64{"wait_index": admin.exchange.WaitIndex()})
+}
+
+// ServeConflicts writes the route conflicts detected by the exchange.
+func (admin *Admin) serveConflicts(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, admin.exchange.Conflicts())
+}
+
+// ServePolicies writes the installed traffic policies.
+func (admin *Admin) servePolicies(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, admin.exchange.mux.TrafficPolicies())
+}
+
+// ServeMirrors writes the mirrored routes and their stats.
+func (admin *Admin) serveMirrors(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, admin.exchange.mux.Mirrors())
+}
+
+// ServeFaults writes the installed fault rules, installs the fault rule in a
+// POST request's body or removes the fault rule named by a DELETE request's
+// name query argument.
+func (admin *Admin) serveFaults(writer http.ResponseWriter, request *http.Request) {
+	mux := admin.exchange.mux
+	switch request.Method {
+	case "GET":
+		writeJSON(writer, http.StatusOK, mux.Faults())
+	case "POST":
+		rule := &FaultRule{}
+		if err := json.NewDecoder(request.Body).Decode(rule); err != nil {
+			writeJSON(writer, http.StatusBadRequest, map[string]string{"error": "fault rule must be JSON"})
+			return
+		}
+		if err := mux.AddFault(rule); err != nil {
+			writeJSON(writer, http.StatusBadRequest, map[string]string{"error": strings.ToLower(err.Error())})
+			return
+		}
+		writeJSON(writer, http.StatusOK, rule)
+	case "DELETE":
+		if !mux.RemoveFault(request.URL.Query().Get("name")) {
+			writeJSON(writer, http.StatusNotFound, map[string]string{"error": "no such fault rule"})
+			return
+		}
+		writeJSON(writer, http.StatusOK, map[string]bool{"removed": true})
+	default:
+		writer.Header().Set("Allow", "GET, POST, DELETE")
+		writeJSON(writer, http.StatusMethodNotAllowed,
+			map[string]string{"error": "faults requires GET, POST or DELETE"})
+	}
+}
+
+// ServeQuarantine writes the service records that failed verification.
+func (admin *Admin) serveQuarantine(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, admin.exchange.Quarantined())
+}
+
+// ServeCache writes the keys of cached responses.
+func (admin *Admin) serveCache(writer http.ResponseWriter, request *http.Request) {
+	writeJSON(writer, http.StatusOK, admin.exchange.mux.CacheState())
+}
+
+// ServePurge removes cached responses for URLs that match the pattern query
+// argument and writes the number removed.
+func (admin *Admin) servePurge(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != "POST" {
+		writer.Header().Set("Allow", "POST")
+		writeJSON(writer, http.StatusMethodNotAllowed, map[string]string{"error": "purge requires POST"})
+		return
+	}
+	pattern := request.URL.Query().Get("pattern")
+	if !strings.HasPrefix(pattern, "/") {
+		writeJSON(writer, http.StatusBadRequest, map[string]string{"error": "pattern must start with /"})
+		return
+	}
+	writeJSON(writer, http.StatusOK, map[string]int{"purged": admin.exchange.mux.PurgeCache(pattern)})
+}
+
+// ServeExplain writes an Explanation of how a request would be routed.  The
+// request is described by the method, host and path query arguments, along
+// with any number of header arguments in "Name: value" form.  For example:
+//
+//	GET /explain?method=GET&path=/user/123&header=Accept:%20application/json
+func (admin *Admin) serveExplain(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	method := query.Get("method")
+	if method == "" {
+		method = "GET"
+	}
+	path := query.Get("path")
+	if path == "" {
+		writeJSON(writer, http.StatusBadRequest, map[string]string{"error": "path is required"})
+		return
+	}
+	header := make(http.Header)
+	for _, value := range query["header"] {
+		name, value, found := strings.Cut(value, ":")
+		if !found {
+			writeJSON(writer, http.StatusBadRequest,
+				map[string]string{"error": "header must be in Name: value form"})
+			return
+		}
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	explanation := admin.exchange.mux.Explain(method, query.Get("host"), path, header)
+	writeJSON(writer, http.StatusOK, explanation)
+}
+
+// WriteJSON writes value to the client as indented JSON.
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	body, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(append(body, '\n'))
+}
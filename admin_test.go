@@ -0,0 +1,164 @@
+package switchboard
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+type AdminTest struct {
+	mux      *ExchangeServeMux
+	exchange *Exchange
+	admin    *Admin
+}
+
+var _ = Suite(&AdminTest{})
+
+func (s *AdminTest) SetUpTest(c *C) {
+	s.mux = NewExchangeServeMux()
+	s.exchange = NewExchange("test", nil, s.mux)
+	s.admin = NewAdmin(s.exchange, NewMetrics(s.mux))
+}
+
+// Get makes a request to the admin handler and decodes the JSON response.
+func (s *AdminTest) get(c *C, path string, value interface{}) *httptest.ResponseRecorder {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://admin"+path, nil)
+	c.Assert(err, IsNil)
+	s.admin.ServeHTTP(writer, request)
+	if value != nil {
+		c.Assert(writer.Header().Get("Content-Type"), Equals, "application/json")
+		err = json.Unmarshal(writer.Body.Bytes(), value)
+		c.Assert(err, IsNil)
+	}
+	return writer
+}
+
+// The routes endpoint reports patterns, addresses and observed health.
+func (s *AdminTest) TestRoutes(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	address := server.URL
+	server.Close()
+	s.exchange.Register(&ServiceRecord{
+		ID:      "users",
+		Address: address,
+		Routes:  Routes{"GET": []string{"/users", "/user/:id"}, "POST": []string{"/users"}}})
+
+	request, err := http.NewRequest("GET", "http://example.com/users", nil)
+	c.Assert(err, IsNil)
+	s.mux.ServeHTTP(httptest.NewRecorder(), request)
+
+	var routes []RouteState
+	s.get(c, "/routes", &routes)
+	c.Assert(len(routes), Equals, 3)
+	c.Assert(routes[0].Method, Equals, "GET")
+	c.Assert(routes[0].Pattern, Equals, "/users")
+	c.Assert(routes[2].Method, Equals, "POST")
+	c.Assert(len(routes[0].Addresses), Equals, 1)
+	state := routes[0].Addresses[0]
+	c.Assert(state.Address, Equals, address)
+	c.Assert(state.ServiceID, Equals, "users")
+	c.Assert(state.Healthy, Equals, false)
+	c.Assert(state.Failures, Equals, 1)
+	c.Assert(state.LastError, Not(Equals), "")
+	c.Assert(state.LastFailure, NotNil)
+}
+
+// The services and watch endpoints report registered service records and
+// the etcd watch index.
+func (s *AdminTest) TestServicesAndWatch(c *C) {
+	service := &ServiceRecord{
+		ID:      "users",
+		Address: "http://localhost:8080",
+		Routes:  Routes{"GET": []string{"/users"}}}
+	s.exchange.Register(service)
+	s.exchange.waitIndex = 42
+
+	var services []*ServiceRecord
+	s.get(c, "/services", &services)
+	c.Assert(services, DeepEquals, []*ServiceRecord{service})
+
+	var watch map[string]uint64
+	s.get(c, "/watch", &watch)
+	c.Assert(watch, DeepEquals, map[string]uint64{"wait_index": 42})
+
+	var state ExchangeState
+	s.get(c, "/", &state)
+	c.Assert(state.Namespace, Equals, "test")
+	c.Assert(state.WaitIndex, Equals, uint64(42))
+	c.Assert(len(state.Routes), Equals, 1)
+	c.Assert(state.Routes[0].Selection, Equals, "random")
+	c.Assert(state.Services, DeepEquals, []*ServiceRecord{service})
+
+	s.exchange.Unregister(service)
+	s.get(c, "/services", &services)
+	c.Assert(services, DeepEquals, []*ServiceRecord{})
+}
+
+// The metrics endpoint serves metrics and unknown paths return 404.
+func (s *AdminTest) TestMetricsAndUnknownPath(c *C) {
+	writer := s.get(c, "/metrics", nil)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	writer = s.get(c, "/unknown", nil)
+	c.Assert(writer.Code, Equals, http.StatusNotFound)
+}
+
+// The groups endpoint reports service instances grouped by logical service.
+func (s *AdminTest) TestGroups(c *C) {
+	s.exchange.Register(&ServiceRecord{
+		ID: "users-1", Name: "users", Version: "1.0", Address: "http://localhost:8080"})
+	s.exchange.Register(&ServiceRecord{
+		ID: "users-2", Name: "users", Version: "2.0", Address: "http://localhost:8081"})
+	s.exchange.Register(&ServiceRecord{ID: "anonymous", Address: "http://localhost:8082"})
+
+	var groups []ServiceGroup
+	s.get(c, "/groups", &groups)
+	c.Assert(len(groups), Equals, 2)
+	c.Assert(groups[0].Name, Equals, "anonymous")
+	c.Assert(groups[0].Versions, DeepEquals, []string{})
+	c.Assert(groups[1].Name, Equals, "users")
+	c.Assert(groups[1].Versions, DeepEquals, []string{"1.0", "2.0"})
+	c.Assert(len(groups[1].Instances), Equals, 2)
+}
+
+// Routes report the traffic policies that choose between the versions of
+// their services.
+func (s *AdminTest) TestRouteSelection(c *C) {
+	s.exchange.Register(&ServiceRecord{
+		ID: "users-1", Name: "users", Version: "v1", Address: "http://localhost:8080",
+		Routes: Routes{"GET": []string{"/users"}}})
+	s.exchange.Register(&ServiceRecord{
+		ID: "users-2", Name: "users", Version: "v2", Address: "http://localhost:8081",
+		Routes: Routes{"GET": []string{"/users"}}})
+	s.exchange.Register(&ServiceRecord{
+		ID: "accounts", Address: "http://localhost:8082",
+		Routes: Routes{"GET": []string{"/accounts"}}})
+	policy := &TrafficPolicy{
+		Service: "users",
+		Splits:  []VersionSplit{{Version: "v1", Weight: 90}, {Version: "v2", Weight: 10}}}
+	c.Assert(s.mux.SetTrafficPolicy(policy), IsNil)
+
+	var routes []RouteState
+	s.get(c, "/routes", &routes)
+	c.Assert(len(routes), Equals, 2)
+	c.Assert(routes[0].Pattern, Equals, "/users")
+	c.Assert(routes[0].Selection, Equals, "traffic-policy")
+	c.Assert(routes[0].Policies, DeepEquals, []*TrafficPolicy{policy})
+	c.Assert(routes[1].Pattern, Equals, "/accounts")
+	c.Assert(routes[1].Selection, Equals, "random")
+	c.Assert(routes[1].Policies, HasLen, 0)
+}
+
+// Read-only endpoints refuse methods other than GET.
+func (s *AdminTest) TestMethodNotAllowed(c *C) {
+	for _, path := range []string{"/", "/routes", "/services", "/watch", "/cache", "/explain", "/metrics"} {
+		writer := httptest.NewRecorder()
+		request, err := http.NewRequest("POST", "http://admin"+path, nil)
+		c.Assert(err, IsNil)
+		s.admin.ServeHTTP(writer, request)
+		c.Assert(writer.Code, Equals, http.StatusMethodNotAllowed, Commentf(path))
+		c.Assert(writer.Header().Get("Allow"), Equals, "GET", Commentf(path))
+	}
+}
@@ -0,0 +1,216 @@
+package switchboard
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Headers set on requests proxied to backend services to describe the
+// authenticated client.  Clients can't set them: any headers starting with
+// X-Auth- are removed from requests before they're proxied.
+const (
+	AuthSubjectHeader = "X-Auth-Subject"
+	AuthScopesHeader  = "X-Auth-Scopes"
+	AuthMethodHeader  = "X-Auth-Method"
+)
+
+// DefaultAPIKeyHeader is the header clients send API keys in when
+// AuthConfig.APIKeyHeader isn't set.
+const DefaultAPIKeyHeader = "X-API-Key"
+
+// AuthRequirement declares who may call one of a service's routes.  Routes
+// without a requirement need an authenticated client with no particular
+// scopes.
+type AuthRequirement struct {
+	Method  string   `json:"method"`
+	Pattern string   `json:"pattern"`          // A pattern from the service's routes.
+	Public  bool     `json:"public,omitempty"` // Allow unauthenticated clients.
+	Scopes  []string `json:"scopes,omitempty"` // Scopes the client must have.
+}
+
+// APIKey is a static key a client authenticates with.
+type APIKey struct {
+	Key     string   `json:"key"`
+	Subject string   `json:"subject"`
+	Scopes  []string `json:"scopes,omitempty"`
+}
+
+// Principal describes an authenticated client.
+type Principal struct {
+	Method  string   // Either "jwt" or "api-key".
+	Subject string   // The subject of the token or owner of the key.
+	Scopes  []string // The scopes granted to the client.
+	Claims  Claims   // The claims of a verified JWT.
+}
+
+// AuthConfig configures the Authentication middleware.
+type AuthConfig struct {
+	// Keys verify JWT bearer tokens sent in the Authorization header.
+	// Bearer tokens aren't accepted if it's nil.
+	Keys *KeySet
+
+	// Validation describes the claims bearer tokens must have.
+	Validation JWTValidation
+
+	// APIKeys lists the API keys clients may send.
+	APIKeys []APIKey
+
+	// APIKeyHeader is the header clients send API keys in.
+	APIKeyHeader string
+
+	// ClaimHeaders maps JWT claim names to headers the claims are
+	// forwarded to backend services in, in addition to the subject, scopes
+	// and authentication method.
+	ClaimHeaders map[string]string
+
+	// Realm is reported to clients that fail to authenticate.
+	Realm string
+}
+
+// Authentication returns middleware that rejects requests that don't meet
+// the AuthRequirement the matched route's services declare for it.  Routes
+// without a service record, such as static routes and routes added with
+// ExchangeServeMux.Add, declare no requirement and are public.
+// Unauthenticated clients receive 401 Unauthorized and clients without the
+// required scopes receive 403 Forbidden.  The authenticated principal is set
+// on the route and forwarded to the backend service in headers.
+func Authentication(config *AuthConfig) *Middleware {
+	apiKeyHeader := config.APIKeyHeader
+	if apiKeyHeader == "" {
+		apiKeyHeader = DefaultAPIKeyHeader
+	}
+	apiKeys := make(map[[sha256.Size]byte]*APIKey)
+	for i := range config.APIKeys {
+		apiKeys[sha256.Sum256([]byte(config.APIKeys[i].Key))] = &config.APIKeys[i]
+	}
+	realm := config.Realm
+	if realm == "" {
+		realm = "switchboard"
+	}
+
+	return &Middleware{
+		PostMatch: func(writer http.ResponseWriter, request *http.Request, route *Route) bool {
+			requirement := route.Auth
+			if requirement == nil {
+				requirement = &AuthRequirement{Method: route.Method, Pattern: route.Pattern, Public: true}
+			}
+			principal, err := config.authenticate(request, apiKeyHeader, apiKeys)
+			if err == errNoCredentials && requirement.Public {
+				return true
+			}
+			if err != nil {
+				route.Refusal = err
+				writer.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+`"`)
+				writer.WriteHeader(http.StatusUnauthorized)
+				return false
+			}
+			for _, scope := range requirement.Scopes {
+				if !contains(principal.Scopes, scope) {
+					route.Refusal = errors.New("Missing scope " + scope)
+					writer.Header().Set("WWW-Authenticate", `Bearer realm="`+realm+
+						`", error="insufficient_scope", scope="`+strings.Join(requirement.Scopes, " ")+`"`)
+					writer.WriteHeader(http.StatusForbidden)
+					return false
+				}
+			}
+			route.Principal = principal
+			return true
+		},
+		PreProxy: func(writer http.ResponseWriter, request, outbound *http.Request, route *Route) bool {
+			for _, header := range config.ClaimHeaders {
+				outbound.Header.Del(header)
+			}
+			outbound.Header.Del(apiKeyHeader)
+			principal := route.Principal
+			if principal == nil {
+				return true
+			}
+			outbound.Header.Set(AuthMethodHeader, principal.Method)
+			outbound.Header.Set(AuthSubjectHeader, principal.Subject)
+			if len(principal.Scopes) > 0 {
+				outbound.Header.Set(AuthScopesHeader, strings.Join(principal.Scopes, " "))
+			}
+			for claim, header := range config.ClaimHeaders {
+				if values := principal.Claims.Strings(claim); len(values) > 0 {
+					outbound.Header.Set(header, strings.Join(values, " "))
+				}
+			}
+			return true
+		}}
+}
+
+// ErrNoCredentials is returned by authenticate when a request doesn't
+// include a bearer token or API key.
+var errNoCredentials = errors.New("No credentials")
+
+// Authenticate verifies the bearer token or API key sent with a request.
+func (config *AuthConfig) authenticate(request *http.Request, apiKeyHeader string, apiKeys map[[sha256.Size]byte]*APIKey) (*Principal, error) {
+	if authorization := request.Header.Get("Authorization"); authorization != "" {
+		scheme, token, found := strings.Cut(authorization, " ")
+		if !found || !strings.EqualFold(scheme, "Bearer") {
+			return nil, errors.New("Unsupported authorization scheme")
+		}
+		if config.Keys == nil {
+			return nil, errors.New("Bearer tokens aren't accepted")
+		}
+		claims, err := config.Keys.Verify(strings.TrimSpace(token), &config.Validation, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		return &Principal{
+			Method:  "jwt",
+			Subject: claims.Subject(),
+			Scopes:  claims.Scopes(),
+			Claims:  claims}, nil
+	}
+	if key := request.Header.Get(apiKeyHeader); key != "" {
+		apiKey, present := apiKeys[sha256.Sum256([]byte(key))]
+		if !present {
+			return nil, errors.New("Unknown API key")
+		}
+		return &Principal{Method: "api-key", Subject: apiKey.Subject, Scopes: apiKey.Scopes}, nil
+	}
+	return nil, errNoCredentials
+}
+
+// AuthRequirement combines the requirements the services registered for a
+// pattern handler declare for it, so enforcement doesn't depend on which
+// instance is selected.  The route is public only if every service declares
+// it public, and clients need every scope any service requires.  Nil is
+// returned if no registered address has a service record.  The caller must
+// hold the read lock.
+func (mux *ExchangeServeMux) authRequirement(method string, handler *patternHandler) *AuthRequirement {
+	var combined *AuthRequirement
+	for _, address := range handler.addresses {
+		service, present := mux.services[address]
+		if !present {
+			continue
+		}
+		requirement := service.AuthRequirement(method, handler.pattern)
+		if combined == nil {
+			combined = &AuthRequirement{Method: method, Pattern: handler.pattern, Public: true}
+		}
+		combined.Public = combined.Public && requirement.Public
+		for _, scope := range requirement.Scopes {
+			if !contains(combined.Scopes, scope) {
+				combined.Scopes = append(combined.Scopes, scope)
+			}
+		}
+	}
+	return combined
+}
+
+// AuthRequirement returns the requirement the service declares for an HTTP
+// method and mounted URL pattern.  Routes without a declared requirement
+// need an authenticated client.
+func (record *ServiceRecord) AuthRequirement(method, pattern string) AuthRequirement {
+	for _, requirement := range record.Auth {
+		if requirement.Method == method && record.MountedPattern(requirement.Pattern) == pattern {
+			return requirement
+		}
+	}
+	return AuthRequirement{Method: method, Pattern: pattern}
+}
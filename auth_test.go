@@ -0,0 +1,178 @@
+package switchboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type AuthTest struct {
+	mux      *ExchangeServeMux
+	server   *httptest.Server
+	received chan http.Header
+}
+
+var _ = Suite(&AuthTest{})
+
+func (s *AuthTest) SetUpTest(c *C) {
+	s.received = make(chan http.Header, 1)
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			s.received <- request.Header
+		}))
+	keys, err := ParseJWKS(testJWKS())
+	c.Assert(err, IsNil)
+	s.mux = NewExchangeServeMux()
+	s.mux.Use(Authentication(&AuthConfig{
+		Keys:         keys,
+		APIKeys:      []APIKey{{Key: "secret-key", Subject: "billing", Scopes: []string{"users:read"}}},
+		ClaimHeaders: map[string]string{"tenant": "X-Tenant"}}))
+	s.mux.AddService(&ServiceRecord{
+		ID:      "users",
+		Address: s.server.URL,
+		Mount:   "/api",
+		Routes:  Routes{"GET": []string{"/health", "/users", "/me"}, "DELETE": []string{"/user/:id"}},
+		Auth: []AuthRequirement{
+			{Method: "GET", Pattern: "/health", Public: true},
+			{Method: "GET", Pattern: "/users", Scopes: []string{"users:read"}},
+			{Method: "DELETE", Pattern: "/user/:id", Scopes: []string{"users:admin"}}}})
+}
+
+func (s *AuthTest) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+// Send makes a request through the mux.
+func (s *AuthTest) send(c *C, method, path string, header http.Header) *httptest.ResponseRecorder {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest(method, "http://example.com"+path, nil)
+	c.Assert(err, IsNil)
+	if header != nil {
+		request.Header = header
+	}
+	s.mux.ServeHTTP(writer, request)
+	return writer
+}
+
+// Bearer returns an Authorization header with a token for claims.
+func bearer(claims map[string]interface{}) http.Header {
+	return http.Header{"Authorization": {"Bearer " + signToken("ES256", "ec", claims)}}
+}
+
+// Public routes can be called without credentials, but client-supplied
+// identity headers are removed.
+func (s *AuthTest) TestPublicRoute(c *C) {
+	writer := s.send(c, "GET", "/api/health", http.Header{"X-Auth-Subject": {"admin"}})
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	received := <-s.received
+	c.Assert(received.Get(AuthSubjectHeader), Equals, "")
+}
+
+// Routes without a requirement reject requests without valid credentials.
+func (s *AuthTest) TestUnauthenticated(c *C) {
+	writer := s.send(c, "GET", "/api/me", nil)
+	c.Assert(writer.Code, Equals, http.StatusUnauthorized)
+	c.Assert(writer.Header().Get("WWW-Authenticate"), Equals, `Bearer realm="switchboard"`)
+
+	writer = s.send(c, "GET", "/api/me", http.Header{"Authorization": {"Bearer nonsense"}})
+	c.Assert(writer.Code, Equals, http.StatusUnauthorized)
+	writer = s.send(c, "GET", "/api/me", http.Header{"Authorization": {"Basic amFuZTpwYXNz"}})
+	c.Assert(writer.Code, Equals, http.StatusUnauthorized)
+	writer = s.send(c, "GET", "/api/me", http.Header{"X-Api-Key": {"wrong-key"}})
+	c.Assert(writer.Code, Equals, http.StatusUnauthorized)
+	expired := bearer(map[string]interface{}{"sub": "jane", "exp": time.Now().Add(-time.Hour).Unix()})
+	writer = s.send(c, "GET", "/api/me", expired)
+	c.Assert(writer.Code, Equals, http.StatusUnauthorized)
+}
+
+// Verified JWT claims are forwarded to the backend, replacing any values
+// sent by the client.
+func (s *AuthTest) TestBearerToken(c *C) {
+	header := bearer(map[string]interface{}{"sub": "jane", "scope": "users:read", "tenant": "acme"})
+	header.Set("X-Auth-Subject", "admin")
+	header.Set("X-Tenant", "other")
+	writer := s.send(c, "GET", "/api/users", header)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	received := <-s.received
+	c.Assert(received.Get(AuthMethodHeader), Equals, "jwt")
+	c.Assert(received.Get(AuthSubjectHeader), Equals, "jane")
+	c.Assert(received.Get(AuthScopesHeader), Equals, "users:read")
+	c.Assert(received.Get("X-Tenant"), Equals, "acme")
+}
+
+// API keys authenticate clients, and aren't forwarded to the backend.
+func (s *AuthTest) TestAPIKey(c *C) {
+	var principal *Principal
+	s.mux.Use(&Middleware{Complete: func(request *http.Request, route *Route) {
+		principal = route.Principal
+	}})
+	writer := s.send(c, "GET", "/api/users", http.Header{"X-Api-Key": {"secret-key"}})
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	received := <-s.received
+	c.Assert(received.Get(AuthMethodHeader), Equals, "api-key")
+	c.Assert(received.Get(AuthSubjectHeader), Equals, "billing")
+	c.Assert(received.Get(DefaultAPIKeyHeader), Equals, "")
+	c.Assert(principal.Subject, Equals, "billing")
+}
+
+// Clients without the scopes a route requires are forbidden.
+func (s *AuthTest) TestMissingScope(c *C) {
+	writer := s.send(c, "DELETE", "/api/user/123", http.Header{"X-Api-Key": {"secret-key"}})
+	c.Assert(writer.Code, Equals, http.StatusForbidden)
+	c.Assert(writer.Header().Get("WWW-Authenticate"), Equals,
+		`Bearer realm="switchboard", error="insufficient_scope", scope="users:admin"`)
+
+	header := bearer(map[string]interface{}{"sub": "jane", "scp": []string{"users:admin"}})
+	writer = s.send(c, "DELETE", "/api/user/123", header)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	<-s.received
+}
+
+// Instances of a service that declare different requirements for a route
+// are combined, so every request meets the strictest of them.
+func (s *AuthTest) TestInconsistentInstances(c *C) {
+	s.mux.AddService(&ServiceRecord{
+		ID:      "users-2",
+		Address: s.server.URL + "/",
+		Mount:   "/api",
+		Routes:  Routes{"GET": []string{"/health"}},
+		Auth:    []AuthRequirement{{Method: "GET", Pattern: "/health", Scopes: []string{"health:read"}}}})
+	for i := 0; i < 20; i++ {
+		writer := s.send(c, "GET", "/api/health", nil)
+		c.Assert(writer.Code, Equals, http.StatusUnauthorized)
+	}
+	writer := s.send(c, "GET", "/api/health", http.Header{"X-Api-Key": {"secret-key"}})
+	c.Assert(writer.Code, Equals, http.StatusForbidden)
+	c.Assert(writer.Header().Get("WWW-Authenticate"), Equals,
+		`Bearer realm="switchboard", error="insufficient_scope", scope="health:read"`)
+}
+
+// Routes without a service record declare no requirement, so they're
+// public.
+func (s *AuthTest) TestRoutesWithoutServices(c *C) {
+	s.mux.Add("GET", "/open", s.server.URL+"/")
+	c.Assert(s.mux.AddStatic("GET", "/fixture", &StaticResponse{Body: "fixture"}), IsNil)
+	writer := s.send(c, "GET", "/open", http.Header{"X-Auth-Subject": {"admin"}})
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert((<-s.received).Get(AuthSubjectHeader), Equals, "")
+	writer = s.send(c, "GET", "/fixture", nil)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(writer.Body.String(), Equals, "fixture")
+
+	// Clients that authenticate are still identified to the backend.
+	writer = s.send(c, "GET", "/open", http.Header{"X-Api-Key": {"secret-key"}})
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert((<-s.received).Get(AuthSubjectHeader), Equals, "billing")
+}
+
+// Service records are invalid if a requirement doesn't match a route.
+func (s *AuthTest) TestValidateRequirements(c *C) {
+	record := &ServiceRecord{
+		ID:      "users",
+		Address: "http://localhost:8080",
+		Routes:  Routes{"GET": []string{"/users"}},
+		Auth:    []AuthRequirement{{Method: "POST", Pattern: "/users", Public: true}}}
+	c.Assert(record.Validate(), ErrorMatches, "Auth requirement for POST /users doesn't match a route")
+}
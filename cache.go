@@ -0,0 +1,605 @@
+package switchboard
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStatusHeader reports how the response cache handled a request, as
+// described by RFC 9211.  For example:
+//
+//	Cache-Status: switchboard; hit
+//	Cache-Status: switchboard; fwd=miss; stored
+//	Cache-Status: switchboard; fwd=stale; fwd-status=304
+const CacheStatusHeader = "Cache-Status"
+
+// DefaultMaxCachedBody is the largest response body stored when
+// CacheConfig.MaxBodySize isn't set.
+const DefaultMaxCachedBody = 1 << 20
+
+// CachedResponse is a backend service response held by a CacheStore.
+type CachedResponse struct {
+	StatusCode   int
+	Header       http.Header
+	Body         []byte
+	Vary         http.Header // The request headers named by Vary.
+	RequestTime  time.Time   // When the request that produced it was sent.
+	ResponseTime time.Time   // When it was received.
+}
+
+// Size returns the approximate number of bytes used by the response.
+func (cached *CachedResponse) Size() int64 {
+	size := int64(len(cached.Body))
+	for _, header := range []http.Header{cached.Header, cached.Vary} {
+		for name, values := range header {
+			size += int64(len(name))
+			for _, value := range values {
+				size += int64(len(value))
+			}
+		}
+	}
+	return size
+}
+
+// CacheStore holds cached responses.  Keys are the request method and URI
+// separated by a space, such as "GET /user/123?fields=name".
+// Implementations must be safe for concurrent use and may evict responses
+// at any time.
+type CacheStore interface {
+	Get(key string) *CachedResponse
+	Set(key string, response *CachedResponse)
+	Delete(key string)
+	Keys() []string
+}
+
+// MemoryCache is a CacheStore that holds responses in memory, evicting the
+// least recently used responses when it's full.
+type MemoryCache struct {
+	mutex    sync.Mutex               // Synchronize access to entries and order.
+	capacity int64                    // The maximum number of bytes to hold.
+	size     int64                    // The number of bytes held.
+	entries  map[string]*list.Element // Elements of order keyed by cache key.
+	order    *list.List               // Entries from most to least recently used.
+}
+
+// memoryEntry is an element of a MemoryCache's LRU list.
+type memoryEntry struct {
+	key      string
+	response *CachedResponse
+}
+
+// NewMemoryCache creates an in-memory store that holds up to capacity bytes
+// of responses.
+func NewMemoryCache(capacity int64) *MemoryCache {
+	return &MemoryCache{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New()}
+}
+
+// Get returns the response stored under key, or nil if there isn't one.
+func (cache *MemoryCache) Get(key string) *CachedResponse {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, present := cache.entries[key]
+	if !present {
+		return nil
+	}
+	cache.order.MoveToFront(element)
+	return element.Value.(*memoryEntry).response
+}
+
+// Set stores a response under key, evicting the least recently used
+// responses to make room for it.  Responses larger than the cache's capacity
+// aren't stored.
+func (cache *MemoryCache) Set(key string, response *CachedResponse) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.remove(key)
+	if response.Size() > cache.capacity {
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(&memoryEntry{key: key, response: response})
+	cache.size += response.Size()
+	for cache.size > cache.capacity {
+		cache.remove(cache.order.Back().Value.(*memoryEntry).key)
+	}
+}
+
+// Delete removes the response stored under key.
+func (cache *MemoryCache) Delete(key string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.remove(key)
+}
+
+// Keys returns the keys of the stored responses.
+func (cache *MemoryCache) Keys() []string {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	keys := make([]string, 0, len(cache.entries))
+	for key := range cache.entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Len returns the number of stored responses.
+func (cache *MemoryCache) Len() int {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return len(cache.entries)
+}
+
+// Remove removes the response stored under key.  The caller must hold the
+// mutex.
+func (cache *MemoryCache) remove(key string) {
+	element, present := cache.entries[key]
+	if !present {
+		return
+	}
+	cache.order.Remove(element)
+	delete(cache.entries, key)
+	cache.size -= element.Value.(*memoryEntry).response.Size()
+}
+
+// CacheConfig enables response caching for a route.  Responses are cached
+// as a shared cache would, following RFC 9111: only responses to GET
+// requests that Cache-Control allows a shared cache to store are held, and
+// they're served until they become stale, after which they're revalidated
+// with the backend service using their ETag or Last-Modified validators.
+// One variant of each URL is held; a request whose Vary headers don't match
+// it replaces it.
+type CacheConfig struct {
+	// DefaultTTL is the freshness lifetime of responses that don't declare
+	// one with Cache-Control or Expires.  Zero stores such responses only
+	// if they have validators, and revalidates them every time they're
+	// used.
+	DefaultTTL time.Duration
+
+	// MaxBodySize is the largest response body, in bytes, that's stored.
+	MaxBodySize int64
+
+	// CredentialHeaders lists the request headers that carry client
+	// credentials.  Responses to requests with any of them, or to requests
+	// authenticated by the exchange, are only stored if they're marked
+	// public or s-maxage.  DefaultCredentialHeaders is used if it's nil.
+	CredentialHeaders []string
+}
+
+// DefaultCredentialHeaders are the request headers that carry client
+// credentials when CacheConfig.CredentialHeaders isn't set.
+var DefaultCredentialHeaders = []string{"Authorization", DefaultAPIKeyHeader}
+
+// SetCacheStore configures the store cached responses are held in.  A nil
+// store disables caching.
+func (mux *ExchangeServeMux) SetCacheStore(store CacheStore) {
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.cacheStore = store
+}
+
+// SetRouteCache enables response caching for an HTTP method and URL
+// pattern.  A nil config disables it.  Caching has no effect until a store
+// is configured with SetCacheStore.
+func (mux *ExchangeServeMux) SetRouteCache(method, pattern string, config *CacheConfig) error {
+	if config != nil && (config.DefaultTTL < 0 || config.MaxBodySize < 0) {
+		return errors.New("Cache limits must not be negative")
+	}
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.config(method, pattern).cache = config
+	return nil
+}
+
+// PurgeCache removes cached responses for URLs that match pattern, which
+// uses the same syntax as route patterns, and returns the number removed.
+// For example, /user/:id purges every user and /files/ purges everything
+// under /files.
+func (mux *ExchangeServeMux) PurgeCache(pattern string) int {
+	mux.rw.RLock()
+	store := mux.cacheStore
+	mux.rw.RUnlock()
+	if store == nil {
+		return 0
+	}
+	handler := &patternHandler{pattern: pattern}
+	purged := 0
+	for _, key := range store.Keys() {
+		_, uri := parseCacheKey(key)
+		target, err := url.ParseRequestURI(uri)
+		if err == nil && handler.Match(target.Path) {
+			store.Delete(key)
+			purged++
+		}
+	}
+	return purged
+}
+
+// Cached sends a proxied request through the response cache if caching is
+// enabled for the route, and passes requests the cache can't answer on to
+// coalesce.
+func (mux *ExchangeServeMux) cached(route *Route, request, outbound *http.Request) (*http.Response, error) {
+	mux.rw.RLock()
+	store := mux.cacheStore
+	var config *CacheConfig
+	if routeConfig, present := mux.configs[routeKey(route.Method, route.Pattern)]; present {
+		config = routeConfig.cache
+	}
+	mux.rw.RUnlock()
+	if store == nil || config == nil {
+		return mux.coalesce(route, request, outbound)
+	}
+
+	key := cacheKey(request.Method, request.URL.RequestURI(), route)
+	if request.Method != "GET" {
+		response, err := mux.coalesce(route, request, outbound)
+		if err == nil && request.Method != "HEAD" && request.Method != "OPTIONS" &&
+			response.StatusCode < http.StatusBadRequest {
+			// Unsafe requests that succeed invalidate the cached responses
+			// for their URL, from every version of the service.
+			for _, cachedKey := range store.Keys() {
+				if method, uri := parseCacheKey(cachedKey); method == "GET" && uri == request.URL.RequestURI() {
+					store.Delete(cachedKey)
+				}
+			}
+		}
+		return response, err
+	}
+	directives := parseCacheControl(request.Header.Get("Cache-Control"))
+	if _, present := directives["no-store"]; present {
+		response, err := mux.coalesce(route, request, outbound)
+		if err == nil {
+			response.Header.Set(CacheStatusHeader, "switchboard; fwd=bypass")
+		}
+		return response, err
+	}
+
+	now := time.Now()
+	cached := store.Get(key)
+	if cached != nil && cached.matches(request) {
+		if cached.fresh(config, directives, now) {
+			route.Cache = "hit"
+			return cached.response(request, now, "switchboard; hit"), nil
+		}
+		// Validators are added before the request is signed, so the
+		// signature covers them.
+		if validated := cached.validate(outbound); validated {
+			response, err := mux.coalesce(route, request, outbound)
+			if err != nil {
+				return nil, err
+			}
+			if response.StatusCode == http.StatusNotModified {
+				response.Body.Close()
+				refreshed := cached.refresh(response, now, time.Now())
+				store.Set(key, refreshed)
+				route.Cache = "revalidated"
+				return refreshed.response(request, time.Now(), "switchboard; fwd=stale; fwd-status=304"), nil
+			}
+			return storeResponse(store, key, config, route, request, response, now, "stale")
+		}
+	}
+
+	fwd := "miss"
+	if cached != nil {
+		fwd = "stale"
+		if !cached.matches(request) {
+			fwd = "vary-miss"
+		}
+	}
+	response, err := mux.coalesce(route, request, outbound)
+	if err != nil {
+		return nil, err
+	}
+	return storeResponse(store, key, config, route, request, response, now, fwd)
+}
+
+// CacheKey returns the key a response is cached under.  Traffic policies may
+// send requests for the same URL to different versions of a service, which
+// never share a cached response, so the key names the selected service and
+// version, as in "GET /user/123 users v2".
+func cacheKey(method, uri string, route *Route) string {
+	key := method + " " + uri
+	if route.Service != nil {
+		key += " " + route.Service.LogicalName()
+		if route.Service.Version != "" {
+			key += " " + route.Service.Version
+		}
+	}
+	return key
+}
+
+// ParseCacheKey returns the method and request URI a cache key names.
+func parseCacheKey(key string) (string, string) {
+	method, rest, _ := strings.Cut(key, " ")
+	uri, _, _ := strings.Cut(rest, " ")
+	return method, uri
+}
+
+// Credentialed returns true if a request carries client credentials or was
+// authenticated by the exchange.
+func credentialed(config *CacheConfig, route *Route, request *http.Request) bool {
+	if route.Principal != nil {
+		return true
+	}
+	headers := config.CredentialHeaders
+	if headers == nil {
+		headers = DefaultCredentialHeaders
+	}
+	for _, header := range headers {
+		if request.Header.Get(header) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// StoreResponse stores a response from a backend service, if it's
+// cacheable, and returns it ready to be relayed to the client.
+func storeResponse(store CacheStore, key string, config *CacheConfig, route *Route, request *http.Request, response *http.Response, requestTime time.Time, fwd string) (*http.Response, error) {
+	status := "switchboard; fwd=" + fwd + "; fwd-status=" + strconv.Itoa(response.StatusCode)
+	if !storable(config, route, request, response) {
+		response.Header.Set(CacheStatusHeader, status)
+		return response, nil
+	}
+	maxBodySize := config.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxCachedBody
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxBodySize+1))
+	if err != nil {
+		response.Body.Close()
+		return nil, err
+	}
+	if int64(len(body)) > maxBodySize {
+		// The body is too big to store, so relay what's been read followed
+		// by the rest of it.
+		response.Body = readCloser{io.MultiReader(bytes.NewReader(body), response.Body), response.Body}
+		response.Header.Set(CacheStatusHeader, status)
+		return response, nil
+	}
+	response.Body.Close()
+	cached := &CachedResponse{
+		StatusCode:   response.StatusCode,
+		Header:       storedHeader(response.Header),
+		Body:         body,
+		Vary:         make(http.Header),
+		RequestTime:  requestTime,
+		ResponseTime: time.Now()}
+	for _, name := range splitHeaderList(response.Header.Get("Vary")) {
+		cached.Vary[http.CanonicalHeaderKey(name)] = request.Header.Values(name)
+	}
+	store.Set(key, cached)
+	response.Header.Set(CacheStatusHeader, status+"; stored")
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	response.ContentLength = int64(len(body))
+	return response, nil
+}
+
+// Storable returns true if a shared cache may store response, as described
+// in RFC 9111 section 3.  Responses to requests with credentials must be
+// explicitly shareable, so one client's response is never served to
+// another.
+func storable(config *CacheConfig, route *Route, request *http.Request, response *http.Response) bool {
+	switch response.StatusCode {
+	case 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501:
+	default:
+		return false
+	}
+	requestDirectives := parseCacheControl(request.Header.Get("Cache-Control"))
+	directives := parseCacheControl(response.Header.Get("Cache-Control"))
+	for _, directive := range []string{"no-store", "private"} {
+		if _, present := directives[directive]; present {
+			return false
+		}
+	}
+	if _, present := requestDirectives["no-store"]; present {
+		return false
+	}
+	if response.Header.Get("Vary") == "*" || response.Header.Get("Set-Cookie") != "" {
+		return false
+	}
+	_, public := directives["public"]
+	_, sMaxAge := directives["s-maxage"]
+	if credentialed(config, route, request) && !public && !sMaxAge {
+		return false
+	}
+	_, maxAge := directives["max-age"]
+	return sMaxAge || maxAge || response.Header.Get("Expires") != "" || config.DefaultTTL > 0 ||
+		response.Header.Get("ETag") != "" || response.Header.Get("Last-Modified") != ""
+}
+
+// Matches returns true if the request headers named by the cached response's
+// Vary header match request's.
+func (cached *CachedResponse) matches(request *http.Request) bool {
+	for name, values := range cached.Vary {
+		if strings.Join(values, ",") != strings.Join(request.Header.Values(name), ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// Age returns the current age of the cached response, as described in RFC
+// 9111 section 4.2.3.
+func (cached *CachedResponse) age(now time.Time) time.Duration {
+	apparentAge := time.Duration(0)
+	if date, err := http.ParseTime(cached.Header.Get("Date")); err == nil && cached.ResponseTime.After(date) {
+		apparentAge = cached.ResponseTime.Sub(date)
+	}
+	ageValue, _ := strconv.Atoi(cached.Header.Get("Age"))
+	correctedAge := time.Duration(ageValue)*time.Second + cached.ResponseTime.Sub(cached.RequestTime)
+	if correctedAge > apparentAge {
+		apparentAge = correctedAge
+	}
+	return apparentAge + now.Sub(cached.ResponseTime)
+}
+
+// Lifetime returns the freshness lifetime of the cached response, as
+// described in RFC 9111 section 4.2.1.
+func (cached *CachedResponse) lifetime(config *CacheConfig) time.Duration {
+	directives := parseCacheControl(cached.Header.Get("Cache-Control"))
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, present := directives[directive]; present {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds < 0 {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+	if value := cached.Header.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			return 0
+		}
+		date, err := http.ParseTime(cached.Header.Get("Date"))
+		if err != nil {
+			date = cached.ResponseTime
+		}
+		return expires.Sub(date)
+	}
+	return config.DefaultTTL
+}
+
+// Fresh returns true if the cached response can be used without
+// revalidating it, taking the request's Cache-Control directives into
+// account.
+func (cached *CachedResponse) fresh(config *CacheConfig, requestDirectives map[string]string, now time.Time) bool {
+	if _, present := requestDirectives["no-cache"]; present {
+		return false
+	}
+	if _, present := parseCacheControl(cached.Header.Get("Cache-Control"))["no-cache"]; present {
+		return false
+	}
+	age := cached.age(now)
+	if value, present := requestDirectives["max-age"]; present {
+		seconds, err := strconv.Atoi(value)
+		if err == nil && age > time.Duration(seconds)*time.Second {
+			return false
+		}
+	}
+	return age < cached.lifetime(config)
+}
+
+// Validate makes outbound a conditional request for the cached response and
+// returns true, or returns false if the cached response has no validators.
+// Conditional headers sent by the client are replaced, since they refer to
+// the client's copy rather than the cache's.
+func (cached *CachedResponse) validate(outbound *http.Request) bool {
+	etag := cached.Header.Get("ETag")
+	lastModified := cached.Header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return false
+	}
+	outbound.Header.Del("If-None-Match")
+	outbound.Header.Del("If-Modified-Since")
+	if etag != "" {
+		outbound.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		outbound.Header.Set("If-Modified-Since", lastModified)
+	}
+	return true
+}
+
+// Refresh returns a copy of the cached response updated with the headers of
+// a 304 Not Modified response, as described in RFC 9111 section 4.3.4.
+func (cached *CachedResponse) refresh(notModified *http.Response, requestTime, responseTime time.Time) *CachedResponse {
+	refreshed := *cached
+	refreshed.Header = cached.Header.Clone()
+	for name, values := range storedHeader(notModified.Header) {
+		if name != "Content-Length" {
+			refreshed.Header[name] = values
+		}
+	}
+	refreshed.RequestTime = requestTime
+	refreshed.ResponseTime = responseTime
+	return &refreshed
+}
+
+// Response creates a response to request from the cached response.
+// Conditional requests the cached response satisfies receive 304 Not
+// Modified.
+func (cached *CachedResponse) response(request *http.Request, now time.Time, status string) *http.Response {
+	header := cached.Header.Clone()
+	header.Set("Age", strconv.Itoa(int(cached.age(now)/time.Second)))
+	header.Set(CacheStatusHeader, status)
+	response := &http.Response{
+		StatusCode:    cached.StatusCode,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(cached.Body)),
+		ContentLength: int64(len(cached.Body))}
+	etag := cached.Header.Get("ETag")
+	if match := request.Header.Get("If-None-Match"); match != "" && etag != "" {
+		for _, candidate := range splitHeaderList(match) {
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				response.StatusCode = http.StatusNotModified
+				response.Body = http.NoBody
+				response.ContentLength = 0
+				header.Del("Content-Length")
+				break
+			}
+		}
+	}
+	return response
+}
+
+// StoredHeader returns a copy of header without hop-by-hop headers, which
+// apply to a single connection and mustn't be stored.
+func storedHeader(header http.Header) http.Header {
+	stored := header.Clone()
+	for _, name := range splitHeaderList(header.Get("Connection")) {
+		stored.Del(name)
+	}
+	for _, name := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te",
+		"Trailer", "Transfer-Encoding", "Upgrade", CacheStatusHeader} {
+		stored.Del(name)
+	}
+	return stored
+}
+
+// ParseCacheControl parses a Cache-Control header into directives keyed by
+// lowercase name.  Directives without a value map to an empty string.
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range splitHeaderList(value) {
+		name, argument, _ := strings.Cut(directive, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(argument), `"`)
+	}
+	return directives
+}
+
+// ReadCloser combines a reader with the closer of the body it reads from.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// CacheState describes the responses held by a CacheStore.
+type CacheState struct {
+	Keys []string `json:"keys"`
+}
+
+// CacheState returns a snapshot of the cached response keys, sorted, or
+// nil if caching is disabled.
+func (mux *ExchangeServeMux) CacheState() *CacheState {
+	mux.rw.RLock()
+	store := mux.cacheStore
+	mux.rw.RUnlock()
+	if store == nil {
+		return nil
+	}
+	keys := store.Keys()
+	sort.Strings(keys)
+	return &CacheState{Keys: keys}
+}
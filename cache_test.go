@@ -0,0 +1,346 @@
+package switchboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type CacheTest struct {
+	mux      *ExchangeServeMux
+	server   *httptest.Server
+	store    *MemoryCache
+	requests int32
+	header   http.Header
+}
+
+var _ = Suite(&CacheTest{})
+
+func (s *CacheTest) SetUpTest(c *C) {
+	s.requests = 0
+	s.header = http.Header{"Cache-Control": {"max-age=60"}}
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			count := atomic.AddInt32(&s.requests, 1)
+			for name, values := range s.header {
+				writer.Header()[name] = values
+			}
+			if request.Method != "GET" {
+				return
+			}
+			if etag := writer.Header().Get("ETag"); etag != "" && request.Header.Get("If-None-Match") == etag {
+				writer.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprintf(writer, "%s %d %s", request.URL.Path, count, request.Header.Get("Accept-Language"))
+		}))
+	s.store = NewMemoryCache(1 << 20)
+	s.mux = NewExchangeServeMux()
+	s.mux.Add("GET", "/user/:id", s.server.URL)
+	s.mux.Add("PUT", "/user/:id", s.server.URL)
+	s.mux.Add("GET", "/users", s.server.URL)
+	s.mux.SetCacheStore(s.store)
+	c.Assert(s.mux.SetRouteCache("GET", "/user/:id", &CacheConfig{}), IsNil)
+	c.Assert(s.mux.SetRouteCache("PUT", "/user/:id", &CacheConfig{}), IsNil)
+}
+
+func (s *CacheTest) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+// Send makes a request through the mux.
+func (s *CacheTest) send(c *C, method, path string, header http.Header) *httptest.ResponseRecorder {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest(method, "http://example.com"+path, nil)
+	c.Assert(err, IsNil)
+	if header != nil {
+		request.Header = header
+	}
+	s.mux.ServeHTTP(writer, request)
+	return writer
+}
+
+// Fresh responses are served from the cache without contacting the backend
+// service.
+func (s *CacheTest) TestHit(c *C) {
+	writer := s.send(c, "GET", "/user/1", nil)
+	c.Assert(writer.Body.String(), Equals, "/user/1 1 ")
+	c.Assert(writer.Header().Get(CacheStatusHeader), Equals, "switchboard; fwd=miss; fwd-status=200; stored")
+
+	var route *Route
+	s.mux.Use(&Middleware{Complete: func(request *http.Request, completed *Route) { route = completed }})
+	writer = s.send(c, "GET", "/user/1", nil)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(writer.Body.String(), Equals, "/user/1 1 ")
+	c.Assert(writer.Header().Get(CacheStatusHeader), Equals, "switchboard; hit")
+	c.Assert(writer.Header().Get("Age"), Equals, "0")
+	c.Assert(route.Cache, Equals, "hit")
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(1))
+
+	// Routes without caching enabled always reach the backend service.
+	s.send(c, "GET", "/users", nil)
+	s.send(c, "GET", "/users", nil)
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(3))
+}
+
+// Responses that forbid storage, private responses and responses without
+// freshness information or validators aren't stored.
+func (s *CacheTest) TestNotStorable(c *C) {
+	for i, cacheControl := range []string{"no-store", "private, max-age=60", ""} {
+		s.header = http.Header{"Cache-Control": {cacheControl}}
+		path := fmt.Sprintf("/user/%d", i)
+		s.send(c, "GET", path, nil)
+		writer := s.send(c, "GET", path, nil)
+		c.Assert(writer.Header().Get(CacheStatusHeader), Matches, "switchboard; fwd=miss; fwd-status=200",
+			Commentf("%q", cacheControl))
+	}
+	c.Assert(s.store.Len(), Equals, 0)
+
+	// Responses to requests with credentials are only stored if they're
+	// explicitly public.
+	s.header = http.Header{"Cache-Control": {"max-age=60"}}
+	s.send(c, "GET", "/user/1", http.Header{"Authorization": {"Bearer token"}})
+	c.Assert(s.store.Len(), Equals, 0)
+	s.header = http.Header{"Cache-Control": {"public, max-age=60"}}
+	s.send(c, "GET", "/user/1", http.Header{"Authorization": {"Bearer token"}})
+	c.Assert(s.store.Len(), Equals, 1)
+}
+
+// Responses to requests authenticated with API keys aren't shared with
+// clients using other keys, whether or not the exchange authenticated them.
+func (s *CacheTest) TestAPIKeys(c *C) {
+	alice, bob := make(http.Header), make(http.Header)
+	alice.Set(DefaultAPIKeyHeader, "alice-key")
+	bob.Set(DefaultAPIKeyHeader, "bob-key")
+	s.send(c, "GET", "/user/1", alice)
+	writer := s.send(c, "GET", "/user/1", bob)
+	c.Assert(writer.Body.String(), Equals, "/user/1 2 ")
+	c.Assert(s.store.Len(), Equals, 0)
+
+	s.mux.Use(Authentication(&AuthConfig{
+		APIKeyHeader: "X-Key",
+		APIKeys:      []APIKey{{Key: "alice-key", Subject: "alice"}, {Key: "bob-key", Subject: "bob"}}}))
+	s.send(c, "GET", "/user/1", http.Header{"X-Key": {"alice-key"}})
+	writer = s.send(c, "GET", "/user/1", http.Header{"X-Key": {"bob-key"}})
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(writer.Body.String(), Equals, "/user/1 4 ")
+	c.Assert(s.store.Len(), Equals, 0)
+
+	// Responses marked shareable are stored.
+	s.header = http.Header{"Cache-Control": {"s-maxage=60"}}
+	s.send(c, "GET", "/user/1", http.Header{"X-Key": {"alice-key"}})
+	writer = s.send(c, "GET", "/user/1", http.Header{"X-Key": {"bob-key"}})
+	c.Assert(writer.Body.String(), Equals, "/user/1 5 ")
+	c.Assert(writer.Header().Get(CacheStatusHeader), Equals, "switchboard; hit")
+}
+
+// Requests can bypass the cache or require revalidation with
+// Cache-Control.
+func (s *CacheTest) TestRequestDirectives(c *C) {
+	s.send(c, "GET", "/user/1", nil)
+	writer := s.send(c, "GET", "/user/1", http.Header{"Cache-Control": {"no-store"}})
+	c.Assert(writer.Header().Get(CacheStatusHeader), Equals, "switchboard; fwd=bypass")
+	writer = s.send(c, "GET", "/user/1", http.Header{"Cache-Control": {"no-cache"}})
+	c.Assert(writer.Header().Get(CacheStatusHeader), Equals, "switchboard; fwd=stale; fwd-status=200; stored")
+	c.Assert(writer.Body.String(), Equals, "/user/1 3 ")
+}
+
+// Stale responses with validators are revalidated with a conditional
+// request, and served from the cache if they haven't changed.
+func (s *CacheTest) TestRevalidation(c *C) {
+	s.header = http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}
+	writer := s.send(c, "GET", "/user/1", nil)
+	c.Assert(writer.Body.String(), Equals, "/user/1 1 ")
+
+	writer = s.send(c, "GET", "/user/1", http.Header{"If-None-Match": {`"v0"`}})
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(writer.Body.String(), Equals, "/user/1 1 ")
+	c.Assert(writer.Header().Get(CacheStatusHeader), Equals, "switchboard; fwd=stale; fwd-status=304")
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(2))
+
+	// Clients revalidating their own copy receive 304 Not Modified.
+	writer = s.send(c, "GET", "/user/1", http.Header{"If-None-Match": {`"v1"`}})
+	c.Assert(writer.Code, Equals, http.StatusNotModified)
+	c.Assert(writer.Body.String(), Equals, "")
+
+	s.header.Set("Etag", `"v2"`)
+	writer = s.send(c, "GET", "/user/1", nil)
+	c.Assert(writer.Body.String(), Equals, "/user/1 4 ")
+	c.Assert(writer.Header().Get("Etag"), Equals, `"v2"`)
+}
+
+// Revalidation requests are signed after the cache adds its validators, so
+// services that verify signatures covering conditional headers accept them.
+func (s *CacheTest) TestSignedRevalidation(c *C) {
+	key := SigningKey{ID: "test", Secret: []byte("secret")}
+	s.server.Config.Handler = VerifySignatures(s.server.Config.Handler, key)
+	headers := append([]string{"If-None-Match"}, DefaultSignedHeaders...)
+	s.mux.SignRequests(NewRequestSigner(key, headers...))
+	s.header = http.Header{"Cache-Control": {"no-cache"}, "Etag": {`"v1"`}}
+	writer := s.send(c, "GET", "/user/1", nil)
+	c.Assert(writer.Body.String(), Equals, "/user/1 1 ")
+
+	writer = s.send(c, "GET", "/user/1", http.Header{"If-None-Match": {`"v0"`}})
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(writer.Body.String(), Equals, "/user/1 1 ")
+	c.Assert(writer.Header().Get(CacheStatusHeader), Equals, "switchboard; fwd=stale; fwd-status=304")
+}
+
+// Responses from different versions of a service, chosen by a traffic
+// policy, are cached separately.
+func (s *CacheTest) TestVersions(c *C) {
+	canary := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			writer.Header().Set("Cache-Control", "max-age=60")
+			writer.Write([]byte("canary"))
+		}))
+	defer canary.Close()
+	mux := NewExchangeServeMux()
+	mux.AddService(&ServiceRecord{ID: "users-v1", Name: "users", Version: "v1", Address: s.server.URL,
+		Routes: Routes{"GET": []string{"/user/:id"}, "PUT": []string{"/user/:id"}}})
+	mux.AddService(&ServiceRecord{ID: "users-v2", Name: "users", Version: "v2", Address: canary.URL,
+		Routes: Routes{"GET": []string{"/user/:id"}}})
+	c.Assert(mux.SetTrafficPolicy(&TrafficPolicy{
+		Service: "users",
+		Matches: []VersionMatch{{Header: "X-Canary", Version: "v2"}},
+		Splits:  []VersionSplit{{Version: "v1", Weight: 1}}}), IsNil)
+	mux.SetCacheStore(s.store)
+	c.Assert(mux.SetRouteCache("GET", "/user/:id", &CacheConfig{}), IsNil)
+	c.Assert(mux.SetRouteCache("PUT", "/user/:id", &CacheConfig{}), IsNil)
+	send := func(method string, header http.Header) string {
+		writer := httptest.NewRecorder()
+		request, err := http.NewRequest(method, "http://example.com/user/1", nil)
+		c.Assert(err, IsNil)
+		if header != nil {
+			request.Header = header
+		}
+		mux.ServeHTTP(writer, request)
+		return writer.Body.String()
+	}
+
+	c.Assert(send("GET", http.Header{"X-Canary": {"true"}}), Equals, "canary")
+	c.Assert(send("GET", nil), Equals, "/user/1 1 ")
+	c.Assert(send("GET", nil), Equals, "/user/1 1 ")
+	c.Assert(send("GET", http.Header{"X-Canary": {"true"}}), Equals, "canary")
+	c.Assert(mux.CacheState().Keys, DeepEquals, []string{"GET /user/1 users v1", "GET /user/1 users v2"})
+
+	// Unsafe requests invalidate the cached responses from every version.
+	send("PUT", nil)
+	c.Assert(mux.CacheState().Keys, HasLen, 0)
+	c.Assert(mux.PurgeCache("/user/:id"), Equals, 0)
+}
+
+// Freshness is calculated from max-age, s-maxage or Expires, and the
+// response's age.
+func (s *CacheTest) TestFreshness(c *C) {
+	now := time.Now()
+	config := &CacheConfig{DefaultTTL: time.Minute}
+	cached := &CachedResponse{
+		Header:       http.Header{"Date": {now.Add(-30 * time.Second).UTC().Format(http.TimeFormat)}},
+		RequestTime:  now.Add(-30 * time.Second),
+		ResponseTime: now.Add(-30 * time.Second)}
+	c.Assert(cached.fresh(config, nil, now), Equals, true)
+	cached.Header.Set("Cache-Control", "max-age=10")
+	c.Assert(cached.fresh(config, nil, now), Equals, false)
+	cached.Header.Set("Cache-Control", "max-age=10, s-maxage=120")
+	c.Assert(cached.fresh(config, nil, now), Equals, true)
+	c.Assert(cached.fresh(config, map[string]string{"max-age": "20"}, now), Equals, false)
+	cached.Header.Set("Cache-Control", "")
+	cached.Header.Set("Expires", now.Add(-time.Second).UTC().Format(http.TimeFormat))
+	c.Assert(cached.fresh(config, nil, now), Equals, false)
+	cached.Header.Set("Age", "100")
+	c.Assert(cached.age(now) >= 130*time.Second, Equals, true)
+}
+
+// One variant of each URL is cached, and requests whose Vary headers don't
+// match it replace it.
+func (s *CacheTest) TestVary(c *C) {
+	s.header = http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"Accept-Language"}}
+	english := http.Header{"Accept-Language": {"en"}}
+	french := http.Header{"Accept-Language": {"fr"}}
+	c.Assert(s.send(c, "GET", "/user/1", english).Body.String(), Equals, "/user/1 1 en")
+	c.Assert(s.send(c, "GET", "/user/1", english).Body.String(), Equals, "/user/1 1 en")
+	writer := s.send(c, "GET", "/user/1", french)
+	c.Assert(writer.Body.String(), Equals, "/user/1 2 fr")
+	c.Assert(writer.Header().Get(CacheStatusHeader), Equals, "switchboard; fwd=vary-miss; fwd-status=200; stored")
+	c.Assert(s.send(c, "GET", "/user/1", french).Body.String(), Equals, "/user/1 2 fr")
+
+	s.header.Set("Vary", "*")
+	s.send(c, "GET", "/user/2", nil)
+	c.Assert(s.send(c, "GET", "/user/2", nil).Body.String(), Equals, "/user/2 4 ")
+}
+
+// Successful unsafe requests invalidate the cached response for their URL.
+func (s *CacheTest) TestInvalidation(c *C) {
+	s.send(c, "GET", "/user/1", nil)
+	s.send(c, "GET", "/user/2", nil)
+	c.Assert(s.send(c, "PUT", "/user/1", nil).Code, Equals, http.StatusOK)
+	c.Assert(s.send(c, "GET", "/user/1", nil).Body.String(), Equals, "/user/1 4 ")
+	c.Assert(s.send(c, "GET", "/user/2", nil).Body.String(), Equals, "/user/2 2 ")
+}
+
+// Responses larger than the body limit are relayed without being stored.
+func (s *CacheTest) TestMaxBodySize(c *C) {
+	c.Assert(s.mux.SetRouteCache("GET", "/user/:id", &CacheConfig{MaxBodySize: 5}), IsNil)
+	writer := s.send(c, "GET", "/user/1", nil)
+	c.Assert(writer.Body.String(), Equals, "/user/1 1 ")
+	c.Assert(s.store.Len(), Equals, 0)
+	c.Assert(s.mux.SetRouteCache("GET", "/user/:id", &CacheConfig{MaxBodySize: -1}), ErrorMatches,
+		"Cache limits must not be negative")
+}
+
+// MemoryCache evicts the least recently used responses when it's full.
+func (s *CacheTest) TestMemoryCacheEviction(c *C) {
+	store := NewMemoryCache(25)
+	response := func(body string) *CachedResponse { return &CachedResponse{Body: []byte(body)} }
+	store.Set("GET /a", response("0123456789"))
+	store.Set("GET /b", response("0123456789"))
+	c.Assert(store.Get("GET /a"), NotNil)
+	store.Set("GET /c", response("0123456789"))
+	c.Assert(store.Get("GET /b"), IsNil)
+	c.Assert(store.Get("GET /a"), NotNil)
+	c.Assert(store.Get("GET /c"), NotNil)
+	store.Set("GET /d", response(strings.Repeat("x", 30)))
+	c.Assert(store.Get("GET /d"), IsNil)
+	c.Assert(store.Len(), Equals, 2)
+	store.Delete("GET /a")
+	c.Assert(store.Keys(), DeepEquals, []string{"GET /c"})
+}
+
+// Cached responses can be purged by pattern through the admin API.
+func (s *CacheTest) TestPurge(c *C) {
+	s.mux.Add("GET", "/files/", s.server.URL)
+	c.Assert(s.mux.SetRouteCache("GET", "/files/", &CacheConfig{}), IsNil)
+	for _, path := range []string{"/user/1", "/user/2?fields=name", "/files/a", "/files/b/c"} {
+		s.send(c, "GET", path, nil)
+	}
+	admin := NewAdmin(NewExchange("test", nil, s.mux), nil)
+	writer := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://admin/cache", nil)
+	admin.ServeHTTP(writer, request)
+	var state CacheState
+	c.Assert(json.Unmarshal(writer.Body.Bytes(), &state), IsNil)
+	c.Assert(state.Keys, DeepEquals, []string{
+		"GET /files/a", "GET /files/b/c", "GET /user/1", "GET /user/2?fields=name"})
+
+	writer = httptest.NewRecorder()
+	request, _ = http.NewRequest("GET", "http://admin/cache/purge?pattern=/user/:id", nil)
+	admin.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusMethodNotAllowed)
+
+	writer = httptest.NewRecorder()
+	request, _ = http.NewRequest("POST", "http://admin/cache/purge?pattern=/user/:id", nil)
+	admin.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	var purged map[string]int
+	c.Assert(json.Unmarshal(writer.Body.Bytes(), &purged), IsNil)
+	c.Assert(purged, DeepEquals, map[string]int{"purged": 2})
+	c.Assert(s.mux.PurgeCache("/files/"), Equals, 2)
+	c.Assert(s.store.Len(), Equals, 0)
+}
@@ -0,0 +1,157 @@
+package switchboard
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultCoalescedHeaders are the request headers that distinguish otherwise
+// identical requests when CoalesceConfig.Headers isn't set.  They include
+// the headers that identify the client, so responses are never shared
+// between clients.
+var DefaultCoalescedHeaders = []string{
+	"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie",
+	DefaultAPIKeyHeader, AuthSubjectHeader, AuthScopesHeader}
+
+// DefaultMaxCoalescedBody is the largest response body shared between
+// coalesced requests when CoalesceConfig.MaxBodySize isn't set.
+const DefaultMaxCoalescedBody = 1 << 20
+
+// CoalesceConfig enables request coalescing for a route.  Concurrent GET
+// and HEAD requests for the same URL, with the same values for Headers,
+// share one request to the backend service, and its response is copied to
+// every waiting client.
+type CoalesceConfig struct {
+	// Headers lists the request headers that must match for requests to be
+	// coalesced.  Conditional request headers always must.
+	Headers []string
+
+	// MaxBodySize is the largest response body, in bytes, that's shared.
+	// Waiting requests whose shared response is bigger make their own
+	// request to the backend service.
+	MaxBodySize int64
+}
+
+// SetRouteCoalescing enables request coalescing for an HTTP method and URL
+// pattern.  A nil config disables it.
+func (mux *ExchangeServeMux) SetRouteCoalescing(method, pattern string, config *CoalesceConfig) error {
+	if config != nil && config.MaxBodySize < 0 {
+		return errors.New("Coalesced body size must not be negative")
+	}
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.config(method, pattern).coalesce = config
+	return nil
+}
+
+// Flight is a backend request shared by coalesced requests.
+type flight struct {
+	done     chan bool   // Closed when the response or error is available.
+	waiters  int         // The number of requests waiting for the response.
+	status   int         // The status code of the shared response.
+	header   http.Header // The headers of the shared response.
+	body     []byte      // The body of the shared response.
+	err      error       // The error that occurred sending the request.
+	tooLarge bool        // True if the body was too big to share.
+}
+
+// Coalesce sends a proxied request to the route's backend service, sharing
+// the request with concurrent identical requests if coalescing is enabled
+// for the route.  The first request is sent with hedge and the others wait
+// for its response.
+func (mux *ExchangeServeMux) coalesce(route *Route, request, outbound *http.Request) (*http.Response, error) {
+	mux.rw.RLock()
+	var config *CoalesceConfig
+	if routeConfig, present := mux.configs[routeKey(route.Method, route.Pattern)]; present {
+		config = routeConfig.coalesce
+	}
+	mux.rw.RUnlock()
+	if config == nil || (outbound.Method != "GET" && outbound.Method != "HEAD") {
+		return mux.hedge(route, request, outbound)
+	}
+
+	key := coalesceKey(config, route, outbound)
+	mux.flightMutex.Lock()
+	if current, present := mux.flights[key]; present {
+		current.waiters++
+		mux.flightMutex.Unlock()
+		start := time.Now()
+		<-current.done
+		route.Upstream += time.Since(start)
+		if current.tooLarge {
+			return mux.hedge(route, request, outbound)
+		}
+		if current.err != nil {
+			return nil, current.err
+		}
+		route.Coalesced = true
+		return &http.Response{
+			StatusCode:    current.status,
+			Header:        current.header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(current.body)),
+			ContentLength: int64(len(current.body))}, nil
+	}
+	current := &flight{done: make(chan bool)}
+	mux.flights[key] = current
+	mux.flightMutex.Unlock()
+
+	response, err := mux.hedge(route, request, outbound)
+	defer func() {
+		mux.flightMutex.Lock()
+		delete(mux.flights, key)
+		mux.flightMutex.Unlock()
+		close(current.done)
+	}()
+	if err != nil {
+		current.err = err
+		return nil, err
+	}
+	maxBodySize := config.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = DefaultMaxCoalescedBody
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, maxBodySize+1))
+	if err != nil {
+		response.Body.Close()
+		current.err = err
+		return nil, err
+	}
+	if int64(len(body)) > maxBodySize {
+		current.tooLarge = true
+		response.Body = readCloser{io.MultiReader(bytes.NewReader(body), response.Body), response.Body}
+		return response, nil
+	}
+	response.Body.Close()
+	current.status = response.StatusCode
+	current.header = response.Header.Clone()
+	current.body = body
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	response.ContentLength = int64(len(body))
+	return response, nil
+}
+
+// CoalesceKey returns the key identifying requests that can share a
+// backend request.  Instances of the same version of a logical service are
+// interchangeable, so the key names the service and version rather than the
+// selected address.  Traffic policies may send otherwise identical requests
+// to different versions, which never share a response.
+func coalesceKey(config *CoalesceConfig, route *Route, outbound *http.Request) string {
+	service := route.Address
+	if route.Service != nil {
+		service = route.Service.LogicalName() + " " + route.Service.Version
+	}
+	var key strings.Builder
+	key.WriteString(service + "\n" + outbound.Method + " " + outbound.URL.RequestURI())
+	headers := config.Headers
+	if headers == nil {
+		headers = DefaultCoalescedHeaders
+	}
+	for _, header := range append([]string{"If-None-Match", "If-Modified-Since"}, headers...) {
+		key.WriteString("\n" + strings.ToLower(header) + ":" + strings.Join(outbound.Header.Values(header), ","))
+	}
+	return key.String()
+}
@@ -0,0 +1,183 @@
+package switchboard
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type CoalesceTest struct {
+	mux      *ExchangeServeMux
+	server   *httptest.Server
+	requests int32
+	started  chan bool
+	release  chan bool
+}
+
+var _ = Suite(&CoalesceTest{})
+
+func (s *CoalesceTest) SetUpTest(c *C) {
+	s.requests = 0
+	s.started = make(chan bool, 10)
+	s.release = make(chan bool)
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			count := atomic.AddInt32(&s.requests, 1)
+			s.started <- true
+			<-s.release
+			writer.Header().Set("X-Count", fmt.Sprint(count))
+			if request.URL.Path == "/large" {
+				writer.Write([]byte(strings.Repeat("x", 100)))
+				return
+			}
+			fmt.Fprintf(writer, "%s %d", request.URL.RequestURI(), count)
+		}))
+	s.mux = NewExchangeServeMux()
+	s.mux.Add("GET", "/user/:id", s.server.URL)
+	s.mux.Add("GET", "/large", s.server.URL)
+	c.Assert(s.mux.SetRouteCoalescing("GET", "/user/:id", &CoalesceConfig{}), IsNil)
+	c.Assert(s.mux.SetRouteCoalescing("GET", "/large", &CoalesceConfig{MaxBodySize: 10}), IsNil)
+}
+
+func (s *CoalesceTest) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+// Concurrently sends requests through the mux and returns the responses
+// once every request has joined the first one's flight and the backend
+// service has been allowed to answer.
+func (s *CoalesceTest) concurrently(c *C, path string, headers ...http.Header) []*httptest.ResponseRecorder {
+	writers := make([]*httptest.ResponseRecorder, len(headers))
+	var wait sync.WaitGroup
+	for i, header := range headers {
+		writers[i] = httptest.NewRecorder()
+		request, err := http.NewRequest("GET", "http://example.com"+path, nil)
+		c.Assert(err, IsNil)
+		request.Header = header
+		wait.Add(1)
+		go func(writer *httptest.ResponseRecorder) {
+			defer wait.Done()
+			s.mux.ServeHTTP(writer, request)
+		}(writers[i])
+		if i == 0 {
+			<-s.started
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		s.mux.flightMutex.Lock()
+		waiters := 0
+		for _, current := range s.mux.flights {
+			waiters += current.waiters
+		}
+		s.mux.flightMutex.Unlock()
+		if waiters+len(s.started) >= len(headers)-1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(s.release)
+	wait.Wait()
+	return writers
+}
+
+// Identical concurrent requests share one backend request.
+func (s *CoalesceTest) TestCoalesce(c *C) {
+	var mutex sync.Mutex
+	coalesced := 0
+	s.mux.Use(&Middleware{Complete: func(request *http.Request, route *Route) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if route.Coalesced {
+			coalesced++
+		}
+	}})
+	writers := s.concurrently(c, "/user/1?fields=name", http.Header{}, http.Header{}, http.Header{}, http.Header{})
+	for _, writer := range writers {
+		c.Assert(writer.Code, Equals, http.StatusOK)
+		c.Assert(writer.Body.String(), Equals, "/user/1?fields=name 1")
+		c.Assert(writer.Header().Get("X-Count"), Equals, "1")
+	}
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(1))
+	c.Assert(coalesced, Equals, 3)
+	c.Assert(s.mux.flights, HasLen, 0)
+}
+
+// Requests with different identifying headers aren't coalesced.
+func (s *CoalesceTest) TestDifferentHeaders(c *C) {
+	writers := s.concurrently(c, "/user/1",
+		http.Header{"Authorization": {"Bearer a"}},
+		http.Header{"Authorization": {"Bearer b"}},
+		http.Header{"Authorization": {"Bearer a"}})
+	c.Assert(writers[0].Body.String(), Equals, writers[2].Body.String())
+	c.Assert(writers[0].Body.String(), Not(Equals), writers[1].Body.String())
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(2))
+}
+
+// Requests from clients with different API keys aren't coalesced, even
+// when the exchange doesn't authenticate them.
+func (s *CoalesceTest) TestDifferentAPIKeys(c *C) {
+	alice, bob := http.Header{}, http.Header{}
+	alice.Set(DefaultAPIKeyHeader, "alice-key")
+	bob.Set(DefaultAPIKeyHeader, "bob-key")
+	writers := s.concurrently(c, "/user/1", alice, bob, alice)
+	c.Assert(writers[0].Body.String(), Equals, writers[2].Body.String())
+	c.Assert(writers[0].Body.String(), Not(Equals), writers[1].Body.String())
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(2))
+}
+
+// Requests a traffic policy sends to different versions of a service aren't
+// coalesced.
+func (s *CoalesceTest) TestVersions(c *C) {
+	canary := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte("canary"))
+		}))
+	defer canary.Close()
+	mux := NewExchangeServeMux()
+	mux.AddService(&ServiceRecord{ID: "users-v1", Name: "users", Version: "v1", Address: s.server.URL,
+		Routes: Routes{"GET": []string{"/user/:id"}}})
+	mux.AddService(&ServiceRecord{ID: "users-v2", Name: "users", Version: "v2", Address: canary.URL,
+		Routes: Routes{"GET": []string{"/user/:id"}}})
+	c.Assert(mux.SetTrafficPolicy(&TrafficPolicy{
+		Service: "users",
+		Matches: []VersionMatch{{Header: "X-Canary", Version: "v2"}},
+		Splits:  []VersionSplit{{Version: "v1", Weight: 1}}}), IsNil)
+	c.Assert(mux.SetRouteCoalescing("GET", "/user/:id", &CoalesceConfig{}), IsNil)
+
+	stable := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		request, _ := http.NewRequest("GET", "http://example.com/user/1", nil)
+		mux.ServeHTTP(stable, request)
+		close(done)
+	}()
+	<-s.started
+
+	// The canary request doesn't wait for the stable request's response.
+	writer := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com/user/1", nil)
+	request.Header.Set("X-Canary", "true")
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Body.String(), Equals, "canary")
+
+	close(s.release)
+	<-done
+	c.Assert(stable.Body.String(), Equals, "/user/1 1")
+}
+
+// Requests waiting for a response too big to share make their own backend
+// request.
+func (s *CoalesceTest) TestLargeResponse(c *C) {
+	writers := s.concurrently(c, "/large", http.Header{}, http.Header{})
+	for _, writer := range writers {
+		c.Assert(writer.Body.String(), Equals, strings.Repeat("x", 100))
+	}
+	c.Assert(writers[0].Header().Get("X-Count"), Not(Equals), writers[1].Header().Get("X-Count"))
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(2))
+}
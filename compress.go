@@ -0,0 +1,207 @@
+package switchboard
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultCompressionMinSize is the smallest response, in bytes, compressed
+// when CompressionConfig.MinSize isn't set.
+const DefaultCompressionMinSize = 1024
+
+// DefaultCompressedTypes are the media types compressed when
+// CompressionConfig.ContentTypes isn't set.
+var DefaultCompressedTypes = []string{
+	"text/*", "application/json", "application/javascript", "application/xml", "image/svg+xml"}
+
+// CompressionConfig describes which responses an ExchangeServeMux
+// compresses.  Responses are compressed with gzip or deflate, negotiated
+// with the client's Accept-Encoding header.  Responses already encoded by
+// the backend service, partial responses and responses marked no-transform
+// are relayed untouched.
+type CompressionConfig struct {
+	// MinSize is the smallest response, in bytes, worth compressing.
+	// Streamed responses of unknown length are always compressed.
+	MinSize int64
+
+	// ContentTypes lists the media types to compress.  An entry ending in
+	// /* matches any subtype.
+	ContentTypes []string
+
+	// Level is the compression level, from 1 (fastest) to 9 (smallest).
+	// Zero uses the default level.
+	Level int
+}
+
+// SetCompression configures response compression for every route.  A nil
+// config disables it.
+func (mux *ExchangeServeMux) SetCompression(config *CompressionConfig) error {
+	if config != nil && (config.Level < 0 || config.Level > flate.BestCompression) {
+		return errors.New("Invalid compression level " + strconv.Itoa(config.Level))
+	}
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.compression = config
+	return nil
+}
+
+// Compress returns the writer a backend service's response body should be
+// relayed through.  If the response should be compressed, its headers are
+// updated to describe the encoding, which must happen before the status is
+// written, and the returned writer compresses data written to it.  The
+// writer must be closed after the body has been relayed.
+func (mux *ExchangeServeMux) compress(writer http.ResponseWriter, request *http.Request, response *http.Response) compressor {
+	mux.rw.RLock()
+	config := mux.compression
+	mux.rw.RUnlock()
+	if config == nil || !config.compresses(request, response) {
+		return &identityWriter{writer}
+	}
+	writer.Header().Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(request.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return &identityWriter{writer}
+	}
+
+	level := config.Level
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	writer.Header().Set("Content-Encoding", encoding)
+	writer.Header().Del("Content-Length")
+	writer.Header().Del("Accept-Ranges")
+	if etag := writer.Header().Get("ETag"); strings.HasPrefix(etag, `"`) {
+		// The encoded body differs from the backend's, so a strong
+		// validator no longer identifies it.
+		writer.Header().Set("ETag", "W/"+etag)
+	}
+	if encoding == "gzip" {
+		compressed, _ := gzip.NewWriterLevel(writer, level)
+		return compressed
+	}
+	compressed, _ := zlib.NewWriterLevel(writer, level)
+	return compressed
+}
+
+// Compresses returns true if response is eligible for compression, before
+// taking the client's preferences into account.
+func (config *CompressionConfig) compresses(request *http.Request, response *http.Response) bool {
+	if request.Method == "HEAD" || response.StatusCode == http.StatusNoContent ||
+		response.StatusCode == http.StatusNotModified ||
+		response.StatusCode == http.StatusPartialContent {
+		return false
+	}
+	if response.Header.Get("Content-Encoding") != "" ||
+		strings.Contains(strings.ToLower(response.Header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	minSize := config.MinSize
+	if minSize == 0 {
+		minSize = DefaultCompressionMinSize
+	}
+	if response.ContentLength >= 0 && response.ContentLength < minSize {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	contentTypes := config.ContentTypes
+	if contentTypes == nil {
+		contentTypes = DefaultCompressedTypes
+	}
+	for _, contentType := range contentTypes {
+		if contentType == mediaType ||
+			(strings.HasSuffix(contentType, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(contentType, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// NegotiateEncoding returns the encoding, gzip or deflate, the client
+// prefers according to an Accept-Encoding header, or an empty string if it
+// accepts neither.  Ties are broken in favour of gzip.
+func negotiateEncoding(accept string) string {
+	qualities := make(map[string]float64)
+	for _, entry := range splitHeaderList(accept) {
+		coding, parameters, _ := strings.Cut(entry, ";")
+		quality := 1.0
+		if name, value, found := strings.Cut(strings.TrimSpace(parameters), "="); found && strings.TrimSpace(name) == "q" {
+			if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				quality = parsed
+			}
+		}
+		qualities[strings.ToLower(strings.TrimSpace(coding))] = quality
+	}
+	best, bestQuality := "", 0.0
+	for _, encoding := range []string{"gzip", "deflate"} {
+		quality, present := qualities[encoding]
+		if !present {
+			quality, present = qualities["*"]
+		}
+		if present && quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// Compressor is a writer that buffers data until it's flushed or closed.
+// *gzip.Writer and *zlib.Writer are compressors.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// IdentityWriter is a compressor that writes data through unchanged.
+type identityWriter struct {
+	io.Writer
+}
+
+// Flush does nothing, since data isn't buffered.
+func (writer *identityWriter) Flush() error {
+	return nil
+}
+
+// Close does nothing, since data isn't buffered.
+func (writer *identityWriter) Close() error {
+	return nil
+}
+
+// Relay copies a response body from a backend service to the client through
+// body.  Streamed responses of unknown length are flushed to the client as
+// data arrives, so compression doesn't hold them back.
+func relay(writer http.ResponseWriter, body compressor, response *http.Response) error {
+	if response.ContentLength >= 0 {
+		_, err := io.Copy(body, response.Body)
+		return err
+	}
+	controller := http.NewResponseController(writer)
+	buffer := make([]byte, 32*1024)
+	for {
+		n, err := response.Body.Read(buffer)
+		if n > 0 {
+			if _, err := body.Write(buffer[:n]); err != nil {
+				return err
+			}
+			if err := body.Flush(); err != nil {
+				return err
+			}
+			controller.Flush()
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
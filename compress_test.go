@@ -0,0 +1,166 @@
+package switchboard
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "gopkg.in/check.v1"
+)
+
+type CompressTest struct {
+	mux     *ExchangeServeMux
+	server  *httptest.Server
+	body    string
+	release chan bool
+}
+
+var _ = Suite(&CompressTest{})
+
+func (s *CompressTest) SetUpTest(c *C) {
+	s.release = make(chan bool)
+	s.body = `{"users": [` + strings.Repeat(`"jane", `, 500) + `"joe"]}`
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			switch request.URL.Path {
+			case "/small":
+				writer.Header().Set("Content-Type", "application/json")
+				writer.Write([]byte(`{}`))
+			case "/image":
+				writer.Header().Set("Content-Type", "image/png")
+				writer.Write([]byte(s.body))
+			case "/encoded":
+				writer.Header().Set("Content-Type", "application/json")
+				writer.Header().Set("Content-Encoding", "br")
+				writer.Write([]byte(s.body))
+			case "/events":
+				writer.Header().Set("Content-Type", "text/event-stream")
+				writer.Write([]byte("data: 1\n\n"))
+				writer.(http.Flusher).Flush()
+				<-s.release
+			default:
+				writer.Header().Set("Content-Type", "application/json; charset=utf-8")
+				writer.Header().Set("ETag", `"users-1"`)
+				writer.Header().Set("Accept-Ranges", "bytes")
+				writer.Write([]byte(s.body))
+			}
+		}))
+	s.mux = NewExchangeServeMux()
+	for _, pattern := range []string{"/users", "/small", "/image", "/encoded", "/events"} {
+		s.mux.Add("GET", pattern, s.server.URL)
+	}
+	c.Assert(s.mux.SetCompression(&CompressionConfig{}), IsNil)
+}
+
+func (s *CompressTest) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+// Get makes a request through the mux with an Accept-Encoding header.
+func (s *CompressTest) get(c *C, path, accept string) *httptest.ResponseRecorder {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://example.com"+path, nil)
+	c.Assert(err, IsNil)
+	if accept != "" {
+		request.Header.Set("Accept-Encoding", accept)
+	}
+	s.mux.ServeHTTP(writer, request)
+	return writer
+}
+
+// Responses are compressed with the encoding the client prefers.
+func (s *CompressTest) TestCompress(c *C) {
+	writer := s.get(c, "/users", "gzip, deflate")
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(writer.Header().Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(writer.Header().Get("Content-Length"), Equals, "")
+	c.Assert(writer.Header().Get("Vary"), Equals, "Accept-Encoding")
+	c.Assert(writer.Body.Len() < len(s.body), Equals, true)
+	reader, err := gzip.NewReader(writer.Body)
+	c.Assert(err, IsNil)
+	body, err := io.ReadAll(reader)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, s.body)
+
+	writer = s.get(c, "/users", "gzip;q=0.5, deflate")
+	c.Assert(writer.Header().Get("Content-Encoding"), Equals, "deflate")
+	inflater, err := zlib.NewReader(writer.Body)
+	c.Assert(err, IsNil)
+	body, err = io.ReadAll(inflater)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, s.body)
+}
+
+// Compressed responses have weak validators, since the encoded body differs
+// from the backend service's, and don't offer ranges.
+func (s *CompressTest) TestValidators(c *C) {
+	writer := s.get(c, "/users", "gzip")
+	c.Assert(writer.Header().Get("Content-Encoding"), Equals, "gzip")
+	c.Assert(writer.Header().Get("ETag"), Equals, `W/"users-1"`)
+	c.Assert(writer.Header().Get("Accept-Ranges"), Equals, "")
+
+	writer = s.get(c, "/users", "")
+	c.Assert(writer.Header().Get("ETag"), Equals, `"users-1"`)
+	c.Assert(writer.Header().Get("Accept-Ranges"), Equals, "bytes")
+}
+
+// Responses are relayed untouched if the client doesn't accept a supported
+// encoding.
+func (s *CompressTest) TestNegotiation(c *C) {
+	for _, accept := range []string{"", "br", "gzip;q=0, deflate;q=0", "identity"} {
+		writer := s.get(c, "/users", accept)
+		c.Assert(writer.Header().Get("Content-Encoding"), Equals, "", Commentf("%q", accept))
+		c.Assert(writer.Body.String(), Equals, s.body)
+	}
+	c.Assert(negotiateEncoding("*"), Equals, "gzip")
+	c.Assert(negotiateEncoding("gzip;q=0, *"), Equals, "deflate")
+}
+
+// Small responses, responses of other content types and responses already
+// encoded by the backend service aren't compressed.
+func (s *CompressTest) TestSkipped(c *C) {
+	writer := s.get(c, "/small", "gzip")
+	c.Assert(writer.Header().Get("Content-Encoding"), Equals, "")
+	c.Assert(writer.Body.String(), Equals, "{}")
+	writer = s.get(c, "/image", "gzip")
+	c.Assert(writer.Header().Get("Content-Encoding"), Equals, "")
+	c.Assert(writer.Header().Get("Vary"), Equals, "")
+	writer = s.get(c, "/encoded", "gzip")
+	c.Assert(writer.Header().Get("Content-Encoding"), Equals, "br")
+	c.Assert(writer.Body.String(), Equals, s.body)
+
+	c.Assert(s.mux.SetCompression(&CompressionConfig{ContentTypes: []string{"image/*"}, MinSize: 1}), IsNil)
+	writer = s.get(c, "/image", "gzip")
+	c.Assert(writer.Header().Get("Content-Encoding"), Equals, "gzip")
+	writer = s.get(c, "/small", "gzip")
+	c.Assert(writer.Header().Get("Content-Encoding"), Equals, "")
+
+	c.Assert(s.mux.SetCompression(&CompressionConfig{Level: 10}), ErrorMatches, "Invalid compression level 10")
+	c.Assert(s.mux.SetCompression(nil), IsNil)
+	writer = s.get(c, "/users", "gzip")
+	c.Assert(writer.Header().Get("Content-Encoding"), Equals, "")
+}
+
+// Streamed responses are compressed and flushed to the client as data
+// arrives, without waiting for the backend service to finish.
+func (s *CompressTest) TestStreamedResponse(c *C) {
+	exchange := httptest.NewServer(s.mux)
+	defer exchange.Close()
+	defer close(s.release)
+	request, err := http.NewRequest("GET", exchange.URL+"/events", nil)
+	c.Assert(err, IsNil)
+	request.Header.Set("Accept-Encoding", "gzip")
+	response, err := http.DefaultTransport.RoundTrip(request)
+	c.Assert(err, IsNil)
+	defer response.Body.Close()
+	c.Assert(response.Header.Get("Content-Encoding"), Equals, "gzip")
+	reader, err := gzip.NewReader(response.Body)
+	c.Assert(err, IsNil)
+	event := make([]byte, 9)
+	_, err = io.ReadFull(reader, event)
+	c.Assert(err, IsNil)
+	c.Assert(string(event), Equals, "data: 1\n\n")
+}
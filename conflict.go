@@ -0,0 +1,233 @@
+package switchboard
+
+import (
+	"sort"
+	"strings"
+)
+
+// ConflictPolicy controls what an Exchange does when a service registers an
+// HTTP method and URL pattern that another service has already claimed.
+type ConflictPolicy int
+
+const (
+	// AllowConflicts merges the addresses of every service that claims a
+	// route, so requests are spread across all of them.  Conflicts aren't
+	// reported.  This is the default.
+	AllowConflicts ConflictPolicy = iota
+
+	// WarnConflicts merges addresses like AllowConflicts but reports each
+	// conflict.
+	WarnConflicts
+
+	// RejectNewer keeps the route for the service that registered it first
+	// and refuses it for services that register it later.
+	RejectNewer
+
+	// RejectBoth refuses the route for every service that claims it, until
+	// only one claimant remains.
+	RejectBoth
+)
+
+// String returns the name of the policy.
+func (policy ConflictPolicy) String() string {
+	switch policy {
+	case AllowConflicts:
+		return "allow"
+	case WarnConflicts:
+		return "warn"
+	case RejectNewer:
+		return "reject-newer"
+	case RejectBoth:
+		return "reject-both"
+	}
+	return "unknown"
+}
+
+// MarshalText encodes the policy as its name.
+func (policy ConflictPolicy) MarshalText() ([]byte, error) {
+	return []byte(policy.String()), nil
+}
+
+// Conflict describes an HTTP method and URL pattern claimed by two logical
+// services.  Instances of the same logical service, identified by
+// ServiceRecord.LogicalName, don't conflict with each other.
+type Conflict struct {
+	Method   string         `json:"method"`
+	Pattern  string         `json:"pattern"`
+	Existing *ServiceRecord `json:"existing"` // The service that claimed the route first.
+	Incoming *ServiceRecord `json:"incoming"` // The service that claimed the route later.
+	Policy   ConflictPolicy `json:"policy"`   // The policy enforced for the conflict.
+	Rejected []string       `json:"rejected"` // Logical names of services refused the route.
+}
+
+// ConflictError is returned by Exchange.Register when some of a service's
+// routes were refused because of conflicts.
+type ConflictError struct {
+	Conflicts []*Conflict
+}
+
+// Error describes the refused routes.
+func (err *ConflictError) Error() string {
+	descriptions := make([]string, 0, len(err.Conflicts))
+	for _, conflict := range err.Conflicts {
+		descriptions = append(descriptions, conflict.Method+" "+conflict.Pattern+
+			" is claimed by "+conflict.Existing.LogicalName()+" and "+
+			conflict.Incoming.LogicalName())
+	}
+	return "Routes rejected: " + strings.Join(descriptions, "; ")
+}
+
+// SetConflictPolicy configures how the exchange handles routes claimed by
+// more than one service.  callback, which may be nil, is called the first
+// time each conflict is detected unless policy is AllowConflicts.
+func (exchange *Exchange) SetConflictPolicy(policy ConflictPolicy, callback func(conflict *Conflict)) {
+	exchange.rw.Lock()
+	defer exchange.rw.Unlock()
+	exchange.conflictPolicy = policy
+	exchange.onConflict = callback
+}
+
+// Conflicts returns the conflicts currently detected by the exchange.
+func (exchange *Exchange) Conflicts() []*Conflict {
+	exchange.rw.RLock()
+	defer exchange.rw.RUnlock()
+	conflicts := make([]*Conflict, 0, len(exchange.conflicts))
+	for _, conflict := range exchange.conflicts {
+		conflicts = append(conflicts, conflict)
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflictKey(conflicts[i]) < conflictKey(conflicts[j])
+	})
+	return conflicts
+}
+
+// Rejected returns the services refused every route they claim because of
+// conflicts, sorted by ID.  They stay known to the exchange, so their routes
+// are restored if the conflicts are resolved.
+func (exchange *Exchange) Rejected() []*ServiceRecord {
+	exchange.rw.RLock()
+	defer exchange.rw.RUnlock()
+	rejected := make([]*ServiceRecord, 0)
+	for _, service := range exchange.services {
+		if exchange.refused(service) {
+			rejected = append(rejected, service)
+		}
+	}
+	sort.Slice(rejected, func(i, j int) bool { return rejected[i].ID < rejected[j].ID })
+	return rejected
+}
+
+// Refused returns true if every route a service claims has been refused to
+// it because of conflicts.  The caller must hold the read lock.
+func (exchange *Exchange) refused(service *ServiceRecord) bool {
+	claimed := 0
+	for method, patterns := range service.Routes {
+		for _, pattern := range patterns {
+			claimed++
+			refused := false
+			for _, conflict := range exchange.conflicts {
+				if conflict.Method == method && conflict.Pattern == service.MountedPattern(pattern) &&
+					contains(conflict.Rejected, service.LogicalName()) {
+					refused = true
+					break
+				}
+			}
+			if !refused {
+				return false
+			}
+		}
+	}
+	return claimed > 0
+}
+
+// Resolution describes the outcome of applying the conflict policy to a
+// service's routes.
+type resolution struct {
+	accepted *ServiceRecord // A copy of the service with only accepted routes.
+	evicted  []*Conflict    // Conflicts that refuse the route to a rival.
+	rejected []*Conflict    // Conflicts that refuse the route to the service.
+	detected []*Conflict    // Conflicts detected for the first time.
+}
+
+// Resolve compares the routes of a registered service with the routes of
+// every other registered service and applies the conflict policy.  The
+// caller must hold the write lock.
+func (exchange *Exchange) resolve(service *ServiceRecord) *resolution {
+	accepted := *service
+	accepted.Routes = make(Routes)
+	result := &resolution{accepted: &accepted}
+	for method, patterns := range service.Routes {
+		for _, pattern := range patterns {
+			rejected := false
+			mounted := service.MountedPattern(pattern)
+			for _, rival := range exchange.rivals(service, method, mounted) {
+				existing, incoming := rival, service
+				if exchange.registered[service.LogicalName()] < exchange.registered[rival.LogicalName()] {
+					existing, incoming = service, rival
+				}
+				conflict := &Conflict{
+					Method:   method,
+					Pattern:  mounted,
+					Existing: existing,
+					Incoming: incoming,
+					Policy:   exchange.conflictPolicy}
+				switch exchange.conflictPolicy {
+				case RejectNewer:
+					conflict.Rejected = []string{incoming.LogicalName()}
+				case RejectBoth:
+					conflict.Rejected = []string{existing.LogicalName(), incoming.LogicalName()}
+				}
+				for _, name := range conflict.Rejected {
+					if name == service.LogicalName() {
+						rejected = true
+						result.rejected = append(result.rejected, conflict)
+					} else {
+						result.evicted = append(result.evicted, conflict)
+					}
+				}
+
+				key := conflictKey(conflict)
+				if _, present := exchange.conflicts[key]; !present {
+					result.detected = append(result.detected, conflict)
+				}
+				exchange.conflicts[key] = conflict
+			}
+			if !rejected {
+				accepted.Routes[method] = append(accepted.Routes[method], pattern)
+			}
+		}
+	}
+	return result
+}
+
+// Rivals returns the registered services, other than instances of service's
+// logical service, that claim an HTTP method and mounted URL pattern.  The
+// caller must hold the read lock.
+func (exchange *Exchange) rivals(service *ServiceRecord, method, pattern string) []*ServiceRecord {
+	if exchange.conflictPolicy == AllowConflicts {
+		return nil
+	}
+	rivals := make([]*ServiceRecord, 0)
+	for _, rival := range exchange.services {
+		if rival.LogicalName() == service.LogicalName() {
+			continue
+		}
+		for _, rivalPattern := range rival.Routes[method] {
+			if rival.MountedPattern(rivalPattern) == pattern {
+				rivals = append(rivals, rival)
+				break
+			}
+		}
+	}
+	sort.Slice(rivals, func(i, j int) bool {
+		return exchange.registered[rivals[i].LogicalName()] < exchange.registered[rivals[j].LogicalName()]
+	})
+	return rivals
+}
+
+// ConflictKey uniquely identifies a conflict between two logical services
+// over a route.
+func conflictKey(conflict *Conflict) string {
+	return routeKey(conflict.Method, conflict.Pattern) + " " +
+		conflict.Existing.LogicalName() + " " + conflict.Incoming.LogicalName()
+}
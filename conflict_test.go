@@ -0,0 +1,143 @@
+package switchboard
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type ConflictTest struct {
+	mux       *ExchangeServeMux
+	exchange  *Exchange
+	users     *ServiceRecord
+	impostor  *ServiceRecord
+	conflicts []*Conflict
+}
+
+var _ = Suite(&ConflictTest{})
+
+func (s *ConflictTest) SetUpTest(c *C) {
+	s.mux = NewExchangeServeMux()
+	s.exchange = NewExchange("test", nil, s.mux)
+	s.users = &ServiceRecord{
+		ID:      "users",
+		Address: "http://localhost:8080",
+		Routes:  Routes{"GET": []string{"/users", "/user/:id"}}}
+	s.impostor = &ServiceRecord{
+		ID:      "impostor",
+		Address: "http://localhost:9090",
+		Routes:  Routes{"GET": []string{"/users", "/impostor"}}}
+	s.conflicts = nil
+}
+
+// Callback records conflicts reported by the exchange.
+func (s *ConflictTest) callback(conflict *Conflict) {
+	s.conflicts = append(s.conflicts, conflict)
+}
+
+// Addresses returns the addresses registered for a GET pattern.
+func (s *ConflictTest) addresses(c *C, path string) []string {
+	addresses, err := s.mux.Match("GET", path)
+	if err != nil {
+		return nil
+	}
+	return *addresses
+}
+
+// By default conflicting routes are merged without being reported.
+func (s *ConflictTest) TestAllowConflicts(c *C) {
+	c.Assert(s.exchange.Register(s.users), IsNil)
+	c.Assert(s.exchange.Register(s.impostor), IsNil)
+	c.Assert(s.addresses(c, "/users"), DeepEquals,
+		[]string{"http://localhost:8080", "http://localhost:9090"})
+	c.Assert(s.exchange.Conflicts(), DeepEquals, []*Conflict{})
+}
+
+// WarnConflicts merges conflicting routes and reports each conflict once.
+func (s *ConflictTest) TestWarnConflicts(c *C) {
+	s.exchange.SetConflictPolicy(WarnConflicts, s.callback)
+	c.Assert(s.exchange.Register(s.users), IsNil)
+	c.Assert(s.exchange.Register(s.impostor), IsNil)
+	c.Assert(s.exchange.Register(s.impostor), IsNil)
+	c.Assert(s.addresses(c, "/users"), DeepEquals,
+		[]string{"http://localhost:8080", "http://localhost:9090"})
+	c.Assert(len(s.conflicts), Equals, 1)
+	c.Assert(s.conflicts[0].Method, Equals, "GET")
+	c.Assert(s.conflicts[0].Pattern, Equals, "/users")
+	c.Assert(s.conflicts[0].Existing, Equals, s.users)
+	c.Assert(s.conflicts[0].Incoming, Equals, s.impostor)
+	c.Assert(s.conflicts[0].Rejected, IsNil)
+}
+
+// RejectNewer refuses conflicting routes to the service that registered
+// last, even when the first service registers again.
+func (s *ConflictTest) TestRejectNewer(c *C) {
+	s.exchange.SetConflictPolicy(RejectNewer, s.callback)
+	c.Assert(s.exchange.Register(s.users), IsNil)
+	err := s.exchange.Register(s.impostor)
+	c.Assert(err, ErrorMatches, "Routes rejected: GET /users is claimed by users and impostor")
+	c.Assert(s.exchange.Register(s.users), IsNil)
+	c.Assert(s.addresses(c, "/users"), DeepEquals, []string{"http://localhost:8080"})
+	c.Assert(s.addresses(c, "/impostor"), DeepEquals, []string{"http://localhost:9090"})
+	c.Assert(len(s.conflicts), Equals, 1)
+	c.Assert(s.conflicts[0].Rejected, DeepEquals, []string{"impostor"})
+}
+
+// Services refused every route they claim aren't listed as registered until
+// the conflict is resolved.
+func (s *ConflictTest) TestRejectedServices(c *C) {
+	s.exchange.SetConflictPolicy(RejectNewer, s.callback)
+	s.impostor.Routes = Routes{"GET": []string{"/users"}}
+	c.Assert(s.exchange.Register(s.users), IsNil)
+	c.Assert(s.exchange.Register(s.impostor), NotNil)
+	c.Assert(s.exchange.Services(), DeepEquals, []*ServiceRecord{s.users})
+	c.Assert(s.exchange.Rejected(), DeepEquals, []*ServiceRecord{s.impostor})
+	c.Assert(s.exchange.State().Rejected, DeepEquals, []*ServiceRecord{s.impostor})
+
+	s.exchange.Unregister(s.users)
+	c.Assert(s.exchange.Services(), DeepEquals, []*ServiceRecord{s.impostor})
+	c.Assert(s.exchange.Rejected(), DeepEquals, []*ServiceRecord{})
+	c.Assert(s.addresses(c, "/users"), DeepEquals, []string{"http://localhost:9090"})
+}
+
+// RejectBoth refuses conflicting routes to every claimant and restores them
+// when only one claimant remains.
+func (s *ConflictTest) TestRejectBoth(c *C) {
+	s.exchange.SetConflictPolicy(RejectBoth, s.callback)
+	c.Assert(s.exchange.Register(s.users), IsNil)
+	c.Assert(s.exchange.Register(s.impostor), NotNil)
+	c.Assert(s.addresses(c, "/users"), IsNil)
+	c.Assert(s.addresses(c, "/user/1"), DeepEquals, []string{"http://localhost:8080"})
+	c.Assert(s.exchange.Register(s.users), NotNil)
+	c.Assert(s.addresses(c, "/users"), IsNil)
+	c.Assert(len(s.exchange.Conflicts()), Equals, 1)
+
+	s.exchange.Unregister(s.impostor)
+	c.Assert(s.addresses(c, "/users"), DeepEquals, []string{"http://localhost:8080"})
+	c.Assert(s.exchange.Conflicts(), DeepEquals, []*Conflict{})
+}
+
+// Instances of the same logical service don't conflict, and later instances
+// of the service that claimed a route first keep it under RejectNewer.
+func (s *ConflictTest) TestLogicalServices(c *C) {
+	s.exchange.SetConflictPolicy(RejectNewer, s.callback)
+	s.users.Name = "users"
+	s.impostor.Name = "impostor"
+	second := &ServiceRecord{
+		ID:      "users-2",
+		Name:    "users",
+		Address: "http://localhost:8081",
+		Routes:  Routes{"GET": []string{"/users"}}}
+	c.Assert(s.exchange.Register(s.users), IsNil)
+	c.Assert(s.exchange.Register(s.impostor), NotNil)
+	c.Assert(s.exchange.Register(second), IsNil)
+	c.Assert(s.addresses(c, "/users"), DeepEquals,
+		[]string{"http://localhost:8080", "http://localhost:8081"})
+	c.Assert(len(s.conflicts), Equals, 1)
+	c.Assert(s.conflicts[0].Rejected, DeepEquals, []string{"impostor"})
+
+	// The conflict remains while any instance of users is registered.
+	s.exchange.Unregister(s.users)
+	c.Assert(len(s.exchange.Conflicts()), Equals, 1)
+	s.exchange.Unregister(second)
+	c.Assert(s.exchange.Conflicts(), DeepEquals, []*Conflict{})
+	c.Assert(s.addresses(c, "/users"), DeepEquals, []string{"http://localhost:9090"})
+}
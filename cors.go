@@ -0,0 +1,233 @@
+package switchboard
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfig describes which cross-origin requests browsers may make to
+// routes served by an ExchangeServeMux.  The exchange answers preflight
+// requests itself, without involving backend services, and adds CORS
+// headers to responses, replacing any set by backend services.  The methods
+// allowed for a URL are the methods with a registered pattern that matches
+// it.
+type CORSConfig struct {
+	// AllowedOrigins lists the origins allowed to make requests.  An entry
+	// may contain * wildcards, such as https://*.example.com, or be * to
+	// allow any origin.
+	AllowedOrigins []string
+
+	// AllowedHeaders lists the request headers browsers may send, beyond
+	// the headers CORS always allows.  An entry of * allows any header.
+	AllowedHeaders []string
+
+	// ExposedHeaders lists the response headers browsers may read, beyond
+	// the headers CORS always exposes.
+	ExposedHeaders []string
+
+	// AllowCredentials allows requests to include cookies and HTTP
+	// authentication.  It can't be combined with an AllowedOrigins entry of
+	// *, which would let any site make credentialed requests.
+	AllowCredentials bool
+
+	// MaxAge is the time browsers may cache the result of a preflight
+	// request.  Zero leaves it up to the browser.
+	MaxAge time.Duration
+}
+
+// SetCORS configures CORS for every route.  A nil config disables it.
+func (mux *ExchangeServeMux) SetCORS(config *CORSConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.cors = config
+	return nil
+}
+
+// SetRouteCORS configures CORS for an HTTP method and URL pattern,
+// overriding the config set with SetCORS.  A nil config removes the
+// override.
+func (mux *ExchangeServeMux) SetRouteCORS(method, pattern string, config *CORSConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.config(method, pattern).cors = config
+	return nil
+}
+
+// Validate returns an error if an origin pattern is malformed, the max age
+// is negative or credentials are allowed from any origin.
+func (config *CORSConfig) validate() error {
+	if config == nil {
+		return nil
+	}
+	for _, origin := range config.AllowedOrigins {
+		if _, err := path.Match(origin, ""); err != nil {
+			return errors.New("Invalid origin pattern " + origin)
+		}
+	}
+	if config.MaxAge < 0 {
+		return errors.New("CORS max age must not be negative")
+	}
+	if config.AllowCredentials && contains(config.AllowedOrigins, "*") {
+		return errors.New("CORS can't allow credentials from any origin")
+	}
+	return nil
+}
+
+// CORSFor returns the CORS config that applies to an HTTP method and URL
+// pattern, or nil if CORS isn't enabled for it.  The caller must hold the
+// read lock.
+func (mux *ExchangeServeMux) corsFor(method, pattern string) *CORSConfig {
+	if config, present := mux.configs[routeKey(method, pattern)]; present && config.cors != nil {
+		return config.cors
+	}
+	return mux.cors
+}
+
+// Preflight answers a CORS preflight request and returns true, or returns
+// false if request isn't a preflight request for a route with CORS enabled.
+// Preflight requests that aren't allowed are answered without CORS headers,
+// which browsers treat as a refusal.
+func (mux *ExchangeServeMux) preflight(writer http.ResponseWriter, request *http.Request, route *Route) bool {
+	requestMethod := request.Header.Get("Access-Control-Request-Method")
+	origin := request.Header.Get("Origin")
+	if request.Method != "OPTIONS" || origin == "" || requestMethod == "" {
+		return false
+	}
+
+	mux.rw.RLock()
+	handler := mux.find(requestMethod, route.Path)
+	if handler == nil {
+		mux.rw.RUnlock()
+		return false
+	}
+	config := mux.corsFor(requestMethod, handler.pattern)
+	methods := make([]string, 0)
+	for method, handlers := range mux.routes {
+		for _, candidate := range handlers {
+			if candidate.Match(route.Path) {
+				methods = append(methods, method)
+				break
+			}
+		}
+	}
+	mux.rw.RUnlock()
+	if config == nil {
+		return false
+	}
+	route.Pattern = handler.pattern
+	sort.Strings(methods)
+
+	header := writer.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	requested := splitHeaderList(request.Header.Get("Access-Control-Request-Headers"))
+	if config.allowsOrigin(origin) && config.allowsHeaders(requested) {
+		config.writeOrigin(header, origin)
+		header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+		if len(requested) > 0 {
+			header.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+		}
+		if config.MaxAge > 0 {
+			header.Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge/time.Second)))
+		}
+	}
+	writer.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// AllowCORS adds CORS headers for a matched cross-origin request to the
+// response and returns true if the response should carry the exchange's
+// CORS headers instead of the backend service's.
+func (mux *ExchangeServeMux) allowCORS(writer http.ResponseWriter, request *http.Request, route *Route) bool {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	mux.rw.RLock()
+	config := mux.corsFor(route.Method, route.Pattern)
+	mux.rw.RUnlock()
+	if config == nil {
+		return false
+	}
+	header := writer.Header()
+	header.Add("Vary", "Origin")
+	if config.allowsOrigin(origin) {
+		config.writeOrigin(header, origin)
+		if len(config.ExposedHeaders) > 0 {
+			header.Set("Access-Control-Expose-Headers", strings.Join(config.ExposedHeaders, ", "))
+		}
+	}
+	return true
+}
+
+// AllowsOrigin returns true if origin may make requests.
+func (config *CORSConfig) allowsOrigin(origin string) bool {
+	for _, allowed := range config.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		if matched, _ := path.Match(allowed, origin); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsHeaders returns true if every requested header may be sent.
+func (config *CORSConfig) allowsHeaders(requested []string) bool {
+	for _, name := range requested {
+		allowed := false
+		for _, candidate := range config.AllowedHeaders {
+			if candidate == "*" || strings.EqualFold(candidate, name) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteOrigin adds the headers that allow origin to read a response.  The
+// wildcard origin isn't allowed with credentials, so the origin is echoed
+// instead.
+func (config *CORSConfig) writeOrigin(header http.Header, origin string) {
+	if contains(config.AllowedOrigins, "*") {
+		header.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		header.Set("Access-Control-Allow-Origin", origin)
+	}
+	if config.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// SplitHeaderList splits a comma-separated list of header names.
+func splitHeaderList(list string) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// IsCORSHeader returns true if header is a CORS response header.
+func isCORSHeader(header string) bool {
+	return strings.HasPrefix(http.CanonicalHeaderKey(header), "Access-Control-")
+}
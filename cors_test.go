@@ -0,0 +1,161 @@
+package switchboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type CORSTest struct {
+	mux      *ExchangeServeMux
+	server   *httptest.Server
+	requests int
+}
+
+var _ = Suite(&CORSTest{})
+
+func (s *CORSTest) SetUpTest(c *C) {
+	s.requests = 0
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			s.requests++
+			writer.Header().Set("Access-Control-Allow-Origin", "https://backend.example.com")
+			writer.Header().Set("X-Total-Count", "3")
+		}))
+	s.mux = NewExchangeServeMux()
+	s.mux.Add("GET", "/users", s.server.URL)
+	s.mux.Add("POST", "/users", s.server.URL)
+	s.mux.Add("DELETE", "/user/:id", s.server.URL)
+}
+
+func (s *CORSTest) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+// Send makes a request through the mux from an origin.
+func (s *CORSTest) send(c *C, method, path, origin string, header http.Header) *httptest.ResponseRecorder {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest(method, "http://example.com"+path, nil)
+	c.Assert(err, IsNil)
+	if header != nil {
+		request.Header = header
+	}
+	if origin != "" {
+		request.Header.Set("Origin", origin)
+	}
+	s.mux.ServeHTTP(writer, request)
+	return writer
+}
+
+// SetCORS rejects malformed origin patterns.
+func (s *CORSTest) TestSetCORSValidatesConfig(c *C) {
+	err := s.mux.SetCORS(&CORSConfig{AllowedOrigins: []string{"https://[.example.com"}})
+	c.Assert(err, ErrorMatches, "Invalid origin pattern https://\\[.example.com")
+	err = s.mux.SetRouteCORS("GET", "/users", &CORSConfig{MaxAge: -time.Second})
+	c.Assert(err, ErrorMatches, "CORS max age must not be negative")
+	err = s.mux.SetCORS(&CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true})
+	c.Assert(err, ErrorMatches, "CORS can't allow credentials from any origin")
+	err = s.mux.SetRouteCORS("GET", "/users",
+		&CORSConfig{AllowedOrigins: []string{"https://app.example.com", "*"}, AllowCredentials: true})
+	c.Assert(err, ErrorMatches, "CORS can't allow credentials from any origin")
+}
+
+// Without CORS config, preflight requests aren't answered by the exchange.
+func (s *CORSTest) TestPreflightWithoutCORS(c *C) {
+	header := http.Header{"Access-Control-Request-Method": {"POST"}}
+	writer := s.send(c, "OPTIONS", "/users", "https://app.example.com", header)
+	c.Assert(writer.Code, Equals, http.StatusNotFound)
+}
+
+// Preflight requests are answered without touching the backend, allowing
+// the methods registered for the path.
+func (s *CORSTest) TestPreflight(c *C) {
+	err := s.mux.SetCORS(&CORSConfig{
+		AllowedOrigins:   []string{"https://*.example.com"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute})
+	c.Assert(err, IsNil)
+
+	header := http.Header{
+		"Access-Control-Request-Method":  {"POST"},
+		"Access-Control-Request-Headers": {"content-type, authorization"}}
+	writer := s.send(c, "OPTIONS", "/users", "https://app.example.com", header)
+	c.Assert(writer.Code, Equals, http.StatusNoContent)
+	c.Assert(s.requests, Equals, 0)
+	c.Assert(writer.Header().Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+	c.Assert(writer.Header().Get("Access-Control-Allow-Methods"), Equals, "GET, POST")
+	c.Assert(writer.Header().Get("Access-Control-Allow-Headers"), Equals, "content-type, authorization")
+	c.Assert(writer.Header().Get("Access-Control-Allow-Credentials"), Equals, "true")
+	c.Assert(writer.Header().Get("Access-Control-Max-Age"), Equals, "600")
+
+	header = http.Header{"Access-Control-Request-Method": {"DELETE"}}
+	writer = s.send(c, "OPTIONS", "/user/123", "https://app.example.com", header)
+	c.Assert(writer.Code, Equals, http.StatusNoContent)
+	c.Assert(writer.Header().Get("Access-Control-Allow-Methods"), Equals, "DELETE")
+}
+
+// Preflight requests from disallowed origins or asking for disallowed
+// headers are answered without CORS headers.
+func (s *CORSTest) TestPreflightRefused(c *C) {
+	err := s.mux.SetCORS(&CORSConfig{AllowedOrigins: []string{"https://app.example.com"}})
+	c.Assert(err, IsNil)
+
+	header := http.Header{"Access-Control-Request-Method": {"POST"}}
+	writer := s.send(c, "OPTIONS", "/users", "https://evil.example.org", header)
+	c.Assert(writer.Code, Equals, http.StatusNoContent)
+	c.Assert(writer.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+
+	header = http.Header{
+		"Access-Control-Request-Method":  {"POST"},
+		"Access-Control-Request-Headers": {"X-Secret"}}
+	writer = s.send(c, "OPTIONS", "/users", "https://app.example.com", header)
+	c.Assert(writer.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+
+	header = http.Header{"Access-Control-Request-Method": {"PUT"}}
+	writer = s.send(c, "OPTIONS", "/users", "https://app.example.com", header)
+	c.Assert(writer.Code, Equals, http.StatusNotFound)
+}
+
+// Cross-origin requests are proxied with the exchange's CORS headers in
+// place of the backend's.
+func (s *CORSTest) TestActualRequest(c *C) {
+	err := s.mux.SetCORS(&CORSConfig{
+		AllowedOrigins: []string{"*"},
+		ExposedHeaders: []string{"X-Total-Count"}})
+	c.Assert(err, IsNil)
+
+	writer := s.send(c, "GET", "/users", "https://app.example.com", nil)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(writer.Header()["Access-Control-Allow-Origin"], DeepEquals, []string{"*"})
+	c.Assert(writer.Header().Get("Access-Control-Expose-Headers"), Equals, "X-Total-Count")
+	c.Assert(writer.Header().Get("Vary"), Equals, "Origin")
+
+	writer = s.send(c, "GET", "/users", "", nil)
+	c.Assert(writer.Header().Get("Access-Control-Allow-Origin"), Equals, "https://backend.example.com")
+}
+
+// Route config overrides the global config.
+func (s *CORSTest) TestRouteCORS(c *C) {
+	err := s.mux.SetCORS(&CORSConfig{AllowedOrigins: []string{"https://app.example.com"}})
+	c.Assert(err, IsNil)
+	err = s.mux.SetRouteCORS("POST", "/users", &CORSConfig{AllowedOrigins: []string{"https://admin.example.com"}})
+	c.Assert(err, IsNil)
+
+	header := http.Header{"Access-Control-Request-Method": {"POST"}}
+	writer := s.send(c, "OPTIONS", "/users", "https://app.example.com", header)
+	c.Assert(writer.Header().Get("Access-Control-Allow-Origin"), Equals, "")
+	header = http.Header{"Access-Control-Request-Method": {"POST"}}
+	writer = s.send(c, "OPTIONS", "/users", "https://admin.example.com", header)
+	c.Assert(writer.Header().Get("Access-Control-Allow-Origin"), Equals, "https://admin.example.com")
+
+	writer = s.send(c, "GET", "/users", "https://app.example.com", nil)
+	c.Assert(writer.Header().Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+
+	c.Assert(s.mux.SetRouteCORS("POST", "/users", nil), IsNil)
+	header = http.Header{"Access-Control-Request-Method": {"POST"}}
+	writer = s.send(c, "OPTIONS", "/users", "https://app.example.com", header)
+	c.Assert(writer.Header().Get("Access-Control-Allow-Origin"), Equals, "https://app.example.com")
+}
@@ -14,9 +14,22 @@ func main() {
 	// consumers and passes them on to the appropriate backend service.
 	client := etcd.NewClient([]string{"http://127.0.0.1:4001"})
 	mux := switchboard.NewExchangeServeMux()
+	mux.Use(switchboard.AccessLog(os.Stdout, switchboard.CommonLogFormat))
 	exchange := switchboard.NewExchange("example", client, mux)
+	metrics := switchboard.NewMetrics(mux)
+	mux.Use(metrics.Middleware())
+	exchange.SetMetrics(metrics)
 	exchange.Init()
 
+	// Serve exchange state and metrics to operators on a separate port.
+	if adminPort := os.Getenv("ADMIN_PORT"); adminPort != "" {
+		go func() {
+			log.Printf("Serving admin API on port %v", adminPort)
+			admin := switchboard.NewAdmin(exchange, metrics)
+			log.Print(http.ListenAndServe("localhost:"+adminPort, admin))
+		}()
+	}
+
 	// Watch for service changes in etcd.  The exchange updates service
 	// routing rules based on configuration changes in etcd.
 	go func() {
@@ -29,17 +42,9 @@ func main() {
 	// appropriate service backend.
 	port := os.Getenv("PORT")
 	log.Printf("Listening for HTTP requests on port %v", port)
-	err := http.ListenAndServe("localhost:"+port, Log(mux))
+	err := http.ListenAndServe("localhost:"+port, mux)
 	if err != nil {
 		log.Print(err)
 	}
 	log.Print("Shutting down")
 }
-
-func Log(handler http.Handler) http.Handler {
-	wrapper := func(writer http.ResponseWriter, request *http.Request) {
-		log.Printf("%s %s %s", request.RemoteAddr, request.Method, request.URL.Path)
-		handler.ServeHTTP(writer, request)
-	}
-	return http.HandlerFunc(wrapper)
-}
@@ -3,7 +3,9 @@ package switchboard
 import (
 	"bytes"
 	"encoding/json"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/coreos/go-etcd/etcd"
 )
@@ -11,21 +13,36 @@ import (
 // Exchange watches for service changes in etcd and update an
 // ExchangeServeMux.
 type Exchange struct {
+	rw        sync.RWMutex              // Synchronize access to services and waitIndex.
 	namespace string                    // The root directory in etcd for services.
 	client    *etcd.Client              // The etcd client.
 	mux       *ExchangeServeMux         // The serve mux to keep in sync with etcd.
 	waitIndex uint64                    // Wait index to use when watching etcd.
 	services  map[string]*ServiceRecord // Currently connected services.
+	metrics   *Metrics                  // Optional collector for exchange events.
+
+	conflictPolicy ConflictPolicy       // How to handle routes claimed by many services.
+	onConflict     func(*Conflict)      // Called when a conflict is first detected.
+	conflicts      map[string]*Conflict // Currently detected conflicts.
+	sequence       uint64               // Counter used to order registrations.
+	registered     map[string]uint64    // Registration order keyed by logical name.
+
+	trustedKeys      []TrustedKey                  // Keys records must be signed with, if set.
+	unverifiedPolicy UnverifiedPolicy              // How to handle records that fail verification.
+	quarantine       map[string]*QuarantinedRecord // Records held after failing verification.
 }
 
 // NewExchange creates a new exchange configured to watch for changes in a
 // given etcd directory.
 func NewExchange(namespace string, client *etcd.Client, mux *ExchangeServeMux) *Exchange {
 	return &Exchange{
-		namespace: namespace,
-		client:    client,
-		mux:       mux,
-		services:  make(map[string]*ServiceRecord)}
+		namespace:  namespace,
+		client:     client,
+		mux:        mux,
+		services:   make(map[string]*ServiceRecord),
+		conflicts:  make(map[string]*Conflict),
+		registered: make(map[string]uint64),
+		quarantine: make(map[string]*QuarantinedRecord)}
 }
 
 // Init fetches service information from etcd and initializes the exchange.
@@ -48,15 +65,31 @@ func (exchange *Exchange) Init() error {
 	}
 
 	for _, node := range response.Node.Nodes {
+		if node.Dir {
+			if strings.HasSuffix(node.Key, "/"+PoliciesDirectory) {
+				for _, child := range node.Nodes {
+					exchange.setPolicy(child.Value)
+				}
+			}
+			continue
+		}
 		service := exchange.load(node.Value)
 		exchange.Register(service)
 	}
 
 	// We want to watch changes *after* this one.
+	exchange.rw.Lock()
 	exchange.waitIndex = response.EtcdIndex + 1
+	exchange.rw.Unlock()
 	return nil
 }
 
+// SetMetrics configures the exchange to record registrations,
+// unregistrations and watch events with a metrics collector.
+func (exchange *Exchange) SetMetrics(metrics *Metrics) {
+	exchange.metrics = metrics
+}
+
 // Watch observes changes in etcd and registers and unregisters services, as
 // necessary, with the ExchangeServeMux.  This blocking call will terminate
 // when a value is received on the stop channel.
@@ -73,14 +106,33 @@ func (exchange *Exchange) Watch(stop chan bool) {
 	for {
 		select {
 		case response := <-receiver:
-			if response.Action == "set" {
+			exchange.rw.Lock()
+			exchange.waitIndex = response.Node.ModifiedIndex + 1
+			exchange.rw.Unlock()
+			if exchange.metrics != nil {
+				exchange.metrics.watched(response.Action)
+			}
+			namespace := "/" + exchange.namespace + "/"
+			key := strings.TrimPrefix(response.Node.Key, namespace)
+			if strings.HasPrefix(key, PoliciesDirectory+"/") {
+				if response.Action == "set" {
+					exchange.setPolicy(response.Node.Value)
+				} else if response.Action == "delete" || response.Action == "expire" {
+					service := strings.TrimPrefix(key, PoliciesDirectory+"/")
+					exchange.mux.RemoveTrafficPolicy(service)
+				}
+			} else if response.Action == "set" {
 				service := exchange.load(response.Node.Value)
 				exchange.Register(service)
 			} else if response.Action == "delete" {
-				namespace := "/" + exchange.namespace + "/"
-				id := strings.TrimPrefix(response.Node.Key, namespace)
-				service := exchange.services[id]
-				exchange.Unregister(service)
+				id := key
+				exchange.rw.Lock()
+				service, present := exchange.services[id]
+				delete(exchange.quarantine, id)
+				exchange.rw.Unlock()
+				if present {
+					exchange.Unregister(service)
+				}
 			}
 		case <-stopped:
 			return
@@ -88,23 +140,146 @@ func (exchange *Exchange) Watch(stop chan bool) {
 	}
 }
 
-// Register adds routes exposed by a service to the ExchangeServeMux.
-func (exchange *Exchange) Register(service *ServiceRecord) {
+// Register adds routes exposed by a service to the ExchangeServeMux, under
+// the service's mount prefix.  Routes also claimed by other services are
+// handled according to the exchange's ConflictPolicy.  A *ConflictError is
+// returned if any of the service's routes were refused.  Services whose
+// records fail ServiceRecord.Validate aren't registered, and neither are
+// services whose records fail verification when RequireSignedRecords is in
+// effect.
+func (exchange *Exchange) Register(service *ServiceRecord) error {
+	if err := service.Validate(); err != nil {
+		return err
+	}
+	if err := exchange.verify(service); err != nil {
+		return err
+	}
+	exchange.rw.Lock()
+	_, known := exchange.services[service.ID]
 	exchange.services[service.ID] = service
-	for method, patterns := range service.Routes {
-		for _, pattern := range patterns {
-			exchange.mux.Add(method, pattern, service.Address)
-		}
+	if _, present := exchange.registered[service.LogicalName()]; !present {
+		exchange.sequence++
+		exchange.registered[service.LogicalName()] = exchange.sequence
 	}
+	exchange.rw.Unlock()
+
+	err := exchange.apply(service)
+	if exchange.metrics != nil && !known {
+		// Heartbeats re-register known services, and aren't counted.
+		exchange.metrics.registered()
+	}
+	return err
 }
 
 // Unregister removes routes exposed by a service from the ExchangeServeMux.
+// Routes the service was in conflict over are restored for the remaining
+// services that claim them.
 func (exchange *Exchange) Unregister(service *ServiceRecord) {
-	for method, patterns := range service.Routes {
-		for _, pattern := range patterns {
-			exchange.mux.Remove(method, pattern, service.Address)
+	exchange.rw.Lock()
+	_, known := exchange.services[service.ID]
+	delete(exchange.services, service.ID)
+	rivals := make(map[string]*ServiceRecord)
+	if len(exchange.instances(service.LogicalName())) == 0 {
+		// The last instance of the logical service is gone, so its claims on
+		// routes are gone too.
+		delete(exchange.registered, service.LogicalName())
+		for key, conflict := range exchange.conflicts {
+			if conflict.Existing.LogicalName() != service.LogicalName() &&
+				conflict.Incoming.LogicalName() != service.LogicalName() {
+				continue
+			}
+			delete(exchange.conflicts, key)
+			for _, rival := range []*ServiceRecord{conflict.Existing, conflict.Incoming} {
+				for _, instance := range exchange.instances(rival.LogicalName()) {
+					rivals[instance.ID] = instance
+				}
+			}
+		}
+	}
+	exchange.rw.Unlock()
+
+	exchange.mux.RemoveService(service)
+	for _, rival := range rivals {
+		exchange.apply(rival)
+	}
+	if exchange.metrics != nil && known {
+		exchange.metrics.unregistered()
+	}
+}
+
+// Instances returns the registered instances of a logical service.  The
+// caller must hold the read lock.
+func (exchange *Exchange) instances(name string) []*ServiceRecord {
+	instances := make([]*ServiceRecord, 0)
+	for _, service := range exchange.services {
+		if service.LogicalName() == name {
+			instances = append(instances, service)
 		}
 	}
+	return instances
+}
+
+// Apply adds the routes of a registered service to the ExchangeServeMux,
+// enforcing the conflict policy.
+func (exchange *Exchange) apply(service *ServiceRecord) error {
+	exchange.rw.Lock()
+	result := exchange.resolve(service)
+	onConflict := exchange.onConflict
+	for _, conflict := range result.evicted {
+		for _, name := range conflict.Rejected {
+			if name == service.LogicalName() {
+				continue
+			}
+			for _, rival := range exchange.instances(name) {
+				exchange.mux.Remove(conflict.Method, conflict.Pattern, rival.Address)
+			}
+		}
+	}
+	exchange.rw.Unlock()
+
+	exchange.mux.AddService(result.accepted)
+	if onConflict != nil {
+		for _, conflict := range result.detected {
+			onConflict(conflict)
+		}
+	}
+	if len(result.rejected) > 0 {
+		return &ConflictError{Conflicts: result.rejected}
+	}
+	return nil
+}
+
+// Services returns the service records currently registered with the
+// exchange, sorted by ID.  Services refused every route they claim because
+// of conflicts are listed by Rejected instead.
+func (exchange *Exchange) Services() []*ServiceRecord {
+	exchange.rw.RLock()
+	defer exchange.rw.RUnlock()
+	services := make([]*ServiceRecord, 0, len(exchange.services))
+	for _, service := range exchange.services {
+		if !exchange.refused(service) {
+			services = append(services, service)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services
+}
+
+// WaitIndex returns the etcd index the exchange will watch for changes from.
+func (exchange *Exchange) WaitIndex() uint64 {
+	exchange.rw.RLock()
+	defer exchange.rw.RUnlock()
+	return exchange.waitIndex
+}
+
+// SetPolicy installs a traffic policy from a JSON representation.  Policies
+// that can't be decoded or are invalid are ignored.
+func (exchange *Exchange) setPolicy(policyJSON string) {
+	var policy TrafficPolicy
+	if err := json.Unmarshal([]byte(policyJSON), &policy); err != nil {
+		return
+	}
+	exchange.mux.SetTrafficPolicy(&policy)
 }
 
 // Load creates a ServiceRecord instance from a JSON representation.
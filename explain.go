@@ -0,0 +1,140 @@
+package switchboard
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Explanation describes how an ExchangeServeMux would route a request.
+type Explanation struct {
+	Method       string      `json:"method"`
+	Host         string      `json:"host"`
+	Path         string      `json:"path"`
+	Candidates   []Candidate `json:"candidates"`
+	Pattern      string      `json:"pattern,omitempty"`
+	Params       url.Values  `json:"params,omitempty"`
+	Addresses    []string    `json:"addresses"`
+	Decision     string      `json:"decision"`
+	OtherMethods []string    `json:"other_methods,omitempty"`
+}
+
+// Candidate describes a pattern evaluated while routing a request.
+// Patterns are evaluated in the order they were registered and the first
+// one that matches is selected.
+type Candidate struct {
+	Pattern  string `json:"pattern"`
+	Matched  bool   `json:"matched"`
+	Selected bool   `json:"selected"`
+	Reason   string `json:"reason"`
+}
+
+// Explain reports how a request with the given method, host, path and
+// headers would be routed, without proxying it.  Every pattern registered
+// for the method is listed as a candidate, including those that would
+// never be reached because an earlier pattern matched first.  Methods with
+// patterns that match the path are listed in OtherMethods to help diagnose
+// requests made with the wrong method.
+func (mux *ExchangeServeMux) Explain(method, host, path string, header http.Header) *Explanation {
+	mux.rw.RLock()
+	defer mux.rw.RUnlock()
+
+	explanation := &Explanation{
+		Method:     method,
+		Host:       host,
+		Path:       path,
+		Candidates: make([]Candidate, 0),
+		Addresses:  make([]string, 0)}
+	var selected *patternHandler
+	for _, handler := range mux.routes[method] {
+		candidate := Candidate{Pattern: handler.pattern}
+		params, matched := handler.Params(path)
+		switch {
+		case matched && selected == nil:
+			selected = handler
+			candidate.Matched = true
+			candidate.Selected = true
+			candidate.Reason = "First pattern to match in registration order"
+			explanation.Pattern = handler.pattern
+			explanation.Params = params
+			explanation.Addresses = append(explanation.Addresses, mux.eligible(handler.addresses,
+				func(policy *TrafficPolicy) (string, bool) {
+					return policy.Match(&http.Request{Header: header})
+				})...)
+		case matched:
+			candidate.Matched = true
+			candidate.Reason = "Matched, but " + selected.pattern + " was registered first"
+		default:
+			candidate.Reason = "Did not match"
+		}
+		explanation.Candidates = append(explanation.Candidates, candidate)
+	}
+
+	if selected != nil && len(selected.addresses) == 0 {
+		explanation.Decision = "Selected " + selected.pattern +
+			"; no addresses are registered, so its static response is sent"
+		return explanation
+	}
+	if selected != nil {
+		explanation.Decision = "Selected " + selected.pattern + "; one of its " +
+			pluralize(len(explanation.Addresses), "address", "addresses") + " is chosen at random"
+		explanation.Decision += mux.describePolicies(selected.addresses, header)
+		return explanation
+	}
+
+	for otherMethod, handlers := range mux.routes {
+		if otherMethod == method {
+			continue
+		}
+		for _, handler := range handlers {
+			if handler.Match(path) {
+				explanation.OtherMethods = append(explanation.OtherMethods, otherMethod)
+				break
+			}
+		}
+	}
+	sort.Strings(explanation.OtherMethods)
+	if len(explanation.OtherMethods) > 0 {
+		explanation.Decision = "No " + method + " pattern matches; the path is routed for " +
+			strings.Join(explanation.OtherMethods, ", ")
+	} else {
+		explanation.Decision = "No pattern matches; the request would receive 404 Not Found"
+	}
+	return explanation
+}
+
+// DescribePolicies explains how traffic policies for the services behind
+// addresses apply to a request with the given headers.  The caller must
+// hold the read lock.
+func (mux *ExchangeServeMux) describePolicies(addresses []string, header http.Header) string {
+	names := make([]string, 0)
+	for _, address := range addresses {
+		if service, present := mux.services[address]; present {
+			name := service.LogicalName()
+			if _, present := mux.policies[name]; present && !contains(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	description := ""
+	for _, name := range names {
+		policy := mux.policies[name]
+		if version, matched := policy.Match(&http.Request{Header: header}); matched {
+			description += "; " + name + " requests are sent to version " + version + " by header or cookie match"
+		} else if len(policy.Splits) > 0 {
+			description += "; " + name + " requests are split between versions (" + policy.describe() + ")"
+		}
+	}
+	return description
+}
+
+// Pluralize formats a count with the singular or plural form of a noun.
+func pluralize(count int, singular, plural string) string {
+	if count == 1 {
+		return "1 " + singular
+	}
+	return strconv.Itoa(count) + " " + plural
+}
@@ -0,0 +1,67 @@
+package switchboard
+
+import (
+	"net/http"
+	"net/url"
+
+	. "gopkg.in/check.v1"
+)
+
+type ExplainTest struct{}
+
+var _ = Suite(&ExplainTest{})
+
+// Explain lists every candidate pattern, selects the first match and reports
+// captured parameters and eligible addresses.
+func (s *ExplainTest) TestExplain(c *C) {
+	mux := NewExchangeServeMux()
+	mux.Add("GET", "/users", "http://localhost:8080")
+	mux.Add("GET", "/user/:id", "http://localhost:8081")
+	mux.Add("GET", "/user/:id", "http://localhost:8082")
+	mux.Add("GET", "/user/", "http://localhost:8083")
+	explanation := mux.Explain("GET", "example.com", "/user/123", http.Header{})
+	c.Assert(explanation.Candidates, DeepEquals, []Candidate{
+		{Pattern: "/users", Reason: "Did not match"},
+		{Pattern: "/user/:id", Matched: true, Selected: true,
+			Reason: "First pattern to match in registration order"},
+		{Pattern: "/user/", Matched: true,
+			Reason: "Matched, but /user/:id was registered first"}})
+	c.Assert(explanation.Pattern, Equals, "/user/:id")
+	c.Assert(explanation.Params, DeepEquals, url.Values{"id": []string{"123"}})
+	c.Assert(explanation.Addresses, DeepEquals,
+		[]string{"http://localhost:8081", "http://localhost:8082"})
+	c.Assert(explanation.Decision, Equals,
+		"Selected /user/:id; one of its 2 addresses is chosen at random")
+}
+
+// Explain reports methods that would route the path when no pattern matches
+// the requested method.
+func (s *ExplainTest) TestExplainOtherMethods(c *C) {
+	mux := NewExchangeServeMux()
+	mux.Add("POST", "/users", "http://localhost:8080")
+	mux.Add("PUT", "/users", "http://localhost:8080")
+	explanation := mux.Explain("GET", "example.com", "/users", http.Header{})
+	c.Assert(explanation.Pattern, Equals, "")
+	c.Assert(explanation.Candidates, DeepEquals, []Candidate{})
+	c.Assert(explanation.OtherMethods, DeepEquals, []string{"POST", "PUT"})
+	c.Assert(explanation.Decision, Equals, "No GET pattern matches; the path is routed for POST, PUT")
+
+	explanation = mux.Explain("GET", "example.com", "/unknown", http.Header{})
+	c.Assert(explanation.Decision, Equals, "No pattern matches; the request would receive 404 Not Found")
+}
+
+// The admin explain endpoint reports how a request would be routed.
+func (s *ExplainTest) TestAdminExplain(c *C) {
+	mux := NewExchangeServeMux()
+	mux.Add("GET", "/user/:id", "http://localhost:8080")
+	test := &AdminTest{mux: mux, exchange: NewExchange("test", nil, mux)}
+	test.admin = NewAdmin(test.exchange, nil)
+
+	var explanation Explanation
+	test.get(c, "/explain?method=GET&path=/user/1&header=Accept:%20text/plain", &explanation)
+	c.Assert(explanation.Pattern, Equals, "/user/:id")
+	c.Assert(explanation.Params, DeepEquals, url.Values{"id": []string{"1"}})
+
+	writer := test.get(c, "/explain?method=GET", nil)
+	c.Assert(writer.Code, Equals, http.StatusBadRequest)
+}
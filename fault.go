@@ -0,0 +1,206 @@
+package switchboard
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// FaultHeader triggers the fault rule it names, on requests for the rule's
+// route, regardless of the rule's percentage.
+const FaultHeader = "X-Switchboard-Fault"
+
+var (
+	errFaultAborted   = errors.New("Request aborted by fault injection")
+	errFaultReset     = errors.New("Connection reset by fault injection")
+	errFaultTruncated = errors.New("Response body truncated by fault injection")
+)
+
+// FaultRule injects faults into requests for a route, to test how clients
+// behave when a backend service misbehaves.  A rule applies to a percentage
+// of the route's requests and to requests that name it in FaultHeader.  The
+// faults are applied in order: the delay, then a reset or abort in place of
+// the proxied request, then truncation of the response body.
+type FaultRule struct {
+	// Name identifies the rule.  Adding a rule replaces any rule with the
+	// same name.
+	Name string `json:"name"`
+
+	// Method and Pattern identify the route the rule applies to.
+	Method  string `json:"method"`
+	Pattern string `json:"pattern"`
+
+	// Percent is the percentage of the route's requests, from 0 to 100, the
+	// rule applies to.  Rules with a Percent of 0 apply only to requests
+	// that name them in FaultHeader.
+	Percent float64 `json:"percent"`
+
+	// Delay is added before the request is proxied.  It's given in
+	// nanoseconds in JSON.
+	Delay time.Duration `json:"delay,omitempty"`
+
+	// AbortStatus, if set, is an error status code from 400 to 599 sent to
+	// the client in place of proxying the request.
+	AbortStatus int `json:"abort_status,omitempty"`
+
+	// Reset, if true, closes the client connection without a response in
+	// place of proxying the request.
+	Reset bool `json:"reset,omitempty"`
+
+	// TruncateBody, if set, closes the client connection after that many
+	// bytes of the response body have been sent.
+	TruncateBody int64 `json:"truncate_body,omitempty"`
+}
+
+// AddFault installs a fault rule, replacing any rule with the same name.
+func (mux *ExchangeServeMux) AddFault(rule *FaultRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+	installed := *rule
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.faults[rule.Name] = &installed
+	return nil
+}
+
+// RemoveFault removes the fault rule with a name.  It returns false if
+// there's no such rule.
+func (mux *ExchangeServeMux) RemoveFault(name string) bool {
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	_, present := mux.faults[name]
+	delete(mux.faults, name)
+	return present
+}
+
+// Faults returns the installed fault rules, sorted by name.
+func (mux *ExchangeServeMux) Faults() []FaultRule {
+	mux.rw.RLock()
+	defer mux.rw.RUnlock()
+	rules := make([]FaultRule, 0, len(mux.faults))
+	for _, rule := range mux.faults {
+		rules = append(rules, *rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules
+}
+
+// Validate returns an error if the rule is incomplete or injects nothing.
+func (rule *FaultRule) validate() error {
+	if rule.Name == "" {
+		return errors.New("Fault rule has no name")
+	}
+	if rule.Method == "" || rule.Pattern == "" {
+		return errors.New("Fault rule needs a method and pattern")
+	}
+	if rule.Percent < 0 || rule.Percent > 100 {
+		return errors.New("Fault percent must be between 0 and 100")
+	}
+	if rule.Delay < 0 || rule.TruncateBody < 0 {
+		return errors.New("Fault delay and truncation must not be negative")
+	}
+	if rule.AbortStatus != 0 && (rule.AbortStatus < 400 || rule.AbortStatus > 599) {
+		return errors.New("Fault abort status must be between 400 and 599")
+	}
+	if rule.Delay == 0 && rule.AbortStatus == 0 && !rule.Reset && rule.TruncateBody == 0 {
+		return errors.New("Fault rule injects nothing")
+	}
+	return nil
+}
+
+// Fault returns the fault rule that applies to a matched request, or nil if
+// none does.  A rule named in FaultHeader takes precedence over rules
+// selected by percentage.
+func (mux *ExchangeServeMux) fault(route *Route, request *http.Request) *FaultRule {
+	mux.rw.RLock()
+	defer mux.rw.RUnlock()
+	if len(mux.faults) == 0 {
+		return nil
+	}
+	if name := request.Header.Get(FaultHeader); name != "" {
+		if rule, present := mux.faults[name]; present && rule.applies(route) {
+			return rule
+		}
+	}
+	names := make([]string, 0, len(mux.faults))
+	for name, rule := range mux.faults {
+		if rule.applies(route) && rule.Percent > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if rand.Float64()*100 < mux.faults[name].Percent {
+			return mux.faults[name]
+		}
+	}
+	return nil
+}
+
+// Applies returns true if the rule is for the route's method and pattern.
+func (rule *FaultRule) applies(route *Route) bool {
+	return rule.Method == route.Method && rule.Pattern == route.Pattern
+}
+
+// Inject applies the rule's delay and, if the rule aborts the request,
+// answers it and returns false.  Connections are reset by aborting the
+// handler, which makes the server close the connection without a response.
+func (rule *FaultRule) inject(writer http.ResponseWriter, request *http.Request, route *Route) bool {
+	route.Fault = rule.Name
+	if rule.Delay > 0 {
+		timer := time.NewTimer(rule.Delay)
+		select {
+		case <-timer.C:
+		case <-request.Context().Done():
+			timer.Stop()
+		}
+	}
+	if rule.Reset {
+		route.Refusal = errFaultReset
+		panic(http.ErrAbortHandler)
+	}
+	if rule.AbortStatus != 0 {
+		route.Refusal = errFaultAborted
+		writer.WriteHeader(rule.AbortStatus)
+		return false
+	}
+	return true
+}
+
+// Truncate wraps a response body, if the rule truncates responses, so it
+// fails after the rule's limit.  Bodies no longer than the limit are
+// relayed intact.
+func (rule *FaultRule) truncate(response *http.Response) {
+	if rule.TruncateBody > 0 {
+		response.Body = &truncatedBody{ReadCloser: response.Body, remaining: rule.TruncateBody}
+	}
+}
+
+// TruncatedBody wraps a response body so it fails if more data follows its
+// first remaining bytes.
+type truncatedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+// Read reads data from the body until the limit is reached, then fails if
+// the body has more data.
+func (body *truncatedBody) Read(data []byte) (int, error) {
+	if body.remaining <= 0 {
+		n, err := body.ReadCloser.Read(make([]byte, 1))
+		if n > 0 {
+			return 0, errFaultTruncated
+		}
+		return 0, err
+	}
+	if int64(len(data)) > body.remaining {
+		data = data[:body.remaining]
+	}
+	n, err := body.ReadCloser.Read(data)
+	body.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,199 @@
+package switchboard
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type FaultTest struct {
+	mux      *ExchangeServeMux
+	server   *httptest.Server
+	requests int32
+}
+
+var _ = Suite(&FaultTest{})
+
+func (s *FaultTest) SetUpTest(c *C) {
+	s.requests = 0
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			atomic.AddInt32(&s.requests, 1)
+			writer.Write([]byte("0123456789"))
+		}))
+	s.mux = NewExchangeServeMux()
+	s.mux.Add("GET", "/user/:id", s.server.URL)
+	s.mux.Add("GET", "/account", s.server.URL)
+}
+
+func (s *FaultTest) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+// Get sends a request through the mux and returns the response and the
+// completed route.
+func (s *FaultTest) get(c *C, path string, header http.Header) (*httptest.ResponseRecorder, *Route) {
+	var route *Route
+	s.mux.Use(&Middleware{Complete: func(request *http.Request, completed *Route) { route = completed }})
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://example.com"+path, nil)
+	c.Assert(err, IsNil)
+	if header != nil {
+		request.Header = header
+	}
+	s.mux.ServeHTTP(writer, request)
+	return writer, route
+}
+
+// Rules abort requests with the chosen status code, without contacting the
+// backend service.
+func (s *FaultTest) TestAbort(c *C) {
+	c.Assert(s.mux.AddFault(&FaultRule{Name: "unavailable", Method: "GET", Pattern: "/user/:id",
+		Percent: 100, AbortStatus: http.StatusServiceUnavailable}), IsNil)
+	writer, route := s.get(c, "/user/123", nil)
+	c.Assert(writer.Code, Equals, http.StatusServiceUnavailable)
+	c.Assert(route.Fault, Equals, "unavailable")
+	c.Assert(route.Refusal, Equals, errFaultAborted)
+	c.Assert(route.Err, IsNil)
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(0))
+
+	// Other routes are unaffected.
+	writer, route = s.get(c, "/account", nil)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(route.Fault, Equals, "")
+}
+
+// Rules with no percentage apply only to requests that name them in the
+// fault header.
+func (s *FaultTest) TestHeader(c *C) {
+	c.Assert(s.mux.AddFault(&FaultRule{Name: "slow", Method: "GET", Pattern: "/user/:id",
+		Delay: 50 * time.Millisecond}), IsNil)
+	writer, route := s.get(c, "/user/123", nil)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(route.Fault, Equals, "")
+
+	start := time.Now()
+	writer, route = s.get(c, "/user/123", http.Header{FaultHeader: []string{"slow"}})
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(writer.Body.String(), Equals, "0123456789")
+	c.Assert(route.Fault, Equals, "slow")
+	c.Assert(time.Since(start) >= 50*time.Millisecond, Equals, true)
+
+	// Naming a rule for another route has no effect.
+	_, route = s.get(c, "/account", http.Header{FaultHeader: []string{"slow"}})
+	c.Assert(route.Fault, Equals, "")
+}
+
+// Rules can reset the client connection or truncate the response body.
+func (s *FaultTest) TestResetAndTruncate(c *C) {
+	exchange := httptest.NewServer(s.mux)
+	defer exchange.Close()
+	c.Assert(s.mux.AddFault(&FaultRule{Name: "reset", Method: "GET", Pattern: "/user/:id",
+		Reset: true}), IsNil)
+	c.Assert(s.mux.AddFault(&FaultRule{Name: "truncate", Method: "GET", Pattern: "/user/:id",
+		TruncateBody: 4}), IsNil)
+
+	request, err := http.NewRequest("GET", exchange.URL+"/user/123", nil)
+	c.Assert(err, IsNil)
+	request.Header.Set(FaultHeader, "reset")
+	_, err = http.DefaultClient.Do(request)
+	c.Assert(err, NotNil)
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(0))
+
+	request.Header.Set(FaultHeader, "truncate")
+	response, err := http.DefaultClient.Do(request)
+	c.Assert(err, IsNil)
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	c.Assert(err, Equals, io.ErrUnexpectedEOF)
+	c.Assert(string(body), Equals, "0123")
+}
+
+// Bodies no longer than the truncation limit are relayed intact.
+func (s *FaultTest) TestTruncateShortBody(c *C) {
+	s.server.Config.Handler = http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte("0123456"))
+			http.NewResponseController(writer).Flush()
+		})
+	c.Assert(s.mux.AddFault(&FaultRule{Name: "truncate", Method: "GET", Pattern: "/user/:id",
+		Percent: 100, TruncateBody: 100}), IsNil)
+	exchange := httptest.NewServer(s.mux)
+	defer exchange.Close()
+	var route *Route
+	s.mux.Use(&Middleware{Complete: func(request *http.Request, completed *Route) { route = completed }})
+
+	response, err := http.Get(exchange.URL + "/user/123")
+	c.Assert(err, IsNil)
+	defer response.Body.Close()
+	c.Assert(response.ContentLength, Equals, int64(-1))
+	body, err := io.ReadAll(response.Body)
+	c.Assert(err, IsNil)
+	c.Assert(string(body), Equals, "0123456")
+	c.Assert(route.Fault, Equals, "truncate")
+	c.Assert(route.Err, IsNil)
+}
+
+// Invalid rules are rejected.
+func (s *FaultTest) TestInvalidRules(c *C) {
+	c.Assert(s.mux.AddFault(&FaultRule{Method: "GET", Pattern: "/account", Reset: true}), ErrorMatches,
+		"Fault rule has no name")
+	c.Assert(s.mux.AddFault(&FaultRule{Name: "reset", Reset: true}), ErrorMatches,
+		"Fault rule needs a method and pattern")
+	c.Assert(s.mux.AddFault(&FaultRule{Name: "reset", Method: "GET", Pattern: "/account", Percent: 101,
+		Reset: true}), ErrorMatches, "Fault percent must be between 0 and 100")
+	c.Assert(s.mux.AddFault(&FaultRule{Name: "abort", Method: "GET", Pattern: "/account",
+		AbortStatus: 1000}), ErrorMatches, "Fault abort status must be between 400 and 599")
+	c.Assert(s.mux.AddFault(&FaultRule{Name: "abort", Method: "GET", Pattern: "/account",
+		AbortStatus: http.StatusContinue}), ErrorMatches, "Fault abort status must be between 400 and 599")
+	c.Assert(s.mux.AddFault(&FaultRule{Name: "abort", Method: "GET", Pattern: "/account",
+		AbortStatus: http.StatusOK}), ErrorMatches, "Fault abort status must be between 400 and 599")
+	c.Assert(s.mux.AddFault(&FaultRule{Name: "noop", Method: "GET", Pattern: "/account"}), ErrorMatches,
+		"Fault rule injects nothing")
+	c.Assert(s.mux.Faults(), HasLen, 0)
+}
+
+// Rules can be listed, installed and removed at runtime through the admin
+// API.
+func (s *FaultTest) TestAdmin(c *C) {
+	admin := NewAdmin(NewExchange("test", nil, s.mux), nil)
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		writer := httptest.NewRecorder()
+		request, err := http.NewRequest(method, "http://admin"+path, strings.NewReader(body))
+		c.Assert(err, IsNil)
+		admin.ServeHTTP(writer, request)
+		return writer
+	}
+
+	writer := serve("POST", "/faults",
+		`{"name": "broken", "method": "GET", "pattern": "/account", "percent": 100, "abort_status": 500}`)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	response, _ := s.get(c, "/account", nil)
+	c.Assert(response.Code, Equals, http.StatusInternalServerError)
+
+	writer = serve("GET", "/faults", "")
+	var rules []FaultRule
+	c.Assert(json.Unmarshal(writer.Body.Bytes(), &rules), IsNil)
+	c.Assert(rules, DeepEquals, []FaultRule{{Name: "broken", Method: "GET", Pattern: "/account",
+		Percent: 100, AbortStatus: 500}})
+
+	writer = serve("POST", "/faults", `{"name": "broken"}`)
+	c.Assert(writer.Code, Equals, http.StatusBadRequest)
+	var failure map[string]string
+	c.Assert(json.Unmarshal(writer.Body.Bytes(), &failure), IsNil)
+	c.Assert(failure["error"], Equals, "fault rule needs a method and pattern")
+
+	writer = serve("DELETE", "/faults?name=broken", "")
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	writer = serve("DELETE", "/faults?name=broken", "")
+	c.Assert(writer.Code, Equals, http.StatusNotFound)
+	response, _ = s.get(c, "/account", nil)
+	c.Assert(response.Code, Equals, http.StatusOK)
+	c.Assert(serve("PUT", "/faults", "").Code, Equals, http.StatusMethodNotAllowed)
+}
@@ -0,0 +1,242 @@
+package switchboard
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HeaderOperation names the change a HeaderRule makes.
+type HeaderOperation string
+
+const (
+	// SetHeader replaces any values of a header with a single value.
+	SetHeader HeaderOperation = "set"
+
+	// AppendHeader adds a value to a header, keeping existing values.
+	AppendHeader HeaderOperation = "append"
+
+	// RemoveHeader removes every value of a header.
+	RemoveHeader HeaderOperation = "remove"
+
+	// RenameHeader moves every value of a header to a header named by the
+	// rule's value.
+	RenameHeader HeaderOperation = "rename"
+)
+
+// HeaderRule changes a single header.  The values of set and append rules
+// are templates that may refer to the request with placeholders in braces:
+//
+//	{param.NAME}        a value captured by the matched pattern
+//	{query.NAME}        a query string argument
+//	{header.NAME}       a header sent by the client
+//	{request.id}        the request ID
+//	{request.method}    the HTTP method
+//	{request.path}      the URL path
+//	{request.host}      the host the client requested
+//	{request.remote_ip} the IP address of the client
+//	{route.pattern}     the pattern that matched the request
+//	{service.id}        the ID of the selected service
+//	{service.name}      the logical name of the selected service
+//	{service.version}   the version of the selected service
+//
+// Placeholders with no value expand to an empty string.
+type HeaderRule struct {
+	Operation HeaderOperation `json:"op"`
+	Name      string          `json:"name"`
+	Value     string          `json:"value,omitempty"`
+}
+
+// HeaderRules are applied to the request sent to a backend service and to
+// the response relayed back to the client, in order.
+type HeaderRules struct {
+	Request  []HeaderRule `json:"request,omitempty"`
+	Response []HeaderRule `json:"response,omitempty"`
+}
+
+// Headers returns middleware that applies header rules.  Install it with Use
+// to apply the rules to every request or with UseRoute to apply them to a
+// single route.  An error is returned if a rule is invalid.
+func Headers(rules *HeaderRules) (*Middleware, error) {
+	requestRules, err := compileHeaderRules(rules.Request)
+	if err != nil {
+		return nil, err
+	}
+	responseRules, err := compileHeaderRules(rules.Response)
+	if err != nil {
+		return nil, err
+	}
+	return &Middleware{
+		PreProxy: func(writer http.ResponseWriter, request, outbound *http.Request, route *Route) bool {
+			applyHeaderRules(requestRules, outbound.Header, request, route)
+			return true
+		},
+		PostProxy: func(writer http.ResponseWriter, request *http.Request, response *http.Response, route *Route) bool {
+			applyHeaderRules(responseRules, response.Header, request, route)
+			return true
+		}}, nil
+}
+
+// CompiledHeaderRule is a header rule with its value template parsed.
+type compiledHeaderRule struct {
+	rule     HeaderRule
+	template []templateSegment
+}
+
+// TemplateSegment is literal text or a placeholder in a value template.
+type templateSegment struct {
+	literal     string
+	placeholder string
+}
+
+// CompileHeaderRules validates header rules and parses their templates.
+func compileHeaderRules(rules []HeaderRule) ([]compiledHeaderRule, error) {
+	compiled := make([]compiledHeaderRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, errors.New("Header rule has no header name")
+		}
+		result := compiledHeaderRule{rule: rule}
+		switch rule.Operation {
+		case SetHeader, AppendHeader:
+			template, err := parseTemplate(rule.Value)
+			if err != nil {
+				return nil, err
+			}
+			result.template = template
+		case RenameHeader:
+			if rule.Value == "" {
+				return nil, errors.New("Rename rule for " + rule.Name + " has no new name")
+			}
+		case RemoveHeader:
+		default:
+			return nil, errors.New("Unknown header operation " + string(rule.Operation))
+		}
+		compiled = append(compiled, result)
+	}
+	return compiled, nil
+}
+
+// ApplyHeaderRules changes header according to rules.
+func applyHeaderRules(rules []compiledHeaderRule, header http.Header, request *http.Request, route *Route) {
+	for _, compiled := range rules {
+		rule := compiled.rule
+		switch rule.Operation {
+		case SetHeader:
+			header.Set(rule.Name, expandTemplate(compiled.template, request, route))
+		case AppendHeader:
+			header.Add(rule.Name, expandTemplate(compiled.template, request, route))
+		case RemoveHeader:
+			header.Del(rule.Name)
+		case RenameHeader:
+			values := header.Values(rule.Name)
+			if len(values) == 0 {
+				continue
+			}
+			values = append([]string(nil), values...)
+			header.Del(rule.Name)
+			header.Del(rule.Value)
+			for _, value := range values {
+				header.Add(rule.Value, value)
+			}
+		}
+	}
+}
+
+// ParseTemplate splits a value template into literal text and placeholders.
+func parseTemplate(template string) ([]templateSegment, error) {
+	segments := make([]templateSegment, 0)
+	for template != "" {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			segments = append(segments, templateSegment{literal: template})
+			break
+		}
+		if start > 0 {
+			segments = append(segments, templateSegment{literal: template[:start]})
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return nil, errors.New("Unterminated placeholder in " + template)
+		}
+		placeholder := template[start+1 : start+end]
+		if !validPlaceholder(placeholder) {
+			return nil, errors.New("Unknown placeholder {" + placeholder + "}")
+		}
+		segments = append(segments, templateSegment{placeholder: placeholder})
+		template = template[start+end+1:]
+	}
+	return segments, nil
+}
+
+// ValidPlaceholder returns true if placeholder names a value that templates
+// can refer to.
+func validPlaceholder(placeholder string) bool {
+	switch placeholder {
+	case "request.id", "request.method", "request.path", "request.host",
+		"request.remote_ip", "route.pattern", "service.id", "service.name",
+		"service.version":
+		return true
+	}
+	for _, prefix := range []string{"param.", "query.", "header."} {
+		if strings.HasPrefix(placeholder, prefix) && len(placeholder) > len(prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandTemplate fills in a parsed template for a request.
+func expandTemplate(template []templateSegment, request *http.Request, route *Route) string {
+	var value strings.Builder
+	for _, segment := range template {
+		if segment.placeholder == "" {
+			value.WriteString(segment.literal)
+			continue
+		}
+		value.WriteString(placeholderValue(segment.placeholder, request, route))
+	}
+	return value.String()
+}
+
+// PlaceholderValue returns the value a placeholder refers to.
+func placeholderValue(placeholder string, request *http.Request, route *Route) string {
+	switch {
+	case strings.HasPrefix(placeholder, "param."):
+		return route.Params.Get(strings.TrimPrefix(placeholder, "param."))
+	case strings.HasPrefix(placeholder, "query."):
+		return request.URL.Query().Get(strings.TrimPrefix(placeholder, "query."))
+	case strings.HasPrefix(placeholder, "header."):
+		return request.Header.Get(strings.TrimPrefix(placeholder, "header."))
+	}
+	switch placeholder {
+	case "request.id":
+		return route.RequestID
+	case "request.method":
+		return request.Method
+	case "request.path":
+		return request.URL.Path
+	case "request.host":
+		return request.Host
+	case "request.remote_ip":
+		if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+			return host
+		}
+		return request.RemoteAddr
+	case "route.pattern":
+		return route.Pattern
+	}
+	if route.Service == nil {
+		return ""
+	}
+	switch placeholder {
+	case "service.id":
+		return route.Service.ID
+	case "service.name":
+		return route.Service.LogicalName()
+	case "service.version":
+		return route.Service.Version
+	}
+	return ""
+}
@@ -0,0 +1,122 @@
+package switchboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+type HeadersTest struct {
+	mux      *ExchangeServeMux
+	server   *httptest.Server
+	received chan http.Header
+}
+
+var _ = Suite(&HeadersTest{})
+
+func (s *HeadersTest) SetUpTest(c *C) {
+	s.received = make(chan http.Header, 1)
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			s.received <- request.Header
+			writer.Header().Set("Server", "backend/1.0")
+			writer.Header().Set("X-Powered-By", "go")
+			writer.Header().Add("X-Debug", "a")
+			writer.Header().Add("X-Debug", "b")
+		}))
+	s.mux = NewExchangeServeMux()
+	s.mux.AddService(&ServiceRecord{
+		ID:      "users-1",
+		Name:    "users",
+		Version: "1.2.0",
+		Address: s.server.URL,
+		Routes:  Routes{"GET": []string{"/tenant/:tenant/users", "/health"}}})
+}
+
+func (s *HeadersTest) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+// Get sends a GET request through the mux.
+func (s *HeadersTest) get(c *C, url string, header http.Header) *httptest.ResponseRecorder {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, IsNil)
+	request.Header = header
+	request.RemoteAddr = "10.0.0.1:1234"
+	s.mux.ServeHTTP(writer, request)
+	return writer
+}
+
+// Headers rejects rules without a name, with unknown operations or
+// placeholders, and rename rules without a new name.
+func (s *HeadersTest) TestHeadersValidatesRules(c *C) {
+	_, err := Headers(&HeaderRules{Request: []HeaderRule{{Operation: SetHeader}}})
+	c.Assert(err, ErrorMatches, "Header rule has no header name")
+	_, err = Headers(&HeaderRules{Request: []HeaderRule{{Operation: "replace", Name: "X-A"}}})
+	c.Assert(err, ErrorMatches, "Unknown header operation replace")
+	_, err = Headers(&HeaderRules{Response: []HeaderRule{{Operation: RenameHeader, Name: "X-A"}}})
+	c.Assert(err, ErrorMatches, "Rename rule for X-A has no new name")
+	_, err = Headers(&HeaderRules{Request: []HeaderRule{
+		{Operation: SetHeader, Name: "X-A", Value: "{request.user}"}}})
+	c.Assert(err, ErrorMatches, "Unknown placeholder \\{request.user\\}")
+	_, err = Headers(&HeaderRules{Request: []HeaderRule{
+		{Operation: SetHeader, Name: "X-A", Value: "{param.id"}}})
+	c.Assert(err, ErrorMatches, "Unterminated placeholder in \\{param.id")
+}
+
+// Request rules set, append, remove and rename headers sent to the backend,
+// expanding placeholders from the request and route.
+func (s *HeadersTest) TestRequestRules(c *C) {
+	middleware, err := Headers(&HeaderRules{Request: []HeaderRule{
+		{Operation: SetHeader, Name: "X-Tenant-ID", Value: "{param.tenant}"},
+		{Operation: SetHeader, Name: "X-Origin", Value: "{request.method} {request.path}?page={query.page} from {request.remote_ip}"},
+		{Operation: AppendHeader, Name: "X-Forwarded-Service", Value: "{service.name}@{service.version}"},
+		{Operation: RemoveHeader, Name: "Cookie"},
+		{Operation: RenameHeader, Name: "X-Token", Value: "X-Internal-Token"}}})
+	c.Assert(err, IsNil)
+	s.mux.Use(middleware)
+
+	header := http.Header{
+		"X-Tenant-Id":         {"spoofed"},
+		"X-Forwarded-Service": {"edge"},
+		"Cookie":              {"session=secret"},
+		"X-Token":             {"abc"}}
+	writer := s.get(c, "http://example.com/tenant/acme/users?page=2", header)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	received := <-s.received
+	c.Assert(received.Get("X-Tenant-ID"), Equals, "acme")
+	c.Assert(received.Get("X-Origin"), Equals, "GET /tenant/acme/users?page=2 from 10.0.0.1")
+	c.Assert(received["X-Forwarded-Service"], DeepEquals, []string{"edge", "users@1.2.0"})
+	c.Assert(received.Get("Cookie"), Equals, "")
+	c.Assert(received.Get("X-Token"), Equals, "")
+	c.Assert(received.Get("X-Internal-Token"), Equals, "abc")
+}
+
+// Response rules scrub headers before they reach the client.  Rules
+// installed for a route apply only to that route, after global rules.
+func (s *HeadersTest) TestResponseRules(c *C) {
+	global, err := Headers(&HeaderRules{Response: []HeaderRule{
+		{Operation: RemoveHeader, Name: "Server"},
+		{Operation: RemoveHeader, Name: "X-Powered-By"},
+		{Operation: SetHeader, Name: "X-Served-By", Value: "{service.id}"}}})
+	c.Assert(err, IsNil)
+	s.mux.Use(global)
+	route, err := Headers(&HeaderRules{Response: []HeaderRule{
+		{Operation: RenameHeader, Name: "X-Debug", Value: "X-Backend-Debug"}}})
+	c.Assert(err, IsNil)
+	s.mux.UseRoute("GET", "/health", route)
+
+	writer := s.get(c, "http://example.com/tenant/acme/users", http.Header{})
+	<-s.received
+	c.Assert(writer.Header().Get("Server"), Equals, "")
+	c.Assert(writer.Header().Get("X-Powered-By"), Equals, "")
+	c.Assert(writer.Header().Get("X-Served-By"), Equals, "users-1")
+	c.Assert(writer.Header()["X-Debug"], DeepEquals, []string{"a", "b"})
+
+	writer = s.get(c, "http://example.com/health", http.Header{})
+	<-s.received
+	c.Assert(writer.Header()["X-Debug"], IsNil)
+	c.Assert(writer.Header()["X-Backend-Debug"], DeepEquals, []string{"a", "b"})
+}
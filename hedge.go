@@ -0,0 +1,301 @@
+package switchboard
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultHedgeRate is the fraction of a route's requests that may be hedged
+// when HedgeConfig.MaxRate isn't set.
+const DefaultHedgeRate = 0.1
+
+// DefaultHedgeMethods are the idempotent methods hedged when
+// HedgeConfig.Methods isn't set.
+var DefaultHedgeMethods = []string{"GET", "HEAD", "OPTIONS"}
+
+// hedgeSamples is the number of recent latencies kept for each hedged
+// route, and hedgeMinSamples the number needed before percentiles are used.
+const (
+	hedgeSamples    = 1000
+	hedgeMinSamples = 20
+)
+
+// HedgeConfig enables hedged requests for a route.  If the backend service
+// selected for a request hasn't responded after a delay, the request is sent
+// to a second address serving the same version of the service, and the
+// first response wins.  The other request is cancelled.  Only requests
+// with an idempotent method and without a body are hedged.
+type HedgeConfig struct {
+	// Delay is how long to wait for the first response before hedging.  It's
+	// required, since it's used until Percentile can be.
+	Delay time.Duration
+
+	// Percentile, if set, replaces Delay with the given percentile, between
+	// 0 and 100, of the route's recent response latency.  Delay is used
+	// until enough responses have been observed.
+	Percentile float64
+
+	// MaxRate is the largest fraction of the route's requests, between 0
+	// and 1, that may be hedged.
+	MaxRate float64
+
+	// Methods lists the methods that may be hedged, which must be
+	// idempotent.  DefaultHedgeMethods is used if it's nil.
+	Methods []string
+}
+
+// SetRouteHedging enables hedged requests for an HTTP method and URL
+// pattern.  A nil config disables them.
+func (mux *ExchangeServeMux) SetRouteHedging(method, pattern string, config *HedgeConfig) error {
+	var h *hedger
+	if config != nil {
+		if config.Delay < 0 || config.Percentile < 0 || config.Percentile > 100 ||
+			config.MaxRate < 0 || config.MaxRate > 1 {
+			return errors.New("Invalid hedge config")
+		}
+		if config.Delay == 0 {
+			return errors.New("Hedge config needs a delay")
+		}
+		h = &hedger{config: *config, samples: make([]time.Duration, 0, hedgeSamples)}
+		if h.config.MaxRate == 0 {
+			h.config.MaxRate = DefaultHedgeRate
+		}
+		if h.config.Methods == nil {
+			h.config.Methods = DefaultHedgeMethods
+		}
+	}
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.config(method, pattern).hedge = h
+	return nil
+}
+
+// Hedger tracks the latency and hedge budget of a hedged route.
+type hedger struct {
+	config  HedgeConfig
+	mutex   sync.Mutex      // Synchronize access to the fields below.
+	samples []time.Duration // Recent response latencies, used as a ring.
+	next    int             // The index of the oldest sample, once full.
+	delay   time.Duration   // The percentile delay, recomputed periodically.
+	stale   int             // Samples added since delay was computed.
+	budget  float64         // Hedges that may be sent, earned by requests.
+}
+
+// Wait returns how long to wait before hedging a request.  Each request
+// earns a fraction of a hedge, up to a small burst.
+func (h *hedger) wait() time.Duration {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.budget += h.config.MaxRate
+	if h.budget > 10 {
+		h.budget = 10
+	}
+	if h.config.Percentile == 0 || len(h.samples) < hedgeMinSamples {
+		return h.config.Delay
+	}
+	if h.delay == 0 || h.stale >= hedgeMinSamples {
+		sorted := append([]time.Duration(nil), h.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		index := int(float64(len(sorted)-1) * h.config.Percentile / 100)
+		h.delay = sorted[index]
+		h.stale = 0
+	}
+	return h.delay
+}
+
+// Allow spends a hedge from the budget and returns true, or returns false if
+// the route has hedged too many requests.
+func (h *hedger) allow() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.budget < 1 {
+		return false
+	}
+	h.budget--
+	return true
+}
+
+// Observe records the latency of a response.
+func (h *hedger) observe(latency time.Duration) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if len(h.samples) < hedgeSamples {
+		h.samples = append(h.samples, latency)
+	} else {
+		h.samples[h.next] = latency
+		h.next = (h.next + 1) % hedgeSamples
+	}
+	h.stale++
+}
+
+// Attempt is one of the requests sent for a hedged request.
+type attempt struct {
+	address  string
+	outbound *http.Request
+	cancel   context.CancelFunc
+	response *http.Response
+	err      error
+	latency  time.Duration
+}
+
+// Hedge sends a proxied request to the route's backend service, sending it
+// to a second address as well if hedging is enabled for the route and the
+// first address is slow to respond.  The route's address is updated to the
+// address that answered.
+func (mux *ExchangeServeMux) hedge(route *Route, request, outbound *http.Request) (*http.Response, error) {
+	mux.rw.RLock()
+	var h *hedger
+	if config, present := mux.configs[routeKey(route.Method, route.Pattern)]; present {
+		h = config.hedge
+	}
+	mux.rw.RUnlock()
+
+	// Requests are signed once the cache has made them conditional, so the
+	// signature covers the validators.  A failure to sign is a refusal
+	// rather than a backend error.
+	if err := mux.sign(outbound); err != nil {
+		route.Refusal = err
+		return nil, err
+	}
+	if h == nil || !contains(h.config.Methods, outbound.Method) ||
+		(outbound.Body != nil && outbound.Body != http.NoBody) {
+		return mux.send(route, outbound)
+	}
+
+	start := time.Now()
+	results := make(chan *attempt, 2)
+	run := func(current *attempt) {
+		sent := time.Now()
+		current.response, current.err = http.DefaultClient.Do(current.outbound)
+		current.latency = time.Since(sent)
+		results <- current
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	primary := &attempt{address: route.Address, outbound: outbound.WithContext(ctx), cancel: cancel}
+	go run(primary)
+
+	timer := time.NewTimer(h.wait())
+	defer timer.Stop()
+	var winner *attempt
+	select {
+	case winner = <-results:
+	case <-timer.C:
+		if secondary := mux.hedgeAttempt(route, request, outbound, h); secondary != nil {
+			route.Retries++
+			go run(secondary)
+			winner = <-results
+			loser := secondary
+			if winner == secondary {
+				loser = primary
+			}
+			if winner.err != nil {
+				// The first attempt to finish failed, so wait for the other.
+				mux.observe(winner.address, winner.err)
+				winner.cancel()
+				winner, loser = <-results, winner
+			} else {
+				loser.cancel()
+				go func() {
+					if abandoned := <-results; abandoned.response != nil {
+						abandoned.response.Body.Close()
+					}
+				}()
+			}
+		} else {
+			winner = <-results
+		}
+	}
+
+	elapsed := time.Since(start)
+	route.Upstream += elapsed
+	mux.observe(winner.address, winner.err)
+	if winner.err != nil {
+		winner.cancel()
+		return nil, winner.err
+	}
+
+	// The primary's latency is observed even when the hedged request wins,
+	// so hedging doesn't pull the percentile down.  A primary that lost was
+	// still waiting when the winner answered.
+	latency := elapsed
+	if winner == primary {
+		latency = primary.latency
+	}
+	h.observe(latency)
+	if winner.address != route.Address {
+		mux.rw.RLock()
+		route.Address = winner.address
+		route.Service = mux.services[winner.address]
+		mux.rw.RUnlock()
+	}
+	winner.response.Body = cancelOnClose{winner.response.Body, winner.cancel}
+	return winner.response, nil
+}
+
+// HedgeAttempt prepares a hedged request to an address other than the
+// route's, serving the same version of the same service, or returns nil if
+// there isn't one or the route's hedge budget is spent.
+func (mux *ExchangeServeMux) hedgeAttempt(route *Route, request, outbound *http.Request, h *hedger) *attempt {
+	mux.rw.RLock()
+	handler := mux.find(route.Method, route.Path)
+	candidates := make([]string, 0)
+	if handler != nil {
+		for _, address := range handler.addresses {
+			service := mux.services[address]
+			if address == route.Address || (route.Service != nil && (service == nil ||
+				service.LogicalName() != route.Service.LogicalName() ||
+				service.Version != route.Service.Version)) {
+				continue
+			}
+			candidates = append(candidates, address)
+		}
+	}
+	var address string
+	var service *ServiceRecord
+	if len(candidates) > 0 {
+		address = candidates[rand.Intn(len(candidates))]
+		service = mux.services[address]
+	}
+	mux.rw.RUnlock()
+	if address == "" || !h.allow() {
+		return nil
+	}
+
+	target := request.URL.EscapedPath()
+	if service != nil {
+		target = service.RewritePath(target)
+	}
+	hedgedURL, err := backendURL(address, target, request.URL.RawQuery)
+	if err != nil {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	hedged := outbound.Clone(ctx)
+	hedged.URL = hedgedURL
+	hedged.Host = hedgedURL.Host
+	if err := mux.sign(hedged); err != nil {
+		cancel()
+		return nil
+	}
+	return &attempt{address: address, outbound: hedged, cancel: cancel}
+}
+
+// CancelOnClose wraps a response body to cancel its request's context once
+// the body has been read and closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+// Close closes the body and cancels the request's context.
+func (body cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
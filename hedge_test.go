@@ -0,0 +1,158 @@
+package switchboard
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type HedgeTest struct {
+	mux      *ExchangeServeMux
+	servers  []*httptest.Server
+	requests int32
+	release  chan bool
+}
+
+var _ = Suite(&HedgeTest{})
+
+func (s *HedgeTest) SetUpTest(c *C) {
+	s.requests = 0
+	s.release = make(chan bool)
+	s.mux = NewExchangeServeMux()
+	s.servers = nil
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("backend-%d", i)
+		server := httptest.NewServer(http.HandlerFunc(
+			func(writer http.ResponseWriter, request *http.Request) {
+				// The first request stalls until it's released or cancelled,
+				// so the hedged request answers first.
+				if atomic.AddInt32(&s.requests, 1) == 1 {
+					select {
+					case <-s.release:
+					case <-request.Context().Done():
+						return
+					}
+				}
+				writer.Write([]byte(name))
+			}))
+		s.servers = append(s.servers, server)
+		s.mux.AddService(&ServiceRecord{ID: name, Name: "users", Version: "1", Address: server.URL,
+			Routes: Routes{"GET": []string{"/user/:id"}}})
+	}
+}
+
+func (s *HedgeTest) TearDownTest(c *C) {
+	close(s.release)
+	for _, server := range s.servers {
+		server.Close()
+	}
+}
+
+// Get sends a request through the mux and returns the response and the
+// completed route.
+func (s *HedgeTest) get(c *C) (*httptest.ResponseRecorder, *Route) {
+	var route *Route
+	s.mux.Use(&Middleware{Complete: func(request *http.Request, completed *Route) { route = completed }})
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://example.com/user/123", nil)
+	c.Assert(err, IsNil)
+	s.mux.ServeHTTP(writer, request)
+	return writer, route
+}
+
+// Requests that aren't answered within the hedge delay are sent to a second
+// address, and the first response is used.
+func (s *HedgeTest) TestHedge(c *C) {
+	c.Assert(s.mux.SetRouteHedging("GET", "/user/:id",
+		&HedgeConfig{Delay: 20 * time.Millisecond, MaxRate: 1}), IsNil)
+	writer, route := s.get(c)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(route.Retries, Equals, 1)
+	c.Assert(writer.Body.String(), Equals, route.Service.ID)
+	c.Assert(route.Address, Equals, route.Service.Address)
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(2))
+
+	// The primary's latency is observed, although the hedged request won.
+	h := s.mux.configs[routeKey("GET", "/user/:id")].hedge
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	c.Assert(h.samples, HasLen, 1)
+	c.Assert(h.samples[0] >= 20*time.Millisecond, Equals, true)
+}
+
+// Requests with methods that may not be idempotent aren't hedged, even
+// without a body.
+func (s *HedgeTest) TestHedgeMethods(c *C) {
+	c.Assert(s.mux.SetRouteHedging("DELETE", "/user/:id",
+		&HedgeConfig{Delay: 20 * time.Millisecond, MaxRate: 1}), IsNil)
+	for _, server := range s.servers {
+		s.mux.Add("DELETE", "/user/:id", server.URL)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.release <- true
+	}()
+	var route *Route
+	s.mux.Use(&Middleware{Complete: func(request *http.Request, completed *Route) { route = completed }})
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("DELETE", "http://example.com/user/123", nil)
+	c.Assert(err, IsNil)
+	s.mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(route.Retries, Equals, 0)
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(1))
+}
+
+// Requests aren't hedged once the route's hedge budget is spent.
+func (s *HedgeTest) TestHedgeBudget(c *C) {
+	c.Assert(s.mux.SetRouteHedging("GET", "/user/:id",
+		&HedgeConfig{Delay: 20 * time.Millisecond, MaxRate: 0.5}), IsNil)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		s.release <- true
+	}()
+	writer, route := s.get(c)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(route.Retries, Equals, 0)
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(1))
+}
+
+// Routes without hedging send one request.
+func (s *HedgeTest) TestWithoutHedging(c *C) {
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		s.release <- true
+	}()
+	writer, route := s.get(c)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(route.Retries, Equals, 0)
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(1))
+}
+
+// The hedge delay is a percentile of the route's recent latency once enough
+// responses have been observed.
+func (s *HedgeTest) TestPercentileDelay(c *C) {
+	h := &hedger{config: HedgeConfig{Delay: time.Second, Percentile: 90, MaxRate: 0.1}}
+	c.Assert(h.wait(), Equals, time.Second)
+	for i := 1; i <= 100; i++ {
+		h.observe(time.Duration(i) * time.Millisecond)
+	}
+	c.Assert(h.wait(), Equals, 90*time.Millisecond)
+}
+
+// Invalid hedge configs are rejected.
+func (s *HedgeTest) TestInvalidConfig(c *C) {
+	c.Assert(s.mux.SetRouteHedging("GET", "/user/:id", &HedgeConfig{}), ErrorMatches,
+		"Hedge config needs a delay")
+	c.Assert(s.mux.SetRouteHedging("GET", "/user/:id", &HedgeConfig{Percentile: 90}), ErrorMatches,
+		"Hedge config needs a delay")
+	c.Assert(s.mux.SetRouteHedging("GET", "/user/:id", &HedgeConfig{Percentile: 101}), ErrorMatches,
+		"Invalid hedge config")
+	c.Assert(s.mux.SetRouteHedging("GET", "/user/:id", &HedgeConfig{Delay: time.Second, MaxRate: 2}),
+		ErrorMatches, "Invalid hedge config")
+	c.Assert(s.mux.SetRouteHedging("GET", "/user/:id", nil), IsNil)
+}
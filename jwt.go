@@ -0,0 +1,269 @@
+package switchboard
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// JSONWebKey is a key from a JWKS document, as described in RFC 7517.  Only
+// the members needed to verify HS256, RS256 and ES256 signatures are
+// decoded.
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+	Use       string `json:"use,omitempty"`
+	K         string `json:"k,omitempty"`   // Symmetric key.
+	N         string `json:"n,omitempty"`   // RSA modulus.
+	E         string `json:"e,omitempty"`   // RSA exponent.
+	Curve     string `json:"crv,omitempty"` // Elliptic curve.
+	X         string `json:"x,omitempty"`   // Elliptic curve point.
+	Y         string `json:"y,omitempty"`   // Elliptic curve point.
+}
+
+// KeySet holds keys used to verify JWT signatures.
+type KeySet struct {
+	keys []verificationKey
+}
+
+// VerificationKey is a decoded key and the algorithm it verifies.
+type verificationKey struct {
+	id        string
+	algorithm string
+	key       interface{}
+}
+
+// LoadJWKS reads a JWKS document from a file.
+func LoadJWKS(filename string) (*KeySet, error) {
+	document, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseJWKS(document)
+}
+
+// ParseJWKS decodes a JWKS document.  Keys with a use other than sig are
+// ignored.  An error is returned if a key can't be decoded.
+func ParseJWKS(document []byte) (*KeySet, error) {
+	var jwks struct {
+		Keys []JSONWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(document, &jwks); err != nil {
+		return nil, err
+	}
+	set := &KeySet{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.decode()
+		if err != nil {
+			return nil, err
+		}
+		set.keys = append(set.keys, key)
+	}
+	return set, nil
+}
+
+// Decode converts a JSON web key into a key that can verify signatures.
+func (jwk *JSONWebKey) decode() (verificationKey, error) {
+	key := verificationKey{id: jwk.KeyID, algorithm: jwk.Algorithm}
+	switch jwk.KeyType {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil || len(secret) == 0 {
+			return key, errors.New("Invalid symmetric key " + jwk.KeyID)
+		}
+		key.key = secret
+		if key.algorithm == "" {
+			key.algorithm = "HS256"
+		}
+	case "RSA":
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil || len(n) == 0 || len(e) == 0 {
+			return key, errors.New("Invalid RSA key " + jwk.KeyID)
+		}
+		key.key = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.algorithm == "" {
+			key.algorithm = "RS256"
+		}
+	case "EC":
+		if jwk.Curve != "P-256" {
+			return key, errors.New("Unsupported curve " + jwk.Curve + " for key " + jwk.KeyID)
+		}
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if errX != nil || errY != nil {
+			return key, errors.New("Invalid EC key " + jwk.KeyID)
+		}
+		public := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y)}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return key, errors.New("Invalid EC key " + jwk.KeyID)
+		}
+		key.key = public
+		if key.algorithm == "" {
+			key.algorithm = "ES256"
+		}
+	default:
+		return key, errors.New("Unsupported key type " + jwk.KeyType)
+	}
+	return key, nil
+}
+
+// Claims are the claims in a verified JWT.
+type Claims map[string]interface{}
+
+// JWTValidation describes the registered claims a JWT must satisfy.
+type JWTValidation struct {
+	Issuer   string        // The required iss claim, if set.
+	Audience string        // A required aud claim value, if set.
+	Leeway   time.Duration // Clock skew allowed for exp and nbf.
+}
+
+// Verify checks a compact JWT's signature against the key set and validates
+// its registered claims.  The claims are returned if the token is valid.
+func (set *KeySet) Verify(token string, validation *JWTValidation, now time.Time) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Malformed token")
+	}
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, errors.New("Malformed token header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Malformed token signature")
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range set.keys {
+		if key.algorithm != header.Algorithm || (header.KeyID != "" && key.id != header.KeyID) {
+			continue
+		}
+		if key.verify(signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New("Invalid token signature")
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, errors.New("Malformed token claims")
+	}
+	if err := claims.validate(validation, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Verify returns true if signature is a valid signature of signed.
+func (key *verificationKey) verify(signed, signature []byte) bool {
+	digest := sha256.Sum256(signed)
+	switch material := key.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, material)
+		mac.Write(signed)
+		return key.algorithm == "HS256" && hmac.Equal(mac.Sum(nil), signature)
+	case *rsa.PublicKey:
+		return key.algorithm == "RS256" &&
+			rsa.VerifyPKCS1v15(material, crypto.SHA256, digest[:], signature) == nil
+	case *ecdsa.PublicKey:
+		if key.algorithm != "ES256" || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(material, digest[:], r, s)
+	}
+	return false
+}
+
+// Validate checks the exp, nbf, iss and aud claims.
+func (claims Claims) validate(validation *JWTValidation, now time.Time) error {
+	if validation == nil {
+		validation = &JWTValidation{}
+	}
+	if exp, present := claims["exp"].(float64); present {
+		if now.After(time.Unix(int64(exp), 0).Add(validation.Leeway)) {
+			return errors.New("Token has expired")
+		}
+	}
+	if nbf, present := claims["nbf"].(float64); present {
+		if now.Add(validation.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return errors.New("Token is not valid yet")
+		}
+	}
+	if validation.Issuer != "" && claims["iss"] != validation.Issuer {
+		return errors.New("Token has the wrong issuer")
+	}
+	if validation.Audience != "" && !contains(claims.Strings("aud"), validation.Audience) {
+		return errors.New("Token has the wrong audience")
+	}
+	return nil
+}
+
+// Subject returns the sub claim.
+func (claims Claims) Subject() string {
+	subject, _ := claims["sub"].(string)
+	return subject
+}
+
+// Strings returns a claim that's either a string or an array of strings.
+func (claims Claims) Strings(name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// Scopes returns the scopes granted by the scope claim, a space-separated
+// string, or the scp claim, an array of strings.
+func (claims Claims) Scopes() []string {
+	if scope, present := claims["scope"].(string); present {
+		return strings.Fields(scope)
+	}
+	return claims.Strings("scp")
+}
+
+// DecodeSegment decodes a base64url-encoded JSON segment of a JWT.
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
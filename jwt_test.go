@@ -0,0 +1,149 @@
+package switchboard
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+// Keys used to sign test tokens, shared by the JWT and auth suites.
+var (
+	testSecret      = []byte("a-very-secret-hmac-key")
+	testRSAKey, _   = rsa.GenerateKey(rand.Reader, 2048)
+	testECDSAKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+)
+
+// TestJWKS returns a JWKS document holding the test keys.
+func testJWKS() []byte {
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks := map[string][]JSONWebKey{"keys": {
+		{KeyType: "oct", KeyID: "hmac", K: encode(testSecret)},
+		{KeyType: "RSA", KeyID: "rsa", Use: "sig",
+			N: encode(testRSAKey.N.Bytes()),
+			E: encode(big.NewInt(int64(testRSAKey.E)).Bytes())},
+		{KeyType: "EC", KeyID: "ec", Curve: "P-256",
+			X: encode(testECDSAKey.X.FillBytes(make([]byte, 32))),
+			Y: encode(testECDSAKey.Y.FillBytes(make([]byte, 32)))},
+		{KeyType: "RSA", KeyID: "encryption", Use: "enc"}}}
+	document, _ := json.Marshal(jwks)
+	return document
+}
+
+// SignToken creates a compact JWT signed with one of the test keys.
+func signToken(algorithm, keyID string, claims map[string]interface{}) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	header, _ := json.Marshal(map[string]string{"alg": algorithm, "kid": keyID, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := encode(header) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var signature []byte
+	switch algorithm {
+	case "HS256":
+		mac := hmac.New(sha256.New, testSecret)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case "RS256":
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, testRSAKey, crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, _ := ecdsa.Sign(rand.Reader, testECDSAKey, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signed + "." + encode(signature)
+}
+
+type JWTTest struct {
+	keys *KeySet
+	now  time.Time
+}
+
+var _ = Suite(&JWTTest{})
+
+func (s *JWTTest) SetUpTest(c *C) {
+	filename := filepath.Join(c.MkDir(), "jwks.json")
+	c.Assert(os.WriteFile(filename, testJWKS(), 0600), IsNil)
+	keys, err := LoadJWKS(filename)
+	c.Assert(err, IsNil)
+	s.keys = keys
+	s.now = time.Unix(1700000000, 0)
+}
+
+// ParseJWKS rejects documents with keys that can't be decoded.
+func (s *JWTTest) TestParseJWKSWithInvalidKeys(c *C) {
+	_, err := ParseJWKS([]byte(`{"keys": [{"kty": "oct", "k": "!"}]}`))
+	c.Assert(err, ErrorMatches, "Invalid symmetric key.*")
+	_, err = ParseJWKS([]byte(`{"keys": [{"kty": "EC", "crv": "P-384"}]}`))
+	c.Assert(err, ErrorMatches, "Unsupported curve P-384.*")
+	_, err = ParseJWKS([]byte(`{"keys": [{"kty": "OKP"}]}`))
+	c.Assert(err, ErrorMatches, "Unsupported key type OKP")
+	_, err = LoadJWKS(filepath.Join(c.MkDir(), "missing.json"))
+	c.Assert(err, NotNil)
+}
+
+// Verify accepts tokens signed with HS256, RS256 and ES256 keys.
+func (s *JWTTest) TestVerify(c *C) {
+	for _, test := range []struct{ algorithm, keyID string }{
+		{"HS256", "hmac"}, {"RS256", "rsa"}, {"ES256", "ec"}, {"RS256", ""},
+	} {
+		token := signToken(test.algorithm, test.keyID, map[string]interface{}{
+			"sub": "jane", "scope": "read write"})
+		claims, err := s.keys.Verify(token, nil, s.now)
+		c.Assert(err, IsNil, Commentf("%s", test.algorithm))
+		c.Assert(claims.Subject(), Equals, "jane")
+		c.Assert(claims.Scopes(), DeepEquals, []string{"read", "write"})
+	}
+}
+
+// Verify rejects malformed tokens, tokens signed with unknown keys and
+// tokens whose algorithm doesn't match the key.
+func (s *JWTTest) TestVerifyRejectsInvalidSignatures(c *C) {
+	_, err := s.keys.Verify("not-a-token", nil, s.now)
+	c.Assert(err, ErrorMatches, "Malformed token")
+	token := signToken("RS256", "ec", map[string]interface{}{"sub": "jane"})
+	_, err = s.keys.Verify(token, nil, s.now)
+	c.Assert(err, ErrorMatches, "Invalid token signature")
+	token = signToken("none", "", map[string]interface{}{"sub": "jane"})
+	_, err = s.keys.Verify(token, nil, s.now)
+	c.Assert(err, ErrorMatches, "Invalid token signature")
+	token = signToken("HS256", "hmac", map[string]interface{}{"sub": "jane"})
+	_, err = s.keys.Verify(token[:len(token)-2]+"AA", nil, s.now)
+	c.Assert(err, ErrorMatches, "Invalid token signature")
+}
+
+// Verify checks the expiry, not-before, issuer and audience claims.
+func (s *JWTTest) TestVerifyValidatesClaims(c *C) {
+	validation := &JWTValidation{Issuer: "https://issuer", Audience: "api", Leeway: time.Minute}
+	claims := map[string]interface{}{
+		"iss": "https://issuer",
+		"aud": []string{"web", "api"},
+		"exp": s.now.Add(-30 * time.Second).Unix(),
+		"nbf": s.now.Add(30 * time.Second).Unix()}
+	_, err := s.keys.Verify(signToken("HS256", "hmac", claims), validation, s.now)
+	c.Assert(err, IsNil)
+
+	claims["exp"] = s.now.Add(-2 * time.Minute).Unix()
+	_, err = s.keys.Verify(signToken("HS256", "hmac", claims), validation, s.now)
+	c.Assert(err, ErrorMatches, "Token has expired")
+	claims["exp"] = s.now.Add(time.Hour).Unix()
+	claims["nbf"] = s.now.Add(2 * time.Minute).Unix()
+	_, err = s.keys.Verify(signToken("HS256", "hmac", claims), validation, s.now)
+	c.Assert(err, ErrorMatches, "Token is not valid yet")
+	delete(claims, "nbf")
+	claims["aud"] = "web"
+	_, err = s.keys.Verify(signToken("HS256", "hmac", claims), validation, s.now)
+	c.Assert(err, ErrorMatches, "Token has the wrong audience")
+	claims["iss"] = "https://other"
+	_, err = s.keys.Verify(signToken("HS256", "hmac", claims), validation, s.now)
+	c.Assert(err, ErrorMatches, "Token has the wrong issuer")
+}
@@ -0,0 +1,243 @@
+package switchboard
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// ThroughputGracePeriod is how long clients may take to send the first part
+// of a request body, or stall while sending it, before MinThroughput is
+// enforced.
+const ThroughputGracePeriod = 5 * time.Second
+
+var (
+	errBodyTooLarge = errors.New("Request body is too large")
+	errSlowClient   = errors.New("Request body was sent too slowly")
+)
+
+// RequestLimits protects backend services from oversized requests and from
+// clients that tie up connections by sending request bodies slowly.  Zero
+// values disable each limit.
+type RequestLimits struct {
+	// MaxBodySize is the largest request body, in bytes, proxied to a
+	// backend service.  Larger requests receive 413 Request Entity Too
+	// Large.
+	MaxBodySize int64
+
+	// MaxHeaderSize is the largest total size, in bytes, of the request's
+	// header names and values.  Larger requests receive 431 Request Header
+	// Fields Too Large.
+	MaxHeaderSize int
+
+	// ReadTimeout is the longest time clients may take to send the request
+	// body.  Slower requests receive 408 Request Timeout.
+	ReadTimeout time.Duration
+
+	// MinThroughput is the slowest average rate, in bytes per second,
+	// clients may send the request body at once ThroughputGracePeriod has
+	// passed.  Clients that stall for longer than the grace period are
+	// also too slow.  Slower requests receive 408 Request Timeout.
+	MinThroughput int64
+}
+
+// SetLimits configures request limits for every route.  A nil limits
+// removes them.
+func (mux *ExchangeServeMux) SetLimits(limits *RequestLimits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.limits = limits
+	return nil
+}
+
+// SetRouteLimits configures request limits for an HTTP method and URL
+// pattern, overriding the limits set with SetLimits.  A nil limits removes
+// the override.
+func (mux *ExchangeServeMux) SetRouteLimits(method, pattern string, limits *RequestLimits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.config(method, pattern).limits = limits
+	return nil
+}
+
+// Validate returns an error if a limit is negative.
+func (limits *RequestLimits) validate() error {
+	if limits == nil {
+		return nil
+	}
+	if limits.MaxBodySize < 0 || limits.MaxHeaderSize < 0 || limits.ReadTimeout < 0 ||
+		limits.MinThroughput < 0 {
+		return errors.New("Request limits must not be negative")
+	}
+	return nil
+}
+
+// Limit enforces the request limits for a matched route.  Requests whose
+// headers or body size exceed the limits are answered and false is returned.
+// Bodies of unknown length are read up to the size limit before the request
+// is proxied, so oversized bodies never reach the backend service.
+// Otherwise the request body is wrapped to enforce the remaining limits as
+// it's read, and the wrapper is returned so the caller can check whether it
+// failed.
+func (mux *ExchangeServeMux) limit(writer http.ResponseWriter, request *http.Request, route *Route) (*limitedBody, bool) {
+	mux.rw.RLock()
+	limits := mux.limits
+	if config, present := mux.configs[routeKey(route.Method, route.Pattern)]; present && config.limits != nil {
+		limits = config.limits
+	}
+	mux.rw.RUnlock()
+	if limits == nil {
+		return nil, true
+	}
+
+	if limits.MaxHeaderSize > 0 && headerSize(request.Header) > limits.MaxHeaderSize {
+		route.Refusal = errors.New("Request headers are too large")
+		writer.WriteHeader(http.StatusRequestHeaderFieldsTooLarge)
+		return nil, false
+	}
+	if limits.MaxBodySize > 0 && request.ContentLength > limits.MaxBodySize {
+		route.Refusal = errBodyTooLarge
+		writer.WriteHeader(http.StatusRequestEntityTooLarge)
+		return nil, false
+	}
+	if request.Body == nil || request.Body == http.NoBody {
+		return nil, true
+	}
+	body := &limitedBody{
+		ReadCloser: request.Body,
+		limits:     limits,
+		controller: http.NewResponseController(writer),
+		start:      time.Now()}
+	request.Body = body
+	if limits.MaxBodySize > 0 && request.ContentLength < 0 {
+		buffered, err := io.ReadAll(io.LimitReader(body, limits.MaxBodySize+1))
+		if failure := body.failure(); failure != nil {
+			route.Refusal = failure
+			writer.WriteHeader(body.status())
+			return nil, false
+		}
+		if err != nil {
+			route.Refusal = err
+			writer.WriteHeader(http.StatusBadRequest)
+			return nil, false
+		}
+		request.Body = readCloser{bytes.NewReader(buffered), body}
+		request.ContentLength = int64(len(buffered))
+	}
+	return body, true
+}
+
+// HeaderSize returns the total size of header's names and values.
+func headerSize(header http.Header) int {
+	size := 0
+	for name, values := range header {
+		for _, value := range values {
+			size += len(name) + len(value)
+		}
+	}
+	return size
+}
+
+// LimitedBody wraps a request body to enforce the size, timeout and
+// throughput limits as it's read.  Stalled reads are interrupted by setting
+// a read deadline on the client connection, where the server supports it.
+type limitedBody struct {
+	io.ReadCloser
+	limits     *RequestLimits
+	controller *http.ResponseController
+	start      time.Time
+	read       int64
+	mutex      sync.Mutex // Synchronize access to err.
+	err        error      // The limit that was exceeded, if any.
+}
+
+// Read reads data from the request body, failing if a limit is exceeded.
+func (body *limitedBody) Read(data []byte) (int, error) {
+	if err := body.failure(); err != nil {
+		return 0, err
+	}
+	if deadline, present := body.deadline(); present {
+		body.controller.SetReadDeadline(deadline)
+	}
+	n, err := body.ReadCloser.Read(data)
+	body.read += int64(n)
+	elapsed := time.Since(body.start)
+	var exceeded error
+	switch {
+	case body.limits.MaxBodySize > 0 && body.read > body.limits.MaxBodySize:
+		exceeded = errBodyTooLarge
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		exceeded = errSlowClient
+	case body.limits.ReadTimeout > 0 && elapsed > body.limits.ReadTimeout && err != io.EOF:
+		exceeded = errSlowClient
+	case body.limits.MinThroughput > 0 && elapsed > ThroughputGracePeriod && err != io.EOF &&
+		float64(body.read)/elapsed.Seconds() < float64(body.limits.MinThroughput):
+		exceeded = errSlowClient
+	}
+	if err == io.EOF && exceeded == nil {
+		// Clear the deadline so it doesn't interrupt the server's reads
+		// once the body has been consumed.
+		body.controller.SetReadDeadline(time.Time{})
+	}
+	if exceeded != nil {
+		// Expire the deadline so the server doesn't wait for the rest of
+		// the body before closing the connection.
+		body.controller.SetReadDeadline(time.Now())
+		body.mutex.Lock()
+		body.err = exceeded
+		body.mutex.Unlock()
+		return n, exceeded
+	}
+	return n, err
+}
+
+// Close closes the request body, clearing the read deadline if the body
+// stayed within its limits.
+func (body *limitedBody) Close() error {
+	if body.failure() == nil {
+		body.controller.SetReadDeadline(time.Time{})
+	}
+	return body.ReadCloser.Close()
+}
+
+// Failure returns the limit that was exceeded, or nil if the body is within
+// its limits.
+func (body *limitedBody) failure() error {
+	body.mutex.Lock()
+	defer body.mutex.Unlock()
+	return body.err
+}
+
+// Deadline returns the time the next read must finish by, if the limits
+// impose one.
+func (body *limitedBody) deadline() (time.Time, bool) {
+	var deadline time.Time
+	if body.limits.ReadTimeout > 0 {
+		deadline = body.start.Add(body.limits.ReadTimeout)
+	}
+	if body.limits.MinThroughput > 0 {
+		stall := time.Now().Add(ThroughputGracePeriod)
+		if deadline.IsZero() || stall.Before(deadline) {
+			deadline = stall
+		}
+	}
+	return deadline, !deadline.IsZero()
+}
+
+// Status returns the status code for the limit that was exceeded.
+func (body *limitedBody) status() int {
+	if body.failure() == errBodyTooLarge {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusRequestTimeout
+}
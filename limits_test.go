@@ -0,0 +1,147 @@
+package switchboard
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type LimitsTest struct {
+	mux      *ExchangeServeMux
+	server   *httptest.Server
+	requests int32
+}
+
+var _ = Suite(&LimitsTest{})
+
+func (s *LimitsTest) SetUpTest(c *C) {
+	s.requests = 0
+	s.server = httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			atomic.AddInt32(&s.requests, 1)
+			body, _ := io.ReadAll(request.Body)
+			writer.Write(body)
+		}))
+	s.mux = NewExchangeServeMux()
+	s.mux.Add("POST", "/upload", s.server.URL)
+	s.mux.Add("POST", "/avatar", s.server.URL)
+	c.Assert(s.mux.SetLimits(&RequestLimits{MaxBodySize: 10, MaxHeaderSize: 100}), IsNil)
+}
+
+func (s *LimitsTest) TearDownTest(c *C) {
+	s.server.Close()
+}
+
+// Post sends a request with body through the mux.  A negative contentLength
+// makes the body's length unknown, as with chunked uploads.
+func (s *LimitsTest) post(c *C, path, body string, contentLength int64) *httptest.ResponseRecorder {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("POST", "http://example.com"+path, strings.NewReader(body))
+	c.Assert(err, IsNil)
+	request.ContentLength = contentLength
+	s.mux.ServeHTTP(writer, request)
+	return writer
+}
+
+// Requests within the limits are proxied.
+func (s *LimitsTest) TestWithinLimits(c *C) {
+	writer := s.post(c, "/upload", "0123456789", 10)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(writer.Body.String(), Equals, "0123456789")
+	writer = s.post(c, "/upload", "0123456789", -1)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+}
+
+// Requests with bodies bigger than the limit receive 413 Request Entity Too
+// Large without reaching the backend service.
+func (s *LimitsTest) TestMaxBodySize(c *C) {
+	writer := s.post(c, "/upload", "01234567890", 11)
+	c.Assert(writer.Code, Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(0))
+
+	writer = s.post(c, "/upload", strings.Repeat("x", 100000), -1)
+	c.Assert(writer.Code, Equals, http.StatusRequestEntityTooLarge)
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(0))
+
+	// Routes can override the limits for every route.
+	c.Assert(s.mux.SetRouteLimits("POST", "/avatar", &RequestLimits{MaxBodySize: 20}), IsNil)
+	writer = s.post(c, "/avatar", "01234567890", 11)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(s.mux.SetRouteLimits("POST", "/avatar", &RequestLimits{MaxBodySize: -1}), ErrorMatches,
+		"Request limits must not be negative")
+}
+
+// Chunked requests with bodies bigger than the limit are refused before
+// they're proxied, so they never reach the backend service.
+func (s *LimitsTest) TestMaxBodySizeWithUnknownLength(c *C) {
+	exchange := httptest.NewServer(s.mux)
+	defer exchange.Close()
+	for i := 0; i < 20; i++ {
+		request, err := http.NewRequest("POST", exchange.URL+"/upload",
+			io.NopCloser(strings.NewReader(strings.Repeat("x", 100))))
+		c.Assert(err, IsNil)
+		c.Assert(request.ContentLength, Equals, int64(0))
+		response, err := http.DefaultClient.Do(request)
+		c.Assert(err, IsNil)
+		response.Body.Close()
+		c.Assert(response.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+	}
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(0))
+}
+
+// Requests with headers bigger than the limit receive 431 Request Header
+// Fields Too Large.
+func (s *LimitsTest) TestMaxHeaderSize(c *C) {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("POST", "http://example.com/upload", nil)
+	c.Assert(err, IsNil)
+	request.Header.Set("Cookie", strings.Repeat("x", 100))
+	s.mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusRequestHeaderFieldsTooLarge)
+	c.Assert(atomic.LoadInt32(&s.requests), Equals, int32(0))
+}
+
+// Clients that stall while sending the request body receive 408 Request
+// Timeout once the read timeout passes.
+func (s *LimitsTest) TestReadTimeout(c *C) {
+	c.Assert(s.mux.SetLimits(&RequestLimits{ReadTimeout: 100 * time.Millisecond}), IsNil)
+	exchange := httptest.NewServer(s.mux)
+	defer exchange.Close()
+	connection, err := net.Dial("tcp", exchange.Listener.Addr().String())
+	c.Assert(err, IsNil)
+	defer connection.Close()
+	_, err = io.WriteString(connection,
+		"POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: 100\r\n\r\n0123456789")
+	c.Assert(err, IsNil)
+
+	connection.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := http.ReadResponse(bufio.NewReader(connection), nil)
+	c.Assert(err, IsNil)
+	c.Assert(response.StatusCode, Equals, http.StatusRequestTimeout)
+}
+
+// Clients that send the request body slower than the minimum throughput,
+// once the grace period has passed, are too slow.
+func (s *LimitsTest) TestMinThroughput(c *C) {
+	body := &limitedBody{
+		ReadCloser: io.NopCloser(strings.NewReader("0123456789")),
+		limits:     &RequestLimits{MinThroughput: 1000},
+		controller: http.NewResponseController(httptest.NewRecorder()),
+		start:      time.Now()}
+	data := make([]byte, 5)
+	_, err := body.Read(data)
+	c.Assert(err, IsNil)
+	body.start = time.Now().Add(-2 * ThroughputGracePeriod)
+	_, err = body.Read(data)
+	c.Assert(err, Equals, errSlowClient)
+	c.Assert(body.status(), Equals, http.StatusRequestTimeout)
+	_, err = body.Read(data)
+	c.Assert(err, Equals, errSlowClient)
+}
@@ -0,0 +1,375 @@
+package switchboard
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram buckets.
+var LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Metrics collects request and routing statistics from an ExchangeServeMux
+// and an Exchange.  It's an http.Handler that serves the statistics in the
+// Prometheus text exposition format and is intended to be mounted on an
+// admin listener.
+type Metrics struct {
+	mutex           sync.Mutex                    // Synchronize access to counters.
+	mux             *ExchangeServeMux             // The mux to report route table size for.
+	requests        map[requestLabels]uint64      // Completed requests.
+	latencies       map[routeLabels]*histogram    // Request latencies.
+	inFlight        map[routeLabels]int64         // Requests currently being handled.
+	active          map[*Route]routeLabels        // Routes counted as in-flight.
+	backendErrors   map[backendErrorLabels]uint64 // Errors talking to backends.
+	registrations   uint64                        // Services registered by the exchange.
+	unregistrations uint64                        // Services unregistered by the exchange.
+	watchEvents     map[string]uint64             // Watch events keyed by etcd action.
+}
+
+// RouteLabels identify the pattern, logical service and backend service
+// address that handled a request.
+type routeLabels struct {
+	method  string
+	pattern string
+	service string
+	address string
+}
+
+// RequestLabels identify the route and status code of a completed request.
+type requestLabels struct {
+	routeLabels
+	code int
+}
+
+// BackendErrorLabels identify a backend service address and the kind of
+// error that occurred talking to it.
+type backendErrorLabels struct {
+	address string
+	kind    string
+}
+
+// NewMetrics creates a collector that reports the size of mux's route
+// table.  Install the collector's Middleware on mux to record requests.
+func NewMetrics(mux *ExchangeServeMux) *Metrics {
+	return &Metrics{
+		mux:           mux,
+		requests:      make(map[requestLabels]uint64),
+		latencies:     make(map[routeLabels]*histogram),
+		inFlight:      make(map[routeLabels]int64),
+		active:        make(map[*Route]routeLabels),
+		backendErrors: make(map[backendErrorLabels]uint64),
+		watchEvents:   make(map[string]uint64)}
+}
+
+// Middleware returns middleware that records request counts, latencies,
+// in-flight requests and backend errors.
+func (metrics *Metrics) Middleware() *Middleware {
+	return &Middleware{
+		PostMatch: func(writer http.ResponseWriter, request *http.Request, route *Route) bool {
+			metrics.mutex.Lock()
+			defer metrics.mutex.Unlock()
+			labels := labelsFor(route)
+			metrics.active[route] = labels
+			metrics.inFlight[labels]++
+			return true
+		},
+		Complete: func(request *http.Request, route *Route) {
+			labels := labelsFor(route)
+			elapsed := time.Since(route.Start).Seconds()
+
+			metrics.mutex.Lock()
+			defer metrics.mutex.Unlock()
+			if active, present := metrics.active[route]; present {
+				delete(metrics.active, route)
+				metrics.inFlight[active]--
+			}
+			metrics.requests[requestLabels{labels, route.Status}]++
+			latency, present := metrics.latencies[labels]
+			if !present {
+				latency = newHistogram(LatencyBuckets)
+				metrics.latencies[labels] = latency
+			}
+			latency.observe(elapsed)
+			if route.Err != nil {
+				metrics.backendErrors[backendErrorLabels{route.Address, errorKind(route.Err)}]++
+			}
+		}}
+}
+
+// Registered records that the exchange registered a service.
+func (metrics *Metrics) registered() {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.registrations++
+}
+
+// Unregistered records that the exchange unregistered a service.
+func (metrics *Metrics) unregistered() {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.unregistrations++
+}
+
+// Watched records an event received from etcd by the exchange.
+func (metrics *Metrics) watched(action string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	metrics.watchEvents[action]++
+}
+
+// ServeHTTP writes the collected metrics in the Prometheus text exposition
+// format.
+func (metrics *Metrics) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.WriteTo(writer)
+}
+
+// WriteTo writes the collected metrics in the Prometheus text exposition
+// format.
+func (metrics *Metrics) WriteTo(writer io.Writer) (int64, error) {
+	routes := make(map[string]uint64)
+	if metrics.mux != nil {
+		metrics.mux.rw.RLock()
+		for method, handlers := range metrics.mux.routes {
+			routes[method] = uint64(len(handlers))
+		}
+		metrics.mux.rw.RUnlock()
+	}
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	output := &metricsWriter{writer: writer}
+
+	output.header("switchboard_requests_total", "counter", "Requests handled by the exchange.")
+	for _, labels := range sortedRequestLabels(metrics.requests) {
+		output.sample("switchboard_requests_total",
+			labels.pairs("code", strconv.Itoa(labels.code)), float64(metrics.requests[labels]))
+	}
+
+	output.header("switchboard_request_duration_seconds", "histogram", "Time taken to handle requests.")
+	latencies := make([]routeLabels, 0, len(metrics.latencies))
+	for labels := range metrics.latencies {
+		latencies = append(latencies, labels)
+	}
+	for _, labels := range sortRouteLabels(latencies) {
+		latency := metrics.latencies[labels]
+		var cumulative uint64
+		for i, bound := range latency.bounds {
+			cumulative += latency.counts[i]
+			output.sample("switchboard_request_duration_seconds_bucket",
+				labels.pairs("le", formatFloat(bound)), float64(cumulative))
+		}
+		output.sample("switchboard_request_duration_seconds_bucket",
+			labels.pairs("le", "+Inf"), float64(latency.count))
+		output.sample("switchboard_request_duration_seconds_sum", labels.pairs(), latency.sum)
+		output.sample("switchboard_request_duration_seconds_count", labels.pairs(), float64(latency.count))
+	}
+
+	output.header("switchboard_requests_in_flight", "gauge", "Requests currently being proxied.")
+	inFlight := make([]routeLabels, 0, len(metrics.inFlight))
+	for labels := range metrics.inFlight {
+		inFlight = append(inFlight, labels)
+	}
+	for _, labels := range sortRouteLabels(inFlight) {
+		output.sample("switchboard_requests_in_flight", labels.pairs(), float64(metrics.inFlight[labels]))
+	}
+
+	output.header("switchboard_backend_errors_total", "counter", "Errors making requests to backend services.")
+	backendErrors := make([]backendErrorLabels, 0, len(metrics.backendErrors))
+	for labels := range metrics.backendErrors {
+		backendErrors = append(backendErrors, labels)
+	}
+	sort.Slice(backendErrors, func(i, j int) bool {
+		if backendErrors[i].address != backendErrors[j].address {
+			return backendErrors[i].address < backendErrors[j].address
+		}
+		return backendErrors[i].kind < backendErrors[j].kind
+	})
+	for _, labels := range backendErrors {
+		output.sample("switchboard_backend_errors_total",
+			[]string{"address", labels.address, "type", labels.kind},
+			float64(metrics.backendErrors[labels]))
+	}
+
+	output.header("switchboard_routes", "gauge", "Patterns in the route table.")
+	for _, method := range sortedKeys(routes) {
+		output.sample("switchboard_routes", []string{"method", method}, float64(routes[method]))
+	}
+
+	output.header("switchboard_exchange_registrations_total", "counter", "Services registered by the exchange.")
+	output.sample("switchboard_exchange_registrations_total", nil, float64(metrics.registrations))
+	output.header("switchboard_exchange_unregistrations_total", "counter", "Services unregistered by the exchange.")
+	output.sample("switchboard_exchange_unregistrations_total", nil, float64(metrics.unregistrations))
+	output.header("switchboard_exchange_watch_events_total", "counter", "Events received from etcd by the exchange.")
+	for _, action := range sortedKeys(metrics.watchEvents) {
+		output.sample("switchboard_exchange_watch_events_total",
+			[]string{"action", action}, float64(metrics.watchEvents[action]))
+	}
+	return output.written, output.err
+}
+
+// LabelsFor returns the labels that identify a route in metrics.
+func labelsFor(route *Route) routeLabels {
+	labels := routeLabels{method: route.Method, pattern: route.Pattern, address: route.Address}
+	if route.Service != nil {
+		labels.service = route.Service.LogicalName()
+	}
+	return labels
+}
+
+// Pairs returns the route labels as name/value pairs, followed by extra.
+func (labels routeLabels) pairs(extra ...string) []string {
+	pairs := []string{
+		"method", labels.method,
+		"pattern", labels.pattern,
+		"service", labels.service,
+		"address", labels.address}
+	return append(pairs, extra...)
+}
+
+// Less returns true if labels sort before other.
+func (labels routeLabels) less(other routeLabels) bool {
+	if labels.method != other.method {
+		return labels.method < other.method
+	}
+	if labels.pattern != other.pattern {
+		return labels.pattern < other.pattern
+	}
+	if labels.service != other.service {
+		return labels.service < other.service
+	}
+	return labels.address < other.address
+}
+
+// ErrorKind classifies an error returned by an HTTP client.
+func errorKind(err error) string {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection_refused"
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return "connection_reset"
+	}
+	return "other"
+}
+
+// Histogram counts observations in buckets with fixed upper bounds.
+type histogram struct {
+	bounds []float64 // Upper bounds of each bucket.
+	counts []uint64  // Observations in each bucket, not cumulative.
+	count  uint64    // Total observations.
+	sum    float64   // Sum of observations.
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds.
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+// Observe adds a value to the histogram.
+func (histogram *histogram) observe(value float64) {
+	histogram.count++
+	histogram.sum += value
+	for i, bound := range histogram.bounds {
+		if value <= bound {
+			histogram.counts[i]++
+			return
+		}
+	}
+}
+
+// MetricsWriter writes samples in the Prometheus text exposition format,
+// keeping track of the first error encountered.
+type metricsWriter struct {
+	writer  io.Writer
+	written int64
+	err     error
+}
+
+// Header writes the HELP and TYPE lines for a metric.
+func (output *metricsWriter) header(name, kind, help string) {
+	output.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Sample writes a single sample.  Labels are given as name/value pairs.
+func (output *metricsWriter) sample(name string, labels []string, value float64) {
+	if len(labels) == 0 {
+		output.printf("%s %s\n", name, formatFloat(value))
+		return
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i < len(labels); i += 2 {
+		pairs = append(pairs, labels[i]+`="`+escapeLabel(labels[i+1])+`"`)
+	}
+	output.printf("%s{%s} %s\n", name, strings.Join(pairs, ","), formatFloat(value))
+}
+
+// Printf formats and writes output unless an earlier write failed.
+func (output *metricsWriter) printf(format string, args ...interface{}) {
+	if output.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(output.writer, format, args...)
+	output.written += int64(n)
+	output.err = err
+}
+
+// LabelEscaper escapes label values as required by the text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// EscapeLabel escapes a label value.
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// FormatFloat formats a sample value or bucket bound.
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// SortRouteLabels sorts route labels in place and returns them.
+func sortRouteLabels(keys []routeLabels) []routeLabels {
+	sort.Slice(keys, func(i, j int) bool { return keys[i].less(keys[j]) })
+	return keys
+}
+
+// SortedRequestLabels returns the keys of a map keyed by request labels in a
+// stable order.
+func sortedRequestLabels(values map[requestLabels]uint64) []requestLabels {
+	keys := make([]requestLabels, 0, len(values))
+	for labels := range values {
+		keys = append(keys, labels)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].routeLabels != keys[j].routeLabels {
+			return keys[i].routeLabels.less(keys[j].routeLabels)
+		}
+		return keys[i].code < keys[j].code
+	})
+	return keys
+}
+
+// SortedKeys returns the keys of a map keyed by strings in sorted order.
+func sortedKeys(values map[string]uint64) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
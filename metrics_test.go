@@ -0,0 +1,165 @@
+package switchboard
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+
+	. "gopkg.in/check.v1"
+)
+
+type MetricsTest struct{}
+
+var _ = Suite(&MetricsTest{})
+
+// Metrics counts requests by pattern, address and status code and records
+// their latency.
+func (s *MetricsTest) TestRequests(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	mux := NewExchangeServeMux()
+	metrics := NewMetrics(mux)
+	mux.Use(metrics.Middleware())
+	mux.Add("GET", "/user/:id", server.URL)
+	for _, url := range []string{"http://example.com/user/1", "http://example.com/user/2", "http://example.com/unknown"} {
+		request, err := http.NewRequest("GET", url, nil)
+		c.Assert(err, IsNil)
+		mux.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	writer := httptest.NewRecorder()
+	metrics.ServeHTTP(writer, nil)
+	c.Assert(writer.Header().Get("Content-Type"), Equals, "text/plain; version=0.0.4; charset=utf-8")
+	output := writer.Body.String()
+	labels := `method="GET",pattern="/user/:id",service="",address="` + server.URL + `"`
+	c.Assert(strings.Contains(output, "switchboard_requests_total{"+labels+`,code="200"} 2`+"\n"), Equals, true)
+	c.Assert(strings.Contains(output, `switchboard_requests_total{method="GET",pattern="",service="",address="",code="404"} 1`+"\n"), Equals, true)
+	c.Assert(strings.Contains(output, "switchboard_request_duration_seconds_bucket{"+labels+`,le="+Inf"} 2`+"\n"), Equals, true)
+	c.Assert(strings.Contains(output, "switchboard_request_duration_seconds_count{"+labels+"} 2\n"), Equals, true)
+	c.Assert(strings.Contains(output, "switchboard_requests_in_flight{"+labels+"} 0\n"), Equals, true)
+	c.Assert(strings.Contains(output, `switchboard_routes{method="GET"} 1`+"\n"), Equals, true)
+}
+
+// Metrics counts errors making requests to backend services by type.
+func (s *MetricsTest) TestBackendErrors(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	address := server.URL
+	server.Close()
+
+	mux := NewExchangeServeMux()
+	metrics := NewMetrics(mux)
+	mux.Use(metrics.Middleware())
+	mux.Add("GET", "/resource", address)
+	request, err := http.NewRequest("GET", "http://example.com/resource", nil)
+	c.Assert(err, IsNil)
+	mux.ServeHTTP(httptest.NewRecorder(), request)
+
+	output := &bytes.Buffer{}
+	_, err = metrics.WriteTo(output)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(output.String(),
+		`switchboard_backend_errors_total{address="`+address+`",type="connection_refused"} 1`+"\n"), Equals, true)
+}
+
+// Requests the exchange answers itself, without contacting the backend
+// service, aren't counted as backend errors.
+func (s *MetricsTest) TestRefusals(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	mux := NewExchangeServeMux()
+	metrics := NewMetrics(mux)
+	mux.Use(metrics.Middleware())
+	mux.Add("GET", "/resource", server.URL)
+	c.Assert(mux.AddFault(&FaultRule{Name: "unavailable", Method: "GET", Pattern: "/resource",
+		Percent: 100, AbortStatus: http.StatusServiceUnavailable}), IsNil)
+	request, err := http.NewRequest("GET", "http://example.com/resource", nil)
+	c.Assert(err, IsNil)
+	mux.ServeHTTP(httptest.NewRecorder(), request)
+
+	output := &bytes.Buffer{}
+	_, err = metrics.WriteTo(output)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(output.String(), "switchboard_backend_errors_total{"), Equals, false)
+	c.Assert(strings.Contains(output.String(), `code="503"} 1`+"\n"), Equals, true)
+}
+
+// Metrics counts exchange registrations, unregistrations and watch events.
+func (s *MetricsTest) TestExchangeEvents(c *C) {
+	metrics := NewMetrics(nil)
+	metrics.registered()
+	metrics.registered()
+	metrics.unregistered()
+	metrics.watched("set")
+	metrics.watched("delete")
+	metrics.watched("set")
+
+	output := &bytes.Buffer{}
+	_, err := metrics.WriteTo(output)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(output.String(), "switchboard_exchange_registrations_total 2\n"), Equals, true)
+	c.Assert(strings.Contains(output.String(), "switchboard_exchange_unregistrations_total 1\n"), Equals, true)
+	c.Assert(strings.Contains(output.String(), `switchboard_exchange_watch_events_total{action="set"} 2`+"\n"), Equals, true)
+}
+
+// Exchanges count a service's registration once, however often its
+// heartbeat re-registers it, and count its unregistration once.
+func (s *MetricsTest) TestExchangeRegistrations(c *C) {
+	exchange := NewExchange("test", nil, NewExchangeServeMux())
+	metrics := NewMetrics(nil)
+	exchange.SetMetrics(metrics)
+	service := &ServiceRecord{ID: "users-1", Name: "users", Address: "http://localhost:8081",
+		Routes: Routes{"GET": []string{"/user/:id"}}}
+	c.Assert(exchange.Register(service), IsNil)
+	c.Assert(exchange.Register(service), IsNil)
+	c.Assert(exchange.Register(service), IsNil)
+	exchange.Unregister(service)
+	exchange.Unregister(service)
+
+	output := &bytes.Buffer{}
+	_, err := metrics.WriteTo(output)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(output.String(), "switchboard_exchange_registrations_total 1\n"), Equals, true)
+	c.Assert(strings.Contains(output.String(), "switchboard_exchange_unregistrations_total 1\n"), Equals, true)
+}
+
+// ErrorKind classifies errors returned by the HTTP client.
+func (s *MetricsTest) TestErrorKind(c *C) {
+	c.Assert(errorKind(syscall.ECONNREFUSED), Equals, "connection_refused")
+	c.Assert(errorKind(syscall.ECONNRESET), Equals, "connection_reset")
+	c.Assert(errorKind(errors.New("boom")), Equals, "other")
+}
+
+// Label values are escaped in the text format.
+func (s *MetricsTest) TestEscapeLabel(c *C) {
+	c.Assert(escapeLabel("a\"b\\c\nd"), Equals, `a\"b\\c\nd`)
+}
+
+// Metrics labels requests with the logical service that handled them.
+func (s *MetricsTest) TestServiceLabel(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	mux := NewExchangeServeMux()
+	metrics := NewMetrics(mux)
+	mux.Use(metrics.Middleware())
+	mux.AddService(&ServiceRecord{
+		ID:      "instance-1",
+		Name:    "users",
+		Address: server.URL,
+		Routes:  Routes{"GET": []string{"/users"}}})
+	request, err := http.NewRequest("GET", "http://example.com/users", nil)
+	c.Assert(err, IsNil)
+	mux.ServeHTTP(httptest.NewRecorder(), request)
+
+	output := &bytes.Buffer{}
+	_, err = metrics.WriteTo(output)
+	c.Assert(err, IsNil)
+	c.Assert(strings.Contains(output.String(), `switchboard_requests_total{method="GET",pattern="/users",service="users",address="`+server.URL+`",code="200"} 1`+"\n"), Equals, true)
+}
@@ -0,0 +1,140 @@
+package switchboard
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Route describes how an ExchangeServeMux routes a single request.  It's
+// created when a request arrives and filled in as the request moves through
+// ServeHTTP, so hooks in later stages can see decisions made in earlier ones.
+type Route struct {
+	Method    string         // The HTTP method of the request.
+	Path      string         // The URL path of the request.
+	RequestID string         // The ID used to correlate the request.
+	Pattern   string         // The pattern that matched the request.
+	Params    url.Values     // Values captured by placeholders in Pattern.
+	Address   string         // The address of the selected backend service.
+	Service   *ServiceRecord // The selected service, if its record is known.
+	Target    string         // The escaped URL path sent to the backend service.
+	Start     time.Time      // The time the request arrived.
+	Status    int            // The status code written to the client.
+	BytesIn   int64          // The number of request body bytes read.
+	BytesOut  int64          // The number of response body bytes written.
+	Upstream  time.Duration  // The time the backend took to respond.
+	Retries   int            // Additional backend requests made.
+	Cache     string         // "hit" or "revalidated" if the response came from the cache.
+	Coalesced bool           // True if the response was shared with an identical request.
+	Fault     string         // The name of the fault rule injected into the request.
+	Static    bool           // True if the route's static response was sent.
+	Err       error          // The error that occurred talking to the backend.
+	Refusal   error          // Why the exchange answered the request itself rather than proxying it.
+	Span      *Span          // The trace span for the request, if it's traced.
+	Principal *Principal     // The authenticated client, if there is one.
+
+	// Auth is the requirement the route's services declare for it, or nil
+	// if no registered address has a service record.
+	Auth *AuthRequirement
+}
+
+// Middleware hooks into the stages of ExchangeServeMux.ServeHTTP.  Every
+// hook is optional.  A hook returns false to stop processing the request, in
+// which case it's responsible for writing a response to the client.
+type Middleware struct {
+	// PreMatch is called before the request is matched against registered
+	// patterns.  Only the route's method, path and request ID are set.
+	PreMatch func(writer http.ResponseWriter, request *http.Request, route *Route) bool
+
+	// PostMatch is called after a pattern has matched the request and a
+	// backend service has been selected to handle it.
+	PostMatch func(writer http.ResponseWriter, request *http.Request, route *Route) bool
+
+	// PreProxy is called with the outbound request before it's sent to the
+	// backend service.  Changes made to outbound are sent to the backend.
+	// It isn't called for requests mirrored to shadow services.
+	PreProxy func(writer http.ResponseWriter, request *http.Request, outbound *http.Request, route *Route) bool
+
+	// PostProxy is called with the response from the backend service before
+	// it's relayed to the client.  Changes made to response are relayed.
+	PostProxy func(writer http.ResponseWriter, request *http.Request, response *http.Response, route *Route) bool
+
+	// Complete is called after a response has been written to the client,
+	// whether the request was proxied, stopped by a hook or failed.
+	Complete func(request *http.Request, route *Route)
+}
+
+// Use installs middleware that runs for every request.
+func (mux *ExchangeServeMux) Use(middleware *Middleware) {
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.middleware = append(mux.middleware, middleware)
+}
+
+// UseService installs middleware that runs for requests routed to a
+// service.  name is either the name of a logical service, which applies the
+// middleware to every instance, or the ID of a single instance.  It runs
+// after middleware installed with Use.
+func (mux *ExchangeServeMux) UseService(name string, middleware *Middleware) {
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.serviceMiddleware[name] = append(mux.serviceMiddleware[name], middleware)
+}
+
+// UseRoute installs middleware that runs for requests matched by an HTTP
+// method and URL pattern.  It runs after middleware installed with Use and
+// UseService.
+func (mux *ExchangeServeMux) UseRoute(method, pattern string, middleware *Middleware) {
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	config := mux.config(method, pattern)
+	config.middleware = append(config.middleware, middleware)
+}
+
+// Stack returns the middleware that applies to a route, in the order it
+// should run.  The caller must hold the read lock.
+func (mux *ExchangeServeMux) stack(route *Route) []*Middleware {
+	stack := make([]*Middleware, 0, len(mux.middleware))
+	stack = append(stack, mux.middleware...)
+	if route.Service != nil {
+		if route.Service.Name != "" {
+			stack = append(stack, mux.serviceMiddleware[route.Service.Name]...)
+		}
+		stack = append(stack, mux.serviceMiddleware[route.Service.ID]...)
+	}
+	if config, present := mux.configs[routeKey(route.Method, route.Pattern)]; present {
+		stack = append(stack, config.middleware...)
+	}
+	return stack
+}
+
+// RouteConfig holds options that apply to a single HTTP method and URL
+// pattern.  It outlives the pattern handler, so options survive services
+// coming and going.
+type routeConfig struct {
+	middleware []*Middleware
+	mirror     *mirror
+	cors       *CORSConfig
+	cache      *CacheConfig
+	coalesce   *CoalesceConfig
+	limits     *RequestLimits
+	hedge      *hedger
+}
+
+// Config returns the options for an HTTP method and URL pattern, creating
+// them if necessary.  The caller must hold the write lock.
+func (mux *ExchangeServeMux) config(method, pattern string) *routeConfig {
+	key := routeKey(method, pattern)
+	config, present := mux.configs[key]
+	if !present {
+		config = &routeConfig{}
+		mux.configs[key] = config
+	}
+	return config
+}
+
+// RouteKey returns the key used to store options for an HTTP method and URL
+// pattern.
+func routeKey(method, pattern string) string {
+	return method + " " + pattern
+}
@@ -0,0 +1,162 @@
+package switchboard
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+type MiddlewareTest struct{}
+
+var _ = Suite(&MiddlewareTest{})
+
+// Middleware hooks run in stage order and receive the route as it's filled in
+// by ServeHTTP.
+func (s *MiddlewareTest) TestStages(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Outbound", r.Header.Get("X-Outbound"))
+		fmt.Fprintln(w, "Hello, world!")
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://example.com/resource/1", nil)
+	c.Assert(err, IsNil)
+
+	stages := []string{}
+	mux := NewExchangeServeMux()
+	mux.Add("GET", "/resource/:id", server.URL)
+	mux.Use(&Middleware{
+		PreMatch: func(w http.ResponseWriter, r *http.Request, route *Route) bool {
+			c.Assert(route.Pattern, Equals, "")
+			c.Assert(route.RequestID, Not(Equals), "")
+			stages = append(stages, "pre-match")
+			return true
+		},
+		PostMatch: func(w http.ResponseWriter, r *http.Request, route *Route) bool {
+			c.Assert(route.Pattern, Equals, "/resource/:id")
+			c.Assert(route.Address, Equals, server.URL)
+			stages = append(stages, "post-match")
+			return true
+		},
+		PreProxy: func(w http.ResponseWriter, r *http.Request, outbound *http.Request, route *Route) bool {
+			outbound.Header.Set("X-Outbound", "yes")
+			stages = append(stages, "pre-proxy")
+			return true
+		},
+		PostProxy: func(w http.ResponseWriter, r *http.Request, response *http.Response, route *Route) bool {
+			response.Header.Set("X-Rewritten", "yes")
+			stages = append(stages, "post-proxy")
+			return true
+		}})
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(writer.Header().Get("X-Outbound"), Equals, "yes")
+	c.Assert(writer.Header().Get("X-Rewritten"), Equals, "yes")
+	c.Assert(stages, DeepEquals, []string{"pre-match", "post-match", "pre-proxy", "post-proxy"})
+}
+
+// A hook that returns false stops the request before it reaches the backend.
+func (s *MiddlewareTest) TestHalt(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c.Fatal("Request should not reach the backend")
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://example.com/resource", nil)
+	c.Assert(err, IsNil)
+
+	mux := NewExchangeServeMux()
+	mux.Add("GET", "/resource", server.URL)
+	mux.Use(&Middleware{
+		PostMatch: func(w http.ResponseWriter, r *http.Request, route *Route) bool {
+			w.WriteHeader(http.StatusUnauthorized)
+			return false
+		}})
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusUnauthorized)
+}
+
+// Middleware installed with UseService and UseRoute only runs for matching
+// requests, after global middleware.
+func (s *MiddlewareTest) TestScopedMiddleware(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	calls := []string{}
+	record := func(name string) *Middleware {
+		return &Middleware{
+			PostMatch: func(w http.ResponseWriter, r *http.Request, route *Route) bool {
+				calls = append(calls, name)
+				return true
+			}}
+	}
+	mux := NewExchangeServeMux()
+	mux.AddService(&ServiceRecord{
+		ID:      "users",
+		Address: server.URL,
+		Routes:  Routes{"GET": []string{"/users", "/user/:id"}}})
+	mux.UseRoute("GET", "/user/:id", record("route"))
+	mux.UseService("users", record("service"))
+	mux.UseService("other", record("other"))
+	mux.Use(record("global"))
+
+	request, err := http.NewRequest("GET", "http://example.com/users", nil)
+	c.Assert(err, IsNil)
+	mux.ServeHTTP(httptest.NewRecorder(), request)
+	c.Assert(calls, DeepEquals, []string{"global", "service"})
+
+	calls = []string{}
+	request, err = http.NewRequest("GET", "http://example.com/user/1", nil)
+	c.Assert(err, IsNil)
+	mux.ServeHTTP(httptest.NewRecorder(), request)
+	c.Assert(calls, DeepEquals, []string{"global", "service", "route"})
+}
+
+// RemoveService unregisters the routes and record of a service.
+func (s *MiddlewareTest) TestRemoveService(c *C) {
+	service := &ServiceRecord{
+		ID:      "users",
+		Address: "http://localhost:8080",
+		Routes:  Routes{"GET": []string{"/users"}}}
+	mux := NewExchangeServeMux()
+	mux.AddService(service)
+	c.Assert(mux.services["http://localhost:8080"], Equals, service)
+	mux.RemoveService(service)
+	_, err := mux.Match("GET", "/users")
+	c.Assert(err, NotNil)
+	c.Assert(len(mux.services), Equals, 0)
+}
+
+// Middleware installed with UseService for a logical service name runs for
+// every instance of the service.
+func (s *MiddlewareTest) TestServiceNameMiddleware(c *C) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var route *Route
+	mux := NewExchangeServeMux()
+	mux.AddService(&ServiceRecord{
+		ID:      "instance-1",
+		Name:    "users",
+		Version: "2.0",
+		Address: server.URL,
+		Routes:  Routes{"GET": []string{"/users"}}})
+	mux.UseService("users", &Middleware{
+		PostMatch: func(w http.ResponseWriter, r *http.Request, matched *Route) bool {
+			route = matched
+			return true
+		}})
+
+	request, err := http.NewRequest("GET", "http://example.com/users", nil)
+	c.Assert(err, IsNil)
+	mux.ServeHTTP(httptest.NewRecorder(), request)
+	c.Assert(route, NotNil)
+	c.Assert(route.Service.LogicalName(), Equals, "users")
+	c.Assert(route.Service.Version, Equals, "2.0")
+}
@@ -0,0 +1,335 @@
+package switchboard
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ShadowHeader is set on requests mirrored to a shadow service, so the
+// shadow can tell them apart from real traffic.
+const ShadowHeader = "X-Switchboard-Shadow"
+
+// DefaultMirrorConcurrency is the number of shadow requests allowed in
+// flight for a route when MirrorConfig.MaxConcurrent isn't set.
+const DefaultMirrorConcurrency = 16
+
+// DefaultMirrorTimeout is the time allowed for a shadow request when
+// MirrorConfig.Timeout isn't set.
+const DefaultMirrorTimeout = 10 * time.Second
+
+// DefaultMirrorBodySize is the largest request body, in bytes, mirrored
+// when MirrorConfig.MaxBodySize isn't set.
+const DefaultMirrorBodySize = 1 << 20
+
+// MirrorConfig describes how requests for a route are mirrored to a shadow
+// service.  Shadow requests are made in the background and their responses
+// are discarded, so they never affect the response sent to the client.
+// They don't pass through middleware PreProxy functions, so they don't
+// carry the headers those add, such as authentication claims and trace
+// context.
+type MirrorConfig struct {
+	// Service is the logical name of the shadow service.  Requests are sent
+	// to a random address registered by an instance of the service.
+	Service string
+
+	// Percent is the percentage of requests to mirror, from 0 to 100.
+	Percent float64
+
+	// MaxConcurrent bounds the number of shadow requests in flight.
+	// Requests that would exceed it aren't mirrored.
+	MaxConcurrent int
+
+	// Timeout bounds the time a shadow request may take.
+	Timeout time.Duration
+
+	// MaxBodySize bounds the size of request bodies, which are buffered to
+	// be sent to both services.  Requests with larger bodies, or bodies of
+	// unknown length, aren't mirrored.
+	MaxBodySize int64
+
+	// ForwardCredentials, if true, sends the client's credentials to the
+	// shadow service.  By default the headers in CredentialHeaders and the
+	// client's cookies are removed from shadow requests.
+	ForwardCredentials bool
+
+	// CredentialHeaders lists the request headers that carry client
+	// credentials.  DefaultCredentialHeaders is used if it's nil.
+	CredentialHeaders []string
+
+	// Compare, if set, is called with the outcome of each mirrored request
+	// once both the primary and shadow requests have finished.
+	Compare func(result *MirrorResult)
+}
+
+// MirrorResult compares the primary and shadow responses to a mirrored
+// request.
+type MirrorResult struct {
+	Method         string
+	Pattern        string
+	RequestID      string
+	ShadowAddress  string
+	PrimaryStatus  int
+	ShadowStatus   int
+	PrimaryLatency time.Duration
+	ShadowLatency  time.Duration
+	Err            error // The error that occurred talking to the shadow.
+}
+
+// MirrorStats counts the outcomes of mirroring for a route.
+type MirrorStats struct {
+	Sent             uint64  `json:"sent"`              // Shadow requests made.
+	Dropped          uint64  `json:"dropped"`           // Requests selected but not mirrored.
+	Failed           uint64  `json:"failed"`            // Shadow requests that failed.
+	StatusMismatches uint64  `json:"status_mismatches"` // Shadow status differed from primary.
+	LatencyDelta     float64 `json:"latency_delta_ms"`  // Total shadow minus primary latency.
+}
+
+// MirrorState describes a mirrored route.
+type MirrorState struct {
+	Method        string      `json:"method"`
+	Pattern       string      `json:"pattern"`
+	Service       string      `json:"service"`
+	Percent       float64     `json:"percent"`
+	MaxConcurrent int         `json:"max_concurrent"`
+	MaxBodySize   int64       `json:"max_body_size"`
+	Stats         MirrorStats `json:"stats"`
+}
+
+// Mirror holds the configuration and running state for a mirrored route.
+type mirror struct {
+	method    string
+	pattern   string
+	config    MirrorConfig
+	client    *http.Client
+	semaphore chan bool
+	mutex     sync.Mutex // Synchronize access to stats.
+	stats     MirrorStats
+}
+
+// Shadow is a request being mirrored to a shadow service.
+type shadow struct {
+	mirror  *mirror
+	result  *MirrorResult
+	primary chan Route
+}
+
+// Mirror duplicates a percentage of the requests that match an HTTP method
+// and URL pattern to a shadow service, replacing any existing mirror for the
+// route.
+func (mux *ExchangeServeMux) Mirror(method, pattern string, config *MirrorConfig) error {
+	if config.Service == "" {
+		return errors.New("Mirror has no shadow service")
+	}
+	if config.Percent < 0 || config.Percent > 100 {
+		return errors.New("Mirror percent must be between 0 and 100")
+	}
+	if config.MaxConcurrent < 0 || config.Timeout < 0 || config.MaxBodySize < 0 {
+		return errors.New("Mirror limits must not be negative")
+	}
+	m := &mirror{method: method, pattern: pattern, config: *config}
+	if m.config.MaxConcurrent == 0 {
+		m.config.MaxConcurrent = DefaultMirrorConcurrency
+	}
+	if m.config.Timeout == 0 {
+		m.config.Timeout = DefaultMirrorTimeout
+	}
+	if m.config.MaxBodySize == 0 {
+		m.config.MaxBodySize = DefaultMirrorBodySize
+	}
+	if m.config.CredentialHeaders == nil {
+		m.config.CredentialHeaders = DefaultCredentialHeaders
+	}
+	m.client = &http.Client{Timeout: m.config.Timeout}
+	m.semaphore = make(chan bool, m.config.MaxConcurrent)
+
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.config(method, pattern).mirror = m
+	return nil
+}
+
+// RemoveMirror stops mirroring requests for an HTTP method and URL pattern.
+// Shadow requests already in flight are allowed to finish.
+func (mux *ExchangeServeMux) RemoveMirror(method, pattern string) {
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	if config, present := mux.configs[routeKey(method, pattern)]; present {
+		config.mirror = nil
+	}
+}
+
+// Mirrors returns the mirrored routes, sorted by method and pattern.
+func (mux *ExchangeServeMux) Mirrors() []MirrorState {
+	mux.rw.RLock()
+	defer mux.rw.RUnlock()
+	keys := make([]string, 0)
+	for key, config := range mux.configs {
+		if config.mirror != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	states := make([]MirrorState, 0, len(keys))
+	for _, key := range keys {
+		m := mux.configs[key].mirror
+		m.mutex.Lock()
+		stats := m.stats
+		m.mutex.Unlock()
+		states = append(states, MirrorState{
+			Method:        m.method,
+			Pattern:       m.pattern,
+			Service:       m.config.Service,
+			Percent:       m.config.Percent,
+			MaxConcurrent: m.config.MaxConcurrent,
+			MaxBodySize:   m.config.MaxBodySize,
+			Stats:         stats})
+	}
+	return states
+}
+
+// Shadow decides whether to mirror a matched request and, if so, starts a
+// shadow request in the background.  The request body is buffered so it can
+// be sent to both services, so requests with bodies that are too large or of
+// unknown length aren't mirrored.  The returned shadow must be completed with the
+// primary route once the client has been sent a response.  Nil is returned
+// if the request isn't mirrored.
+func (mux *ExchangeServeMux) shadow(route *Route, request *http.Request) *shadow {
+	mux.rw.RLock()
+	config, present := mux.configs[routeKey(route.Method, route.Pattern)]
+	if !present || config.mirror == nil {
+		mux.rw.RUnlock()
+		return nil
+	}
+	m := config.mirror
+	if rand.Float64()*100 >= m.config.Percent {
+		mux.rw.RUnlock()
+		return nil
+	}
+	addresses := make([]string, 0)
+	for address, service := range mux.services {
+		if service.LogicalName() == m.config.Service {
+			addresses = append(addresses, address)
+		}
+	}
+	var service *ServiceRecord
+	if len(addresses) > 0 {
+		service = mux.services[addresses[rand.Intn(len(addresses))]]
+	}
+	mux.rw.RUnlock()
+
+	hasBody := request.Body != nil && request.Body != http.NoBody
+	if service == nil || (hasBody && (request.ContentLength < 0 || request.ContentLength > m.config.MaxBodySize)) {
+		m.record(func(stats *MirrorStats) { stats.Dropped++ })
+		return nil
+	}
+	select {
+	case m.semaphore <- true:
+	default:
+		m.record(func(stats *MirrorStats) { stats.Dropped++ })
+		return nil
+	}
+
+	var body []byte
+	if hasBody {
+		var err error
+		body, err = io.ReadAll(request.Body)
+		request.Body.Close()
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return m.abandon()
+		}
+	}
+
+	s := &shadow{
+		mirror:  m,
+		primary: make(chan Route, 1),
+		result: &MirrorResult{
+			Method:        route.Method,
+			Pattern:       route.Pattern,
+			RequestID:     route.RequestID,
+			ShadowAddress: service.Address}}
+	target, err := backendURL(service.Address,
+		service.RewritePath(request.URL.EscapedPath()), request.URL.RawQuery)
+	if err != nil {
+		return m.abandon()
+	}
+	shadowRequest, err := http.NewRequest(request.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return m.abandon()
+	}
+	copyHeader(shadowRequest, request, route)
+	if !m.config.ForwardCredentials {
+		for _, header := range m.config.CredentialHeaders {
+			shadowRequest.Header.Del(header)
+		}
+		shadowRequest.Header.Del("Cookie")
+	}
+	shadowRequest.Header.Set(ShadowHeader, "true")
+	if err := mux.sign(shadowRequest); err != nil {
+		return m.abandon()
+	}
+	go s.send(shadowRequest)
+	return s
+}
+
+// Send makes the shadow request, discarding the response, and waits for the
+// primary request to finish before recording the outcome.  The concurrency
+// slot is released as soon as the shadow response has been read.
+func (s *shadow) send(request *http.Request) {
+	start := time.Now()
+	response, err := s.mirror.client.Do(request)
+	s.result.ShadowLatency = time.Since(start)
+	if err != nil {
+		s.result.Err = err
+	} else {
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+		s.result.ShadowStatus = response.StatusCode
+	}
+	<-s.mirror.semaphore
+
+	primary := <-s.primary
+	s.result.PrimaryStatus = primary.Status
+	s.result.PrimaryLatency = primary.Upstream
+	s.mirror.record(func(stats *MirrorStats) {
+		stats.Sent++
+		if s.result.Err != nil {
+			stats.Failed++
+			return
+		}
+		if s.result.ShadowStatus != s.result.PrimaryStatus {
+			stats.StatusMismatches++
+		}
+		stats.LatencyDelta += milliseconds(s.result.ShadowLatency - s.result.PrimaryLatency)
+	})
+	if s.mirror.config.Compare != nil {
+		s.mirror.config.Compare(s.result)
+	}
+}
+
+// Complete hands a copy of the primary route to the shadow.
+func (s *shadow) complete(route *Route) {
+	s.primary <- *route
+}
+
+// Abandon releases the concurrency slot acquired for a shadow request that
+// won't be sent and counts it as dropped.
+func (m *mirror) abandon() *shadow {
+	<-m.semaphore
+	m.record(func(stats *MirrorStats) { stats.Dropped++ })
+	return nil
+}
+
+// Record updates the mirror's stats.
+func (m *mirror) record(update func(stats *MirrorStats)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	update(&m.stats)
+}
@@ -0,0 +1,281 @@
+package switchboard
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type MirrorTest struct {
+	mux     *ExchangeServeMux
+	primary *httptest.Server
+	shadow  *httptest.Server
+	bodies  chan string
+	headers chan http.Header
+	results chan *MirrorResult
+}
+
+var _ = Suite(&MirrorTest{})
+
+func (s *MirrorTest) SetUpTest(c *C) {
+	s.bodies = make(chan string, 100)
+	s.headers = make(chan http.Header, 100)
+	s.results = make(chan *MirrorResult, 100)
+	s.primary = httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			body, _ := io.ReadAll(request.Body)
+			writer.WriteHeader(http.StatusCreated)
+			writer.Write(append([]byte("primary "), body...))
+		}))
+	s.shadow = httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			body, _ := io.ReadAll(request.Body)
+			s.bodies <- string(body)
+			s.headers <- request.Header
+			writer.WriteHeader(http.StatusInternalServerError)
+			writer.Write([]byte("shadow"))
+		}))
+	s.mux = NewExchangeServeMux()
+	s.mux.AddService(&ServiceRecord{
+		ID:      "users",
+		Address: s.primary.URL,
+		Routes:  Routes{"POST": []string{"/users"}}})
+	s.mux.AddService(&ServiceRecord{
+		ID:      "users-rewrite",
+		Name:    "users-rewrite",
+		Address: s.shadow.URL})
+}
+
+func (s *MirrorTest) TearDownTest(c *C) {
+	s.primary.Close()
+	s.shadow.Close()
+}
+
+// Post sends a request for POST /users through the mux.
+func (s *MirrorTest) post(c *C, body string) *httptest.ResponseRecorder {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("POST", "http://example.com/users?q=1", strings.NewReader(body))
+	c.Assert(err, IsNil)
+	request.Header.Set("X-Custom", "value")
+	s.mux.ServeHTTP(writer, request)
+	return writer
+}
+
+// Result waits for the outcome of a mirrored request.
+func (s *MirrorTest) result(c *C) *MirrorResult {
+	select {
+	case result := <-s.results:
+		return result
+	case <-time.After(time.Second):
+		c.Fatal("Timed out waiting for mirrored request")
+	}
+	return nil
+}
+
+// Mirror rejects configurations without a shadow service or with invalid
+// percentages or limits.
+func (s *MirrorTest) TestMirrorValidatesConfig(c *C) {
+	err := s.mux.Mirror("POST", "/users", &MirrorConfig{Percent: 100})
+	c.Assert(err, ErrorMatches, "Mirror has no shadow service")
+	err = s.mux.Mirror("POST", "/users", &MirrorConfig{Service: "users-rewrite", Percent: 101})
+	c.Assert(err, ErrorMatches, "Mirror percent must be between 0 and 100")
+	err = s.mux.Mirror("POST", "/users", &MirrorConfig{Service: "users-rewrite", MaxConcurrent: -1})
+	c.Assert(err, ErrorMatches, "Mirror limits must not be negative")
+	err = s.mux.Mirror("POST", "/users", &MirrorConfig{Service: "users-rewrite", MaxBodySize: -1})
+	c.Assert(err, ErrorMatches, "Mirror limits must not be negative")
+	c.Assert(s.mux.Mirrors(), HasLen, 0)
+}
+
+// Mirrored requests are sent to the shadow service with the same body and
+// headers, while the client receives the primary response.  Differences
+// between the responses are reported and counted.
+func (s *MirrorTest) TestMirror(c *C) {
+	err := s.mux.Mirror("POST", "/users", &MirrorConfig{
+		Service: "users-rewrite",
+		Percent: 100,
+		Compare: func(result *MirrorResult) { s.results <- result }})
+	c.Assert(err, IsNil)
+
+	writer := s.post(c, "jane")
+	c.Assert(writer.Code, Equals, http.StatusCreated)
+	c.Assert(writer.Body.String(), Equals, "primary jane")
+
+	result := s.result(c)
+	c.Assert(<-s.bodies, Equals, "jane")
+	headers := <-s.headers
+	c.Assert(headers.Get("X-Custom"), Equals, "value")
+	c.Assert(headers.Get(ShadowHeader), Equals, "true")
+	c.Assert(headers.Get(RequestIDHeader), Equals, writer.Header().Get(RequestIDHeader))
+	c.Assert(result.Method, Equals, "POST")
+	c.Assert(result.Pattern, Equals, "/users")
+	c.Assert(result.ShadowAddress, Equals, s.shadow.URL)
+	c.Assert(result.PrimaryStatus, Equals, http.StatusCreated)
+	c.Assert(result.ShadowStatus, Equals, http.StatusInternalServerError)
+	c.Assert(result.Err, IsNil)
+
+	mirrors := s.mux.Mirrors()
+	c.Assert(mirrors, HasLen, 1)
+	c.Assert(mirrors[0].Service, Equals, "users-rewrite")
+	c.Assert(mirrors[0].MaxConcurrent, Equals, DefaultMirrorConcurrency)
+	c.Assert(mirrors[0].MaxBodySize, Equals, int64(DefaultMirrorBodySize))
+	c.Assert(mirrors[0].Stats.Sent, Equals, uint64(1))
+	c.Assert(mirrors[0].Stats.StatusMismatches, Equals, uint64(1))
+}
+
+// Requests aren't mirrored when the percentage is zero or the mirror has
+// been removed.
+func (s *MirrorTest) TestMirrorPercent(c *C) {
+	err := s.mux.Mirror("POST", "/users", &MirrorConfig{Service: "users-rewrite", Percent: 0})
+	c.Assert(err, IsNil)
+	for i := 0; i < 20; i++ {
+		c.Assert(s.post(c, "jane").Code, Equals, http.StatusCreated)
+	}
+	c.Assert(s.mux.Mirrors()[0].Stats, DeepEquals, MirrorStats{})
+
+	s.mux.RemoveMirror("POST", "/users")
+	c.Assert(s.mux.Mirrors(), HasLen, 0)
+}
+
+// Requests selected for mirroring are dropped when the shadow service has
+// no registered instances.
+func (s *MirrorTest) TestMirrorWithoutShadowInstances(c *C) {
+	err := s.mux.Mirror("POST", "/users", &MirrorConfig{Service: "unknown", Percent: 100})
+	c.Assert(err, IsNil)
+	c.Assert(s.post(c, "jane").Code, Equals, http.StatusCreated)
+	c.Assert(s.mux.Mirrors()[0].Stats.Dropped, Equals, uint64(1))
+}
+
+// Requests that would exceed the shadow concurrency limit aren't mirrored.
+func (s *MirrorTest) TestMirrorBoundsConcurrency(c *C) {
+	release := make(chan bool)
+	s.shadow.Config.Handler = http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			<-release
+		})
+	err := s.mux.Mirror("POST", "/users", &MirrorConfig{
+		Service:       "users-rewrite",
+		Percent:       100,
+		MaxConcurrent: 1,
+		Compare:       func(result *MirrorResult) { s.results <- result }})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.post(c, "first").Code, Equals, http.StatusCreated)
+	c.Assert(s.post(c, "second").Code, Equals, http.StatusCreated)
+	c.Assert(s.mux.Mirrors()[0].Stats.Dropped, Equals, uint64(1))
+	close(release)
+	result := s.result(c)
+	c.Assert(result.ShadowStatus, Equals, http.StatusOK)
+	c.Assert(s.mux.Mirrors()[0].Stats.Sent, Equals, uint64(1))
+}
+
+// Requests with bodies larger than the limit, or of unknown length, aren't
+// mirrored.
+func (s *MirrorTest) TestMirrorBoundsBodySize(c *C) {
+	err := s.mux.Mirror("POST", "/users", &MirrorConfig{
+		Service:     "users-rewrite",
+		Percent:     100,
+		MaxBodySize: 4,
+		Compare:     func(result *MirrorResult) { s.results <- result }})
+	c.Assert(err, IsNil)
+
+	c.Assert(s.post(c, "jane").Code, Equals, http.StatusCreated)
+	s.result(c)
+	c.Assert(<-s.bodies, Equals, "jane")
+
+	writer := s.post(c, "janet")
+	c.Assert(writer.Body.String(), Equals, "primary janet")
+	c.Assert(s.mux.Mirrors()[0].Stats.Dropped, Equals, uint64(1))
+
+	writer = httptest.NewRecorder()
+	request, err := http.NewRequest("POST", "http://example.com/users", io.NopCloser(strings.NewReader("jo")))
+	c.Assert(err, IsNil)
+	c.Assert(request.ContentLength, Equals, int64(0))
+	request.ContentLength = -1
+	s.mux.ServeHTTP(writer, request)
+	c.Assert(writer.Body.String(), Equals, "primary jo")
+	c.Assert(s.mux.Mirrors()[0].Stats.Dropped, Equals, uint64(2))
+	c.Assert(s.mux.Mirrors()[0].Stats.Sent, Equals, uint64(1))
+}
+
+// A shadow request's concurrency slot is released once its response has
+// been read, without waiting for the primary request to finish.
+func (s *MirrorTest) TestMirrorReleasesSlotBeforePrimary(c *C) {
+	release := make(chan bool)
+	s.primary.Config.Handler = http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			if body, _ := io.ReadAll(request.Body); string(body) == "first" {
+				<-release
+			}
+		})
+	err := s.mux.Mirror("POST", "/users", &MirrorConfig{
+		Service:       "users-rewrite",
+		Percent:       100,
+		MaxConcurrent: 1,
+		Compare:       func(result *MirrorResult) { s.results <- result }})
+	c.Assert(err, IsNil)
+	m := s.mux.configs[routeKey("POST", "/users")].mirror
+
+	done := make(chan bool)
+	go func() {
+		s.post(c, "first")
+		done <- true
+	}()
+	c.Assert(<-s.bodies, Equals, "first")
+	for deadline := time.Now().Add(time.Second); len(m.semaphore) > 0; {
+		if time.Now().After(deadline) {
+			c.Fatal("Timed out waiting for the shadow to release its slot")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	c.Assert(s.post(c, "second").Code, Equals, http.StatusOK)
+	c.Assert(<-s.bodies, Equals, "second")
+	s.result(c)
+	close(release)
+	<-done
+	s.result(c)
+	c.Assert(s.mux.Mirrors()[0].Stats.Dropped, Equals, uint64(0))
+}
+
+// Client credentials are removed from shadow requests unless the mirror
+// forwards them.
+func (s *MirrorTest) TestMirrorCredentials(c *C) {
+	err := s.mux.Mirror("POST", "/users", &MirrorConfig{
+		Service: "users-rewrite",
+		Percent: 100,
+		Compare: func(result *MirrorResult) { s.results <- result }})
+	c.Assert(err, IsNil)
+	post := func() http.Header {
+		request, err := http.NewRequest("POST", "http://example.com/users", strings.NewReader("jane"))
+		c.Assert(err, IsNil)
+		request.Header.Set("Authorization", "Bearer secret")
+		request.Header.Set(DefaultAPIKeyHeader, "key")
+		request.Header.Set("Cookie", "session=secret")
+		request.Header.Set("X-Custom", "value")
+		s.mux.ServeHTTP(httptest.NewRecorder(), request)
+		s.result(c)
+		<-s.bodies
+		return <-s.headers
+	}
+
+	headers := post()
+	c.Assert(headers.Get("Authorization"), Equals, "")
+	c.Assert(headers.Get(DefaultAPIKeyHeader), Equals, "")
+	c.Assert(headers.Get("Cookie"), Equals, "")
+	c.Assert(headers.Get("X-Custom"), Equals, "value")
+
+	err = s.mux.Mirror("POST", "/users", &MirrorConfig{
+		Service:            "users-rewrite",
+		Percent:            100,
+		ForwardCredentials: true,
+		Compare:            func(result *MirrorResult) { s.results <- result }})
+	c.Assert(err, IsNil)
+	headers = post()
+	c.Assert(headers.Get("Authorization"), Equals, "Bearer secret")
+	c.Assert(headers.Get(DefaultAPIKeyHeader), Equals, "key")
+	c.Assert(headers.Get("Cookie"), Equals, "session=secret")
+}
@@ -1,25 +1,90 @@
 package switchboard
 
 import (
-	"bytes"
 	"errors"
-	"math/rand"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
 )
 
+// RequestIDHeader is the header used to correlate a client request with the
+// backend service request made on its behalf.  An ID provided by the client
+// is reused, otherwise one is generated.
+const RequestIDHeader = "X-Request-ID"
+
 // ExchangeServeMux is an HTTP request multiplexer.  It matches the URL of
 // each incoming request against a list of registered patterns to find the
 // service that can respond to it and proxies the request to the appropriate
 // backend.  Pattern matching logic is based on pat.go.
 type ExchangeServeMux struct {
-	rw     sync.RWMutex                 // Synchronize access to routes map.
-	routes map[string][]*patternHandler // Patterns mapped to backend services.
+	rw                sync.RWMutex                 // Synchronize access to routes map.
+	routes            map[string][]*patternHandler // Patterns mapped to backend services.
+	services          map[string]*ServiceRecord    // Service records keyed by address.
+	configs           map[string]*routeConfig      // Per-route options keyed by method and pattern.
+	middleware        []*Middleware                // Middleware run for every request.
+	serviceMiddleware map[string][]*Middleware     // Middleware keyed by service name or ID.
+	policies          map[string]*TrafficPolicy    // Traffic policies keyed by service name.
+	cors              *CORSConfig                  // CORS config for every route.
+	signer            *RequestSigner               // Signs proxied requests, if set.
+	compression       *CompressionConfig           // Response compression, if enabled.
+	cacheStore        CacheStore                   // Holds cached responses, if caching is enabled.
+	limits            *RequestLimits               // Request limits for every route.
+	faults            map[string]*FaultRule        // Fault rules keyed by name.
+	healthMutex       sync.Mutex                   // Synchronize access to health map.
+	health            map[string]*addressHealth    // Passive health keyed by address.
+	flightMutex       sync.Mutex                   // Synchronize access to flights map.
+	flights           map[string]*flight           // Coalesced backend requests in progress.
 }
 
 // NewExchangeServeMux allocates and returns a new ExchangeServeMux.
 func NewExchangeServeMux() *ExchangeServeMux {
-	return &ExchangeServeMux{routes: make(map[string][]*patternHandler)}
+	return &ExchangeServeMux{
+		routes:            make(map[string][]*patternHandler),
+		services:          make(map[string]*ServiceRecord),
+		configs:           make(map[string]*routeConfig),
+		serviceMiddleware: make(map[string][]*Middleware),
+		policies:          make(map[string]*TrafficPolicy),
+		health:            make(map[string]*addressHealth),
+		faults:            make(map[string]*FaultRule),
+		flights:           make(map[string]*flight)}
+}
+
+// AddService registers the routes exposed by a service.  The service record
+// is made available to middleware for requests routed to its address.
+func (mux *ExchangeServeMux) AddService(service *ServiceRecord) {
+	mux.rw.Lock()
+	mux.services[service.Address] = service
+	mux.rw.Unlock()
+
+	for method, patterns := range service.Routes {
+		for _, pattern := range patterns {
+			mux.Add(method, service.MountedPattern(pattern), service.Address)
+		}
+	}
+}
+
+// RemoveService unregisters the routes exposed by a service.
+func (mux *ExchangeServeMux) RemoveService(service *ServiceRecord) {
+	for method, patterns := range service.Routes {
+		for _, pattern := range patterns {
+			mux.Remove(method, service.MountedPattern(pattern), service.Address)
+		}
+	}
+
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	if existing, present := mux.services[service.Address]; present && existing.ID == service.ID {
+		delete(mux.services, service.Address)
+		mux.healthMutex.Lock()
+		delete(mux.health, service.Address)
+		mux.healthMutex.Unlock()
+	}
 }
 
 // Add registers the address of a backend service as a handler for an HTTP
@@ -71,8 +136,8 @@ func (mux *ExchangeServeMux) Remove(method, pattern, address string) {
 	for i, handler := range handlers {
 		if pattern == handler.pattern {
 			// Remove the handler if the address to remove is the only one
-			// registered.
-			if len(handler.addresses) == 1 && handler.addresses[0] == address {
+			// registered and there's no static response to fall back to.
+			if len(handler.addresses) == 1 && handler.addresses[0] == address && handler.static == nil {
 				mux.routes[method] = append(handlers[:i], handlers[i+1:]...)
 				return
 			}
@@ -91,48 +156,195 @@ func (mux *ExchangeServeMux) Remove(method, pattern, address string) {
 }
 
 // ServeHTTP dispatches the request to the backend service whose pattern most
-// closely matches the request URL.
+// closely matches the request URL.  Middleware installed with Use,
+// UseService and UseRoute runs at each stage of the request.
 func (mux *ExchangeServeMux) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
-	// Attempt to match the request against registered patterns and addresses.
-	addresses, err := mux.Match(request.Method, request.URL.Path)
+	route := &Route{
+		Method:    request.Method,
+		Path:      request.URL.Path,
+		RequestID: requestID(request),
+		Start:     time.Now()}
+	writer = &responseRecorder{ResponseWriter: writer, route: route}
+	writer.Header().Set(RequestIDHeader, route.RequestID)
+	mux.rw.RLock()
+	stack := mux.stack(route)
+	mux.rw.RUnlock()
+	defer func() {
+		for _, middleware := range stack {
+			if middleware.Complete != nil {
+				middleware.Complete(request, route)
+			}
+		}
+	}()
+	for _, middleware := range stack {
+		if middleware.PreMatch != nil && !middleware.PreMatch(writer, request, route) {
+			return
+		}
+	}
+
+	// Answer CORS preflight requests without involving backend services.
+	if mux.preflight(writer, request, route) {
+		return
+	}
+
+	// Attempt to match the request against registered patterns and select a
+	// random backend service.
+	matched, err := mux.selectRoute(route, request)
 	if err != nil {
 		writer.WriteHeader(http.StatusNotFound)
 		return
 	}
+	stack = matched
+	cors := mux.allowCORS(writer, request, route)
+	limited, ok := mux.limit(writer, request, route)
+	if !ok {
+		return
+	}
+	for _, middleware := range stack {
+		if middleware.PostMatch != nil && !middleware.PostMatch(writer, request, route) {
+			return
+		}
+	}
+
+	// Mirror the request to a shadow service, if the route is mirrored.
+	// Mirroring reads the whole body, so a client that sends it too slowly
+	// is detected here.
+	if shadow := mux.shadow(route, request); shadow != nil {
+		defer shadow.complete(route)
+	}
+	if limited != nil && limited.failure() != nil {
+		route.Refusal = limited.failure()
+		writer.WriteHeader(limited.status())
+		return
+	}
+
+	// Inject a fault, if a fault rule applies to the request.
+	fault := mux.fault(route, request)
+	if fault != nil && !fault.inject(writer, request, route) {
+		return
+	}
 
-	// Make a request to a random backend service.
-	index := rand.Intn(len(*addresses))
-	address := (*addresses)[index]
-	url := address + request.URL.Path
-	if len(request.URL.Query()) > 0 {
-		url = url + "?" + request.URL.RawQuery
+	// Answer the request with the route's static response if no backend
+	// service is registered for it.
+	if route.Address == "" {
+		mux.serveStatic(writer, request, route)
+		return
 	}
-	innerRequest, err := http.NewRequest(request.Method, url, request.Body)
+
+	// Make a request to the selected backend service.
+	route.Target = request.URL.EscapedPath()
+	if route.Service != nil {
+		route.Target = route.Service.RewritePath(route.Target)
+	}
+	target, err := backendURL(route.Address, route.Target, request.URL.RawQuery)
 	if err != nil {
+		route.Err = err
 		writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	for header, values := range request.Header {
-		for _, value := range values {
-			innerRequest.Header.Add(header, value)
+	requestBody := request.Body
+	if requestBody != nil && requestBody != http.NoBody {
+		requestBody = &countingReader{ReadCloser: requestBody, route: route}
+	}
+	innerRequest, err := http.NewRequest(request.Method, target.String(), requestBody)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	copyHeader(innerRequest, request, route)
+	for _, middleware := range stack {
+		if middleware.PreProxy != nil && !middleware.PreProxy(writer, request, innerRequest, route) {
+			return
+		}
+	}
+	response, err := mux.roundTrip(route, request, innerRequest)
+	if limited != nil && limited.failure() != nil {
+		// The request body exceeded the route's limits while it was being
+		// proxied.
+		if err == nil {
+			response.Body.Close()
 		}
+		route.Refusal = limited.failure()
+		writer.WriteHeader(limited.status())
+		return
 	}
-	response, err := http.DefaultClient.Do(innerRequest)
 	if err != nil {
+		if route.Refusal == nil {
+			route.Err = err
+		}
 		writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	defer response.Body.Close()
+	for _, middleware := range stack {
+		if middleware.PostProxy != nil && !middleware.PostProxy(writer, request, response, route) {
+			return
+		}
+	}
 
 	// Relay the response from the backend service back to the client.
+	if fault != nil {
+		fault.truncate(response)
+	}
+	response.Header.Del(RequestIDHeader)
 	for header, values := range response.Header {
+		if cors && isCORSHeader(header) {
+			continue
+		}
 		for _, value := range values {
 			writer.Header().Add(header, value)
 		}
 	}
+	body := mux.compress(writer, request, response)
 	writer.WriteHeader(response.StatusCode)
-	body := bytes.NewBufferString("")
-	body.ReadFrom(response.Body)
-	writer.Write(body.Bytes())
+	if err := relay(writer, body, response); err != nil {
+		route.Err = err
+		if errors.Is(err, errFaultTruncated) {
+			// Send what's been written and close the connection, so the
+			// client sees a truncated body.
+			http.NewResponseController(writer).Flush()
+			panic(http.ErrAbortHandler)
+		}
+	}
+	body.Close()
+}
+
+// RoundTrip sends a proxied request on behalf of request, applying the
+// options configured for the route, and returns the response to relay to
+// the client.  The request passes through the response cache, then request
+// coalescing, then hedging, where it's signed, before it's sent.
+func (mux *ExchangeServeMux) roundTrip(route *Route, request, outbound *http.Request) (*http.Response, error) {
+	return mux.cached(route, request, outbound)
+}
+
+// Send sends a proxied request to the route's backend service, recording
+// the time it took and the outcome in the address's health.
+func (mux *ExchangeServeMux) send(route *Route, outbound *http.Request) (*http.Response, error) {
+	upstreamStart := time.Now()
+	response, err := http.DefaultClient.Do(outbound)
+	route.Upstream += time.Since(upstreamStart)
+	mux.observe(route.Address, err)
+	return response, err
+}
+
+// SelectRoute matches a route against registered patterns, selects a backend
+// service to handle it and returns the middleware that applies to it.  An
+// error is returned if no addresses are registered for the route's HTTP
+// method and URL path.
+func (mux *ExchangeServeMux) selectRoute(route *Route, request *http.Request) ([]*Middleware, error) {
+	mux.rw.RLock()
+	defer mux.rw.RUnlock()
+
+	handler := mux.find(route.Method, route.Path)
+	if handler == nil {
+		return nil, errors.New("No matching address")
+	}
+	route.Pattern = handler.pattern
+	route.Params, _ = handler.Params(route.Path)
+	route.Address = mux.choose(handler, request)
+	route.Service = mux.services[route.Address]
+	route.Auth = mux.authRequirement(route.Method, handler)
+	return mux.stack(route), nil
 }
 
 // Match finds backend service addresses capable of handling a request for the
@@ -142,15 +354,135 @@ func (mux *ExchangeServeMux) Match(method, pattern string) (*[]string, error) {
 	mux.rw.RLock()
 	defer mux.rw.RUnlock()
 
-	handlers, present := mux.routes[method]
-	if present {
-		for _, handler := range handlers {
-			if handler.Match(pattern) {
-				return &handler.addresses, nil
-			}
+	handler := mux.find(method, pattern)
+	if handler == nil || len(handler.addresses) == 0 {
+		return nil, errors.New("No matching address")
+	}
+	return &handler.addresses, nil
+}
+
+// AddressHealth tracks the outcome of recent requests to a backend service
+// address.
+type addressHealth struct {
+	failures    int       // Consecutive failed requests.
+	lastError   string    // The most recent error.
+	lastFailure time.Time // The time of the most recent failed request.
+	lastSuccess time.Time // The time of the most recent successful request.
+}
+
+// Observe records the outcome of a request to a backend service address.
+func (mux *ExchangeServeMux) observe(address string, err error) {
+	mux.healthMutex.Lock()
+	defer mux.healthMutex.Unlock()
+	health, present := mux.health[address]
+	if !present {
+		health = &addressHealth{}
+		mux.health[address] = health
+	}
+	if err != nil {
+		health.failures++
+		health.lastError = err.Error()
+		health.lastFailure = time.Now()
+	} else {
+		health.failures = 0
+		health.lastSuccess = time.Now()
+	}
+}
+
+// ResponseRecorder wraps an http.ResponseWriter to record the status code
+// and number of bytes written to the client in a Route.
+type responseRecorder struct {
+	http.ResponseWriter
+	route *Route
+}
+
+// WriteHeader records the status code and writes it to the client.
+func (recorder *responseRecorder) WriteHeader(status int) {
+	if recorder.route.Status == 0 {
+		recorder.route.Status = status
+	}
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// Write writes data to the client, recording an implicit 200 OK status if
+// WriteHeader hasn't been called.
+func (recorder *responseRecorder) Write(data []byte) (int, error) {
+	if recorder.route.Status == 0 {
+		recorder.route.Status = http.StatusOK
+	}
+	n, err := recorder.ResponseWriter.Write(data)
+	recorder.route.BytesOut += int64(n)
+	return n, err
+}
+
+// Unwrap returns the wrapped http.ResponseWriter for use with
+// http.ResponseController.
+func (recorder *responseRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
+// CountingReader wraps a request body to record the number of bytes read
+// from the client in a Route.
+type countingReader struct {
+	io.ReadCloser
+	route *Route
+}
+
+// Read reads data from the request body.
+func (reader *countingReader) Read(data []byte) (int, error) {
+	n, err := reader.ReadCloser.Read(data)
+	reader.route.BytesIn += int64(n)
+	return n, err
+}
+
+// CopyHeader copies the client's request headers to a request proxied on its
+// behalf.  Identity headers are set only by the exchange, so X-Auth-*
+// headers sent by the client are dropped, and the client's address is
+// appended to X-Forwarded-For.
+func copyHeader(outbound, request *http.Request, route *Route) {
+	for header, values := range request.Header {
+		if strings.HasPrefix(http.CanonicalHeaderKey(header), "X-Auth-") {
+			continue
+		}
+		for _, value := range values {
+			outbound.Header.Add(header, value)
+		}
+	}
+	outbound.Header.Set(RequestIDHeader, route.RequestID)
+	if client, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		if prior := request.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			client = strings.Join(prior, ", ") + ", " + client
+		}
+		outbound.Header.Set("X-Forwarded-For", client)
+	}
+}
+
+// RequestID returns the ID provided by the client in the X-Request-ID header
+// or a new random UUID if the client didn't provide a usable one.
+func requestID(request *http.Request) string {
+	id := request.Header.Get(RequestIDHeader)
+	if id == "" || len(id) > 128 {
+		return uuid.NewRandom().String()
+	}
+	for _, char := range id {
+		// Reject IDs with characters that could corrupt logs.
+		if char < '!' || char > '~' {
+			return uuid.NewRandom().String()
 		}
 	}
-	return nil, errors.New("No matching address")
+	return id
+}
+
+// Find returns the first pattern handler registered for an HTTP method that
+// matches path, or nil if there isn't one.  The caller must hold the read
+// lock.
+func (mux *ExchangeServeMux) find(method, path string) *patternHandler {
+	for _, handler := range mux.routes[method] {
+		if handler.Match(path) {
+			return handler
+		}
+	}
+	return nil
 }
 
 // Handler keeps track of backend service addresses that are registered to
@@ -158,31 +490,43 @@ func (mux *ExchangeServeMux) Match(method, pattern string) (*[]string, error) {
 type patternHandler struct {
 	pattern   string
 	addresses []string
+	static    *staticResponse // Sent while no addresses are registered.
 }
 
 // Match returns true if this handler is a match for path.
 func (handler *patternHandler) Match(path string) bool {
+	_, matched := handler.Params(path)
+	return matched
+}
+
+// Params matches path against the handler's pattern and returns the values
+// captured by its placeholders, keyed by placeholder name without the
+// leading colon.  False is returned if path doesn't match.
+func (handler *patternHandler) Params(path string) (url.Values, bool) {
+	params := make(url.Values)
 	var i, j int
 	for i < len(path) {
 		switch {
 		case j == len(handler.pattern) && handler.pattern[j-1] == '/':
-			return true
+			return params, true
 		case j >= len(handler.pattern):
-			return false
+			return nil, false
 		case handler.pattern[j] == ':':
-			j = handler.find(handler.pattern, '/', j)
-			i = handler.find(path, '/', i)
+			nameEnd := handler.find(handler.pattern, '/', j)
+			valueEnd := handler.find(path, '/', i)
+			params.Add(handler.pattern[j+1:nameEnd], path[i:valueEnd])
+			i, j = valueEnd, nameEnd
 		case path[i] == handler.pattern[j]:
 			i++
 			j++
 		default:
-			return false
+			return nil, false
 		}
 	}
 	if j != len(handler.pattern) {
-		return false
+		return nil, false
 	}
-	return true
+	return params, true
 }
 
 // Find searches text for char, starting at startIndex, and returns the index
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	. "gopkg.in/check.v1"
 )
 
@@ -179,7 +180,8 @@ func (s *ExchangeServeMuxTest) TestServeHTTPWithHeaders(c *C) {
 		c.Assert(r.Header, DeepEquals, http.Header{
 			"User-Agent":      []string{"Go 1.1 package http"},
 			"Accept-Encoding": []string{"gzip"},
-			"X-From-Client":   []string{"Client"}})
+			"X-From-Client":   []string{"Client"},
+			"X-Request-Id":    []string{"request-id"}})
 		w.Header().Add("X-From-Service", "Service")
 	})
 	server := httptest.NewServer(handler)
@@ -188,6 +190,7 @@ func (s *ExchangeServeMuxTest) TestServeHTTPWithHeaders(c *C) {
 	url := "http://example.com/resource?key=value&key1=value1&key1=value2"
 	request, err := http.NewRequest("GET", url, nil)
 	request.Header.Add("X-From-Client", "Client")
+	request.Header.Add("X-Request-ID", "request-id")
 	c.Assert(err, IsNil)
 
 	mux := NewExchangeServeMux()
@@ -198,7 +201,54 @@ func (s *ExchangeServeMuxTest) TestServeHTTPWithHeaders(c *C) {
 	c.Assert(writer.Header(), DeepEquals, http.Header{
 		"Content-Length": []string{"0"},
 		"Content-Type":   []string{"text/plain; charset=utf-8"},
-		"X-From-Service": []string{"Service"}})
+		"X-From-Service": []string{"Service"},
+		"X-Request-Id":   []string{"request-id"}})
+}
+
+// ServeHTTP generates a request ID when the client doesn't provide one,
+// forwards it to the backend service and echoes it to the client.
+func (s *ExchangeServeMuxTest) TestServeHTTPGeneratesRequestID(c *C) {
+	var backendID string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendID = r.Header.Get("X-Request-ID")
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://example.com/resource", nil)
+	c.Assert(err, IsNil)
+
+	mux := NewExchangeServeMux()
+	mux.Add("GET", "/resource", server.URL)
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(backendID, Matches, "[0-9a-f-]{36}")
+	c.Assert(writer.Header().Get("X-Request-ID"), Equals, backendID)
+}
+
+// ServeHTTP includes the request ID in error responses.
+func (s *ExchangeServeMuxTest) TestServeHTTPRequestIDInErrorResponse(c *C) {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://example.com/resource", nil)
+	c.Assert(err, IsNil)
+	request.Header.Set("X-Request-ID", "request-id")
+
+	mux := NewExchangeServeMux()
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusNotFound)
+	c.Assert(writer.Header().Get("X-Request-ID"), Equals, "request-id")
+}
+
+// ServeHTTP replaces request IDs that contain unprintable characters.
+func (s *ExchangeServeMuxTest) TestServeHTTPReplacesInvalidRequestID(c *C) {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://example.com/resource", nil)
+	c.Assert(err, IsNil)
+	request.Header.Set("X-Request-ID", "bad id")
+
+	mux := NewExchangeServeMux()
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Header().Get("X-Request-ID"), Matches, "[0-9a-f-]{36}")
 }
 
 // ServeHTTP proxies requests to dynamic routes registered with Add.
@@ -309,3 +359,22 @@ func (s *PatternHandlerTest) TestMatchWithPrefixAndSplat(c *C) {
 	c.Assert(handler.Match("/foo/name/bar/baz"), Equals, true)
 	c.Assert(handler.Match("/foo/name/bar/baz/quux"), Equals, true)
 }
+
+// Params returns the values captured by placeholders.
+func (s *PatternHandlerTest) TestParams(c *C) {
+	handler := patternHandler{pattern: "/foo/:name/bar/:id"}
+	params, matched := handler.Params("/foo/x/bar/123")
+	c.Assert(matched, Equals, true)
+	c.Assert(params, DeepEquals, url.Values{"name": []string{"x"}, "id": []string{"123"}})
+	_, matched = handler.Params("/foo/x/bar")
+	c.Assert(matched, Equals, false)
+}
+
+// Params captures values for placeholders with a constant prefix and for
+// duplicate placeholder names.
+func (s *PatternHandlerTest) TestParamsWithPrefixAndDuplicates(c *C) {
+	handler := patternHandler{pattern: "/foo/x:name/:name"}
+	params, matched := handler.Params("/foo/xbar/baz")
+	c.Assert(matched, Equals, true)
+	c.Assert(params, DeepEquals, url.Values{"name": []string{"bar", "baz"}})
+}
@@ -0,0 +1,115 @@
+package switchboard
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// RewriteRule transforms the escaped URL path of a request before it's
+// proxied to a backend service.  Each rule does exactly one thing:
+// StripPrefix removes a prefix from the path, AddPrefix prepends one, and
+// Match replaces the parts of the path matched by a regular expression with
+// Replace.  Replace may refer to groups captured by Match as $1 or ${name}.
+type RewriteRule struct {
+	StripPrefix string `json:"strip_prefix,omitempty"`
+	AddPrefix   string `json:"add_prefix,omitempty"`
+	Match       string `json:"match,omitempty"`
+	Replace     string `json:"replace,omitempty"`
+}
+
+// Expressions caches compiled rewrite expressions, since service records
+// are decoded from JSON and don't hold on to compiled state.
+var expressions = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: make(map[string]*regexp.Regexp)}
+
+// Validate returns an error if the rule doesn't do exactly one thing or its
+// expression doesn't compile.
+func (rule *RewriteRule) Validate() error {
+	actions := 0
+	for _, value := range []string{rule.StripPrefix, rule.AddPrefix, rule.Match} {
+		if value != "" {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return errors.New("Rewrite rule needs exactly one of strip_prefix, add_prefix or match")
+	}
+	if rule.Match != "" {
+		_, err := compile(rule.Match)
+		return err
+	}
+	return nil
+}
+
+// Apply rewrites path.  Paths that the rule doesn't match are returned
+// unchanged.  Prefixes are only stripped at a path segment boundary, so
+// stripping /api leaves /apiary alone.
+func (rule *RewriteRule) Apply(path string) string {
+	switch {
+	case rule.StripPrefix != "":
+		prefix := strings.TrimSuffix(rule.StripPrefix, "/")
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			path = ensureSlash(strings.TrimPrefix(path, prefix))
+		}
+	case rule.AddPrefix != "":
+		path = strings.TrimSuffix(rule.AddPrefix, "/") + path
+	case rule.Match != "":
+		if expression, err := compile(rule.Match); err == nil {
+			path = ensureSlash(expression.ReplaceAllString(path, rule.Replace))
+		}
+	}
+	return path
+}
+
+// MountedPattern returns the pattern an exchange registers for one of the
+// service's route patterns, which is the pattern under the service's mount
+// prefix.
+func (record *ServiceRecord) MountedPattern(pattern string) string {
+	mount := strings.TrimSuffix(record.Mount, "/")
+	if mount == "" {
+		return pattern
+	}
+	return mount + pattern
+}
+
+// RewritePath returns the URL path to send to the service for a request
+// with path.  The service's mount prefix is removed and then its rewrite
+// rules are applied in order.
+func (record *ServiceRecord) RewritePath(path string) string {
+	if mount := strings.TrimSuffix(record.Mount, "/"); mount != "" {
+		if path == mount || strings.HasPrefix(path, mount+"/") {
+			path = ensureSlash(strings.TrimPrefix(path, mount))
+		}
+	}
+	for i := range record.Rewrites {
+		path = record.Rewrites[i].Apply(path)
+	}
+	return path
+}
+
+// Compile returns the compiled form of a rewrite expression.
+func compile(expression string) (*regexp.Regexp, error) {
+	expressions.Lock()
+	defer expressions.Unlock()
+	if compiled, present := expressions.compiled[expression]; present {
+		return compiled, nil
+	}
+	compiled, err := regexp.Compile(expression)
+	if err != nil {
+		return nil, err
+	}
+	expressions.compiled[expression] = compiled
+	return compiled, nil
+}
+
+// EnsureSlash returns path with a leading slash.
+func ensureSlash(path string) string {
+	if !strings.HasPrefix(path, "/") {
+		return "/" + path
+	}
+	return path
+}
@@ -0,0 +1,138 @@
+package switchboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+type RewriteTest struct{}
+
+var _ = Suite(&RewriteTest{})
+
+// Rewrite rules are validated to do exactly one thing with a valid
+// expression, and mount prefixes must be absolute.
+func (s *RewriteTest) TestValidate(c *C) {
+	rule := RewriteRule{}
+	c.Assert(rule.Validate(), ErrorMatches,
+		"Rewrite rule needs exactly one of strip_prefix, add_prefix or match")
+	rule = RewriteRule{StripPrefix: "/v1", AddPrefix: "/v2"}
+	c.Assert(rule.Validate(), NotNil)
+	rule = RewriteRule{Match: "("}
+	c.Assert(rule.Validate(), ErrorMatches, "error parsing regexp.*")
+	rule = RewriteRule{Match: "^/user/(\\d+)$", Replace: "/users/$1"}
+	c.Assert(rule.Validate(), IsNil)
+
+	record := &ServiceRecord{Address: "http://localhost:8080", Mount: "users"}
+	c.Assert(record.Validate(), ErrorMatches, "Mount prefix must start with /")
+	record = &ServiceRecord{
+		Address:  "http://localhost:8080",
+		Mount:    "/users",
+		Rewrites: []RewriteRule{{}}}
+	c.Assert(record.Validate(), NotNil)
+}
+
+// Rewrite rules strip and add prefixes and replace regular expression
+// matches, expanding captured groups.
+func (s *RewriteTest) TestApply(c *C) {
+	rule := RewriteRule{StripPrefix: "/api"}
+	c.Assert(rule.Apply("/api/users"), Equals, "/users")
+	c.Assert(rule.Apply("/api"), Equals, "/")
+	c.Assert(rule.Apply("/users"), Equals, "/users")
+	c.Assert(rule.Apply("/apiary"), Equals, "/apiary")
+	c.Assert(rule.Apply("/apiary/bees"), Equals, "/apiary/bees")
+
+	rule = RewriteRule{StripPrefix: "/api/"}
+	c.Assert(rule.Apply("/api/users"), Equals, "/users")
+	c.Assert(rule.Apply("/apiary"), Equals, "/apiary")
+
+	rule = RewriteRule{AddPrefix: "/v2/"}
+	c.Assert(rule.Apply("/users"), Equals, "/v2/users")
+
+	rule = RewriteRule{Match: "^/user/(?P<id>[^/]+)/photos$", Replace: "/photos/${id}"}
+	c.Assert(rule.Apply("/user/123/photos"), Equals, "/photos/123")
+	c.Assert(rule.Apply("/user/123"), Equals, "/user/123")
+}
+
+// Routes are registered under the mount prefix, which is removed from the
+// path before rewrite rules are applied.
+func (s *RewriteTest) TestMount(c *C) {
+	record := &ServiceRecord{
+		Mount:    "/accounts/",
+		Rewrites: []RewriteRule{{AddPrefix: "/internal"}}}
+	c.Assert(record.MountedPattern("/user/:id"), Equals, "/accounts/user/:id")
+	c.Assert(record.RewritePath("/accounts/user/123"), Equals, "/internal/user/123")
+	c.Assert(record.RewritePath("/accounts"), Equals, "/internal/")
+	c.Assert((&ServiceRecord{}).MountedPattern("/users"), Equals, "/users")
+}
+
+// ServeHTTP matches mounted patterns and proxies rewritten paths, keeping
+// the query string.
+func (s *RewriteTest) TestServeHTTPWithMountAndRewrite(c *C) {
+	paths := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			paths <- request.URL.RequestURI()
+		}))
+	defer server.Close()
+	mux := NewExchangeServeMux()
+	mux.AddService(&ServiceRecord{
+		ID:       "users",
+		Address:  server.URL,
+		Routes:   Routes{"GET": []string{"/user/:id"}},
+		Mount:    "/accounts",
+		Rewrites: []RewriteRule{{Match: "^/user/", Replace: "/people/"}}})
+	_, err := mux.Match("GET", "/user/123")
+	c.Assert(err, NotNil)
+
+	var target string
+	mux.Use(&Middleware{Complete: func(request *http.Request, route *Route) {
+		target = route.Target
+	}})
+	writer := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com/accounts/user/123?q=1", nil)
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(<-paths, Equals, "/people/123?q=1")
+	c.Assert(target, Equals, "/people/123")
+}
+
+// Services mounted under different prefixes don't conflict, and exchanges
+// refuse services with invalid rewrite rules.
+func (s *RewriteTest) TestExchangeRegister(c *C) {
+	mux := NewExchangeServeMux()
+	exchange := NewExchange("test", nil, mux)
+	exchange.SetConflictPolicy(RejectNewer, nil)
+	users := &ServiceRecord{
+		ID:      "users",
+		Address: "http://localhost:8080",
+		Routes:  Routes{"GET": []string{"/"}},
+		Mount:   "/users"}
+	groups := &ServiceRecord{
+		ID:      "groups",
+		Address: "http://localhost:9090",
+		Routes:  Routes{"GET": []string{"/"}},
+		Mount:   "/groups"}
+	c.Assert(exchange.Register(users), IsNil)
+	c.Assert(exchange.Register(groups), IsNil)
+	addresses, err := mux.Match("GET", "/groups/123")
+	c.Assert(err, IsNil)
+	c.Assert(*addresses, DeepEquals, []string{"http://localhost:9090"})
+
+	impostor := &ServiceRecord{
+		ID:      "impostor",
+		Address: "http://localhost:7070",
+		Routes:  Routes{"GET": []string{"/users/"}}}
+	err = exchange.Register(impostor)
+	c.Assert(err, ErrorMatches, "Routes rejected: GET /users/ is claimed by users and impostor")
+
+	invalid := &ServiceRecord{
+		ID:       "invalid",
+		Address:  "http://localhost:6060",
+		Routes:   Routes{"GET": []string{"/invalid"}},
+		Rewrites: []RewriteRule{{Match: "("}}}
+	c.Assert(exchange.Register(invalid), NotNil)
+	c.Assert(exchange.Services(), HasLen, 2)
+	c.Assert(exchange.Rejected(), DeepEquals, []*ServiceRecord{impostor})
+}
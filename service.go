@@ -2,7 +2,10 @@ package switchboard
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
+	"strings"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
@@ -15,19 +18,67 @@ type Routes map[string][]string
 // ServiceRecord is a representation of a service stored in etcd and used by
 // exchanges.
 type ServiceRecord struct {
-	ID      string `json:"id"`
-	Address string `json:"address"`
-	Routes  Routes `json:"routes"`
+	ID        string            `json:"id"`
+	Name      string            `json:"name,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Address   string            `json:"address"`
+	Routes    Routes            `json:"routes"`
+	Mount     string            `json:"mount,omitempty"`
+	Rewrites  []RewriteRule     `json:"rewrites,omitempty"`
+	Auth      []AuthRequirement `json:"auth,omitempty"`
+	Signature *RecordSignature  `json:"signature,omitempty"`
+}
+
+// LogicalName returns the name of the logical service this record is an
+// instance of.  Records without a name are treated as their own logical
+// service and identified by their ID.
+func (record *ServiceRecord) LogicalName() string {
+	if record.Name == "" {
+		return record.ID
+	}
+	return record.Name
+}
+
+// Validate returns an error if the service's address, mount prefix,
+// rewrite rules or auth requirements are invalid.
+func (record *ServiceRecord) Validate() error {
+	if _, err := ParseAddress(record.Address); err != nil {
+		return err
+	}
+	if record.Mount != "" && !strings.HasPrefix(record.Mount, "/") {
+		return errors.New("Mount prefix must start with /")
+	}
+	for i := range record.Rewrites {
+		if err := record.Rewrites[i].Validate(); err != nil {
+			return err
+		}
+	}
+	for _, requirement := range record.Auth {
+		if !contains(record.Routes[requirement.Method], requirement.Pattern) {
+			return errors.New("Auth requirement for " + requirement.Method + " " +
+				requirement.Pattern + " doesn't match a route")
+		}
+	}
+	return nil
 }
 
 // Service responds to HTTP requests for a set of endpoints described by a
 // JSON schema.
 type Service struct {
-	id        string       // A unique ID representing this service.
-	namespace string       // The root directory in etcd for config files.
-	client    *etcd.Client // The etcd client.
-	address   string       // The public address for this service.
-	routes    Routes       // The routes handled by this service.
+	id        string             // A unique ID representing this service.
+	namespace string             // The root directory in etcd for config files.
+	client    *etcd.Client       // The etcd client.
+	address   string             // The public address for this service.
+	routes    Routes             // The routes handled by this service.
+	name      string             // The name of the logical service.
+	version   string             // The version of the logical service.
+	labels    map[string]string  // Arbitrary metadata describing the service.
+	mount     string             // The prefix the service's routes are mounted under.
+	rewrites  []RewriteRule      // Rules that rewrite paths before they're proxied.
+	auth      []AuthRequirement  // Who may call each route.
+	keyID     string             // The ID of the key records are signed with.
+	key       ed25519.PrivateKey // The key records are signed with.
 }
 
 // NewService creates a service that can be registered with etcd to handle
@@ -57,15 +108,105 @@ func (service *Service) Routes() Routes {
 	return service.routes
 }
 
+// Name returns the name of the logical service this service is an instance
+// of.
+func (service *Service) Name() string {
+	return service.name
+}
+
+// SetName sets the name of the logical service this service is an instance
+// of.  Exchanges treat services with the same name as instances of one
+// service.
+func (service *Service) SetName(name string) {
+	service.name = name
+}
+
+// Version returns the version of this service.
+func (service *Service) Version() string {
+	return service.version
+}
+
+// SetVersion sets the version of this service.
+func (service *Service) SetVersion(version string) {
+	service.version = version
+}
+
+// Labels returns the metadata labels describing this service.
+func (service *Service) Labels() map[string]string {
+	return service.labels
+}
+
+// SetLabel adds a metadata label describing this service.
+func (service *Service) SetLabel(key, value string) {
+	if service.labels == nil {
+		service.labels = make(map[string]string)
+	}
+	service.labels[key] = value
+}
+
+// Mount returns the prefix this service's routes are mounted under.
+func (service *Service) Mount() string {
+	return service.mount
+}
+
+// SetMount sets the prefix this service's routes are mounted under.
+// Exchanges register each route pattern under the prefix and remove it from
+// request paths before proxying them, so the service can be written as if
+// it were mounted at /.
+func (service *Service) SetMount(prefix string) {
+	service.mount = prefix
+}
+
+// Rewrites returns the rules that rewrite request paths for this service.
+func (service *Service) Rewrites() []RewriteRule {
+	return service.rewrites
+}
+
+// AddRewrite adds a rule that rewrites request paths before they're proxied
+// to this service.  Rules are applied in the order they're added, after the
+// mount prefix is removed.
+func (service *Service) AddRewrite(rule RewriteRule) {
+	service.rewrites = append(service.rewrites, rule)
+}
+
+// AddAuthRequirement declares who may call one of this service's routes.
+// Exchanges using Authentication middleware require an authenticated client
+// for routes without a requirement.
+func (service *Service) AddAuthRequirement(requirement AuthRequirement) {
+	service.auth = append(service.auth, requirement)
+}
+
+// SetSigningKey configures the service to sign its records with an ed25519
+// private key.  Exchanges that require signed records look the public key up
+// by id.
+func (service *Service) SetSigningKey(id string, key ed25519.PrivateKey) {
+	service.keyID = id
+	service.key = key
+}
+
 // Register adds a service record to etcd.  The ttl is the time to live for
 // the service record, in seconds.  A ttl of 0 registers a service record that
 // never expires.
 func (service *Service) Register(ttl uint64) (*ServiceRecord, error) {
 	key := service.namespace + "/" + service.id
 	record := ServiceRecord{
-		ID:      service.id,
-		Address: service.address,
-		Routes:  service.routes}
+		ID:       service.id,
+		Name:     service.name,
+		Version:  service.version,
+		Labels:   service.labels,
+		Address:  service.address,
+		Routes:   service.routes,
+		Mount:    service.mount,
+		Rewrites: service.rewrites,
+		Auth:     service.auth}
+	if err := record.Validate(); err != nil {
+		return nil, err
+	}
+	if service.key != nil {
+		if err := record.Sign(service.keyID, service.key); err != nil {
+			return nil, err
+		}
+	}
 	recordJSON, err := json.Marshal(record)
 	if err != nil {
 		return nil, err
@@ -2,6 +2,8 @@ package switchboard_test
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/json"
 	"time"
 
@@ -39,6 +41,70 @@ func (s *ServiceTest) TestRegister(c *C) {
 	c.Assert(response.Node.Value, Equals, bytes.NewBuffer(recordJSON).String())
 }
 
+// Register includes the service's name, version and labels in its service
+// record.
+func (s *ServiceTest) TestRegisterWithNameAndVersion(c *C) {
+	address := "http://localhost:8080"
+	routes := switchboard.Routes{"GET": []string{"/users"}}
+	service := switchboard.NewService("test", s.client, address, routes)
+	service.SetName("users")
+	service.SetVersion("1.2.0")
+	service.SetLabel("team", "identity")
+	record, err := service.Register(0)
+	c.Assert(err, IsNil)
+	c.Assert(record.Name, Equals, "users")
+	c.Assert(record.Version, Equals, "1.2.0")
+	c.Assert(record.Labels, DeepEquals, map[string]string{"team": "identity"})
+	c.Assert(record.LogicalName(), Equals, "users")
+
+	key := "test/" + service.ID()
+	response, err := s.client.Get(key, false, false)
+	c.Assert(err, IsNil)
+	var stored switchboard.ServiceRecord
+	err = json.Unmarshal([]byte(response.Node.Value), &stored)
+	c.Assert(err, IsNil)
+	c.Assert(&stored, DeepEquals, record)
+}
+
+// Register includes the mount prefix and rewrite rules in the service
+// record, and refuses to store records with invalid rules.
+func (s *ServiceTest) TestRegisterWithMountAndRewrites(c *C) {
+	address := "http://localhost:8080"
+	routes := switchboard.Routes{"GET": []string{"/:id"}}
+	service := switchboard.NewService("test", s.client, address, routes)
+	service.SetMount("/users")
+	service.AddRewrite(switchboard.RewriteRule{AddPrefix: "/v1"})
+	record, err := service.Register(0)
+	c.Assert(err, IsNil)
+	c.Assert(record.Mount, Equals, "/users")
+	c.Assert(record.Rewrites, DeepEquals, []switchboard.RewriteRule{{AddPrefix: "/v1"}})
+
+	service.AddRewrite(switchboard.RewriteRule{Match: "("})
+	_, err = service.Register(0)
+	c.Assert(err, NotNil)
+}
+
+// Register signs the service record if a signing key is configured, and
+// exchanges that trust the key accept it from etcd.
+func (s *ServiceTest) TestRegisterSigned(c *C) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	address := "http://localhost:8080"
+	routes := switchboard.Routes{"GET": []string{"/users"}}
+	service := switchboard.NewService("test", s.client, address, routes)
+	service.SetSigningKey("users-2024", private)
+	record, err := service.Register(0)
+	c.Assert(err, IsNil)
+	c.Assert(record.Signature.KeyID, Equals, "users-2024")
+
+	mux := switchboard.NewExchangeServeMux()
+	exchange := switchboard.NewExchange("test", s.client, mux)
+	exchange.RequireSignedRecords([]switchboard.TrustedKey{
+		{ID: "users-2024", PublicKey: public, Patterns: []string{"/users"}}}, switchboard.RefuseUnverified)
+	c.Assert(exchange.Init(), IsNil)
+	c.Assert(exchange.Services(), DeepEquals, []*switchboard.ServiceRecord{record})
+}
+
 // Register is effectively a no-op if the service record already exists in
 // etcd.
 func (s *ServiceTest) TestRegisterDuplicate(c *C) {
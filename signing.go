@@ -0,0 +1,309 @@
+package switchboard
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SignatureHeader carries the signature of a request proxied by an
+// exchange.  Its value is a comma-separated list of parameters:
+//
+//	key=ID, ts=UNIX-SECONDS, nonce=HEX, headers="NAME NAME", sig=BASE64URL
+//
+// The signature is an HMAC-SHA256, keyed by the secret identified by key,
+// of the canonical form of the request described by RequestSigner.Sign.
+const SignatureHeader = "X-Switchboard-Signature"
+
+// DefaultSignedHeaders are the headers signed when a RequestSigner isn't
+// given a list.  They're the headers services most need to trust.
+var DefaultSignedHeaders = []string{
+	"X-Forwarded-For", RequestIDHeader, AuthMethodHeader, AuthSubjectHeader, AuthScopesHeader}
+
+// DefaultMaxSkew is the difference allowed between the time a request was
+// signed and the time it's verified when SignatureVerifier.MaxSkew isn't
+// set.
+const DefaultMaxSkew = 5 * time.Minute
+
+// SigningKey is a secret shared by exchanges and services, identified by an
+// ID so it can be rotated.
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// RequestSigner signs requests proxied by an exchange.  Install it with
+// ExchangeServeMux.SignRequests.
+type RequestSigner struct {
+	rw      sync.RWMutex // Synchronize access to key.
+	key     SigningKey   // The key used to sign requests.
+	headers []string     // The headers to sign.
+}
+
+// NewRequestSigner creates a signer that signs requests with key, covering
+// headers.  DefaultSignedHeaders are signed if no headers are given.
+func NewRequestSigner(key SigningKey, headers ...string) *RequestSigner {
+	if len(headers) == 0 {
+		headers = DefaultSignedHeaders
+	}
+	canonical := make([]string, 0, len(headers))
+	for _, header := range headers {
+		canonical = append(canonical, strings.ToLower(header))
+	}
+	return &RequestSigner{key: key, headers: canonical}
+}
+
+// Rotate switches to signing with a new key.  Services should accept the
+// new key before the exchange rotates to it, and keep accepting the old key
+// until requests signed with it have drained.
+func (signer *RequestSigner) Rotate(key SigningKey) {
+	signer.rw.Lock()
+	defer signer.rw.Unlock()
+	signer.key = key
+}
+
+// Sign adds a signature to request.  The signature covers the method, the
+// host, the escaped path and query, a timestamp, a random nonce and the
+// signed headers.  Signed headers missing from the request are signed as empty,
+// so they can't be added later.
+func (signer *RequestSigner) Sign(request *http.Request, now time.Time) error {
+	signer.rw.RLock()
+	key := signer.key
+	signer.rw.RUnlock()
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	signature := &requestSignature{
+		keyID:     key.ID,
+		timestamp: now.Unix(),
+		nonce:     hex.EncodeToString(nonce),
+		headers:   signer.headers}
+	signature.value = signature.compute(request, key.Secret)
+	request.Header.Set(SignatureHeader, signature.String())
+	return nil
+}
+
+// SignRequests configures the mux to sign every request it proxies.
+// Requests are signed after all PreProxy hooks have run and the response
+// cache has added validators, so changes they make to signed headers are
+// covered.  A nil signer disables signing.
+func (mux *ExchangeServeMux) SignRequests(signer *RequestSigner) {
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.signer = signer
+}
+
+// Sign signs an outbound request if request signing is enabled.
+func (mux *ExchangeServeMux) sign(outbound *http.Request) error {
+	mux.rw.RLock()
+	signer := mux.signer
+	mux.rw.RUnlock()
+	if signer == nil {
+		return nil
+	}
+	return signer.Sign(outbound, time.Now())
+}
+
+// SignatureVerifier is an http.Handler that services install in front of
+// their handlers to reject requests that weren't signed by an exchange.
+// Unsigned requests, requests with invalid or stale signatures and replayed
+// requests receive 401 Unauthorized.
+type SignatureVerifier struct {
+	// MaxSkew is the difference allowed between the time a request was
+	// signed and the time it's verified.
+	MaxSkew time.Duration
+
+	// RequiredHeaders lists headers that must be covered by the signature.
+	// DefaultSignedHeaders are required if it's nil.
+	RequiredHeaders []string
+
+	handler http.Handler
+	rw      sync.RWMutex         // Synchronize access to keys.
+	keys    map[string][]byte    // Accepted secrets keyed by ID.
+	mutex   sync.Mutex           // Synchronize access to the fields below.
+	nonces  map[string]time.Time // Seen nonces and when they can be forgotten.
+	expiry  []string             // Seen nonces, in the order they can be forgotten.
+	now     func() time.Time
+}
+
+// VerifySignatures wraps handler with a verifier that accepts requests
+// signed with any of keys.
+func VerifySignatures(handler http.Handler, keys ...SigningKey) *SignatureVerifier {
+	verifier := &SignatureVerifier{
+		handler: handler,
+		keys:    make(map[string][]byte),
+		nonces:  make(map[string]time.Time),
+		now:     time.Now}
+	for _, key := range keys {
+		verifier.AddKey(key)
+	}
+	return verifier
+}
+
+// AddKey accepts requests signed with key.
+func (verifier *SignatureVerifier) AddKey(key SigningKey) {
+	verifier.rw.Lock()
+	defer verifier.rw.Unlock()
+	verifier.keys[key.ID] = key.Secret
+}
+
+// RemoveKey stops accepting requests signed with the key identified by id.
+func (verifier *SignatureVerifier) RemoveKey(id string) {
+	verifier.rw.Lock()
+	defer verifier.rw.Unlock()
+	delete(verifier.keys, id)
+}
+
+// ServeHTTP verifies the request's signature and passes it to the wrapped
+// handler if it's valid.
+func (verifier *SignatureVerifier) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if err := verifier.Verify(request); err != nil {
+		http.Error(writer, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	verifier.handler.ServeHTTP(writer, request)
+}
+
+// Verify returns an error if request doesn't carry a valid signature or
+// has been seen before.
+func (verifier *SignatureVerifier) Verify(request *http.Request) error {
+	value := request.Header.Get(SignatureHeader)
+	if value == "" {
+		return errors.New("Request is not signed")
+	}
+	signature, err := parseSignature(value)
+	if err != nil {
+		return err
+	}
+	required := verifier.RequiredHeaders
+	if required == nil {
+		required = DefaultSignedHeaders
+	}
+	for _, header := range required {
+		if !contains(signature.headers, strings.ToLower(header)) {
+			return errors.New("Signature doesn't cover " + header)
+		}
+	}
+
+	verifier.rw.RLock()
+	secret, present := verifier.keys[signature.keyID]
+	verifier.rw.RUnlock()
+	if !present {
+		return errors.New("Unknown signing key " + signature.keyID)
+	}
+	if !hmac.Equal([]byte(signature.compute(request, secret)), []byte(signature.value)) {
+		return errors.New("Invalid signature")
+	}
+
+	maxSkew := verifier.MaxSkew
+	if maxSkew == 0 {
+		maxSkew = DefaultMaxSkew
+	}
+	now := verifier.now()
+	signed := time.Unix(signature.timestamp, 0)
+	if signed.Before(now.Add(-maxSkew)) || signed.After(now.Add(maxSkew)) {
+		return errors.New("Signature has expired")
+	}
+
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+	for len(verifier.expiry) > 0 && now.After(verifier.nonces[verifier.expiry[0]]) {
+		delete(verifier.nonces, verifier.expiry[0])
+		verifier.expiry = verifier.expiry[1:]
+	}
+	if _, seen := verifier.nonces[signature.nonce]; seen {
+		return errors.New("Request has been replayed")
+	}
+	// A signature can be accepted until twice the skew after it's first
+	// seen.  Remembering every nonce for that long, rather than until its
+	// own signature expires, keeps them in the order they can be forgotten.
+	verifier.nonces[signature.nonce] = now.Add(2 * maxSkew)
+	verifier.expiry = append(verifier.expiry, signature.nonce)
+	return nil
+}
+
+// RequestSignature holds the parameters of a signature header.
+type requestSignature struct {
+	keyID     string
+	timestamp int64
+	nonce     string
+	headers   []string
+	value     string
+}
+
+// Compute returns the signature of request's canonical form.  The canonical
+// form is the method, host, escaped path and query, timestamp, nonce and
+// then each signed header as "name:value,value", separated by newlines.
+// The host is included so a request can't be replayed against another
+// service that shares the key.
+func (signature *requestSignature) compute(request *http.Request, secret []byte) string {
+	host := request.Host
+	if host == "" {
+		host = request.URL.Host
+	}
+	var canonical strings.Builder
+	canonical.WriteString(request.Method + "\n")
+	canonical.WriteString(strings.ToLower(host) + "\n")
+	canonical.WriteString(request.URL.EscapedPath())
+	if request.URL.RawQuery != "" {
+		canonical.WriteString("?" + request.URL.RawQuery)
+	}
+	canonical.WriteString("\n" + strconv.FormatInt(signature.timestamp, 10))
+	canonical.WriteString("\n" + signature.nonce)
+	for _, header := range signature.headers {
+		canonical.WriteString("\n" + header + ":" + strings.Join(request.Header.Values(header), ","))
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(canonical.String()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// String formats the signature as a header value.
+func (signature *requestSignature) String() string {
+	return "key=" + signature.keyID +
+		", ts=" + strconv.FormatInt(signature.timestamp, 10) +
+		", nonce=" + signature.nonce +
+		`, headers="` + strings.Join(signature.headers, " ") + `"` +
+		", sig=" + signature.value
+}
+
+// ParseSignature parses a signature header value.
+func parseSignature(value string) (*requestSignature, error) {
+	signature := &requestSignature{}
+	for _, parameter := range strings.Split(value, ",") {
+		name, parameterValue, found := strings.Cut(strings.TrimSpace(parameter), "=")
+		if !found {
+			return nil, errors.New("Malformed signature")
+		}
+		switch name {
+		case "key":
+			signature.keyID = parameterValue
+		case "ts":
+			timestamp, err := strconv.ParseInt(parameterValue, 10, 64)
+			if err != nil {
+				return nil, errors.New("Malformed signature timestamp")
+			}
+			signature.timestamp = timestamp
+		case "nonce":
+			signature.nonce = parameterValue
+		case "headers":
+			signature.headers = strings.Fields(strings.Trim(parameterValue, `"`))
+		case "sig":
+			signature.value = parameterValue
+		}
+	}
+	if signature.keyID == "" || signature.nonce == "" || signature.value == "" {
+		return nil, errors.New("Malformed signature")
+	}
+	return signature, nil
+}
@@ -0,0 +1,199 @@
+package switchboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	. "gopkg.in/check.v1"
+)
+
+type SigningTest struct {
+	key      SigningKey
+	verifier *SignatureVerifier
+	now      time.Time
+}
+
+var _ = Suite(&SigningTest{})
+
+func (s *SigningTest) SetUpTest(c *C) {
+	s.key = SigningKey{ID: "2024-01", Secret: []byte("shared-secret")}
+	s.now = time.Unix(1700000000, 0)
+	s.verifier = VerifySignatures(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte("trusted"))
+		}), s.key)
+	s.verifier.now = func() time.Time { return s.now }
+}
+
+// Request creates a request to be signed, with the default signed headers.
+func (s *SigningTest) request(c *C) *http.Request {
+	request, err := http.NewRequest("POST", "http://service/user/a%2Fb?q=1", nil)
+	c.Assert(err, IsNil)
+	request.Header.Set(AuthSubjectHeader, "jane")
+	request.Header.Set(RequestIDHeader, "abc")
+	return request
+}
+
+// Signed requests are verified and passed to the wrapped handler.
+func (s *SigningTest) TestVerify(c *C) {
+	request := s.request(c)
+	c.Assert(NewRequestSigner(s.key).Sign(request, s.now), IsNil)
+	c.Assert(request.Header.Get(SignatureHeader), Matches,
+		`key=2024-01, ts=1700000000, nonce=[0-9a-f]{32}, headers="x-forwarded-for x-request-id `+
+			`x-auth-method x-auth-subject x-auth-scopes", sig=[A-Za-z0-9_-]+`)
+
+	writer := httptest.NewRecorder()
+	s.verifier.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(writer.Body.String(), Equals, "trusted")
+}
+
+// Unsigned requests and requests changed after they were signed are
+// rejected.
+func (s *SigningTest) TestVerifyRejectsTampering(c *C) {
+	request := s.request(c)
+	writer := httptest.NewRecorder()
+	s.verifier.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusUnauthorized)
+	c.Assert(writer.Body.String(), Equals, "Request is not signed\n")
+
+	signer := NewRequestSigner(s.key)
+	tests := []func(request *http.Request){
+		func(request *http.Request) { request.Header.Set(AuthSubjectHeader, "admin") },
+		func(request *http.Request) { request.Header.Set("X-Forwarded-For", "10.0.0.1") },
+		func(request *http.Request) { request.Method = "DELETE" },
+		func(request *http.Request) { request.URL.RawQuery = "q=2" },
+		func(request *http.Request) { request.URL.RawPath = "/user/a/b"; request.URL.Path = "/user/a/b" },
+	}
+	for i, tamper := range tests {
+		request := s.request(c)
+		c.Assert(signer.Sign(request, s.now), IsNil)
+		tamper(request)
+		c.Assert(s.verifier.Verify(request), ErrorMatches, "Invalid signature", Commentf("test %d", i))
+	}
+}
+
+// Requests signed outside the allowed skew or replayed are rejected.
+func (s *SigningTest) TestVerifyRejectsStaleAndReplayedRequests(c *C) {
+	signer := NewRequestSigner(s.key)
+	request := s.request(c)
+	c.Assert(signer.Sign(request, s.now.Add(-10*time.Minute)), IsNil)
+	c.Assert(s.verifier.Verify(request), ErrorMatches, "Signature has expired")
+
+	request = s.request(c)
+	c.Assert(signer.Sign(request, s.now), IsNil)
+	c.Assert(s.verifier.Verify(request), IsNil)
+	c.Assert(s.verifier.Verify(request), ErrorMatches, "Request has been replayed")
+}
+
+// Nonces are forgotten once their requests can no longer be replayed.
+func (s *SigningTest) TestNoncesExpire(c *C) {
+	signer := NewRequestSigner(s.key)
+	for i := 0; i < 3; i++ {
+		request := s.request(c)
+		c.Assert(signer.Sign(request, s.now), IsNil)
+		c.Assert(s.verifier.Verify(request), IsNil)
+	}
+	c.Assert(s.verifier.nonces, HasLen, 3)
+
+	s.now = s.now.Add(2*DefaultMaxSkew + time.Second)
+	request := s.request(c)
+	c.Assert(signer.Sign(request, s.now), IsNil)
+	c.Assert(s.verifier.Verify(request), IsNil)
+	c.Assert(s.verifier.nonces, HasLen, 1)
+	c.Assert(s.verifier.expiry, HasLen, 1)
+}
+
+// Requests signed for one service are rejected by another service that
+// shares the key.
+func (s *SigningTest) TestVerifyRejectsOtherHosts(c *C) {
+	request := s.request(c)
+	c.Assert(NewRequestSigner(s.key).Sign(request, s.now), IsNil)
+	request.Host = "other-service"
+	c.Assert(s.verifier.Verify(request), ErrorMatches, "Invalid signature")
+	request.Host = "SERVICE"
+	c.Assert(s.verifier.Verify(request), IsNil)
+}
+
+// Verifiers accept any of their keys, so keys can be rotated without
+// rejecting requests.
+func (s *SigningTest) TestKeyRotation(c *C) {
+	next := SigningKey{ID: "2024-02", Secret: []byte("next-secret")}
+	signer := NewRequestSigner(s.key)
+	signer.Rotate(next)
+	request := s.request(c)
+	c.Assert(signer.Sign(request, s.now), IsNil)
+	c.Assert(s.verifier.Verify(request), ErrorMatches, "Unknown signing key 2024-02")
+
+	s.verifier.AddKey(next)
+	c.Assert(s.verifier.Verify(request), IsNil)
+	s.verifier.RemoveKey(s.key.ID)
+	request = s.request(c)
+	c.Assert(NewRequestSigner(s.key).Sign(request, s.now), IsNil)
+	c.Assert(s.verifier.Verify(request), ErrorMatches, "Unknown signing key 2024-01")
+}
+
+// Verifiers require their headers to be covered by the signature.
+func (s *SigningTest) TestRequiredHeaders(c *C) {
+	request := s.request(c)
+	c.Assert(NewRequestSigner(s.key, RequestIDHeader).Sign(request, s.now), IsNil)
+	c.Assert(s.verifier.Verify(request), ErrorMatches, "Signature doesn't cover X-Forwarded-For")
+	s.verifier.RequiredHeaders = []string{RequestIDHeader}
+	c.Assert(s.verifier.Verify(request), IsNil)
+}
+
+// Exchanges sign proxied requests after PreProxy hooks have run, and
+// clients can't forge signatures by sending their own.
+func (s *SigningTest) TestExchangeSignsRequests(c *C) {
+	s.verifier.now = time.Now
+	server := httptest.NewServer(s.verifier)
+	defer server.Close()
+	mux := NewExchangeServeMux()
+	mux.Add("GET", "/users", server.URL)
+	mux.Use(&Middleware{PreProxy: func(writer http.ResponseWriter, request, outbound *http.Request, route *Route) bool {
+		outbound.Header.Set(AuthSubjectHeader, "jane")
+		return true
+	}})
+
+	writer := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://example.com/users", nil)
+	request.Header.Set(SignatureHeader, "key=2024-01, ts=0, nonce=00, headers=\"\", sig=forged")
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusUnauthorized)
+
+	mux.SignRequests(NewRequestSigner(s.key))
+	writer = httptest.NewRecorder()
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(strings.TrimSpace(writer.Body.String()), Equals, "trusted")
+}
+
+// Identity headers sent by clients are never signed, even without the
+// authentication middleware, and the client's address is appended to
+// X-Forwarded-For.
+func (s *SigningTest) TestExchangeDropsForgedIdentity(c *C) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			received = request.Header
+			writer.Write([]byte("trusted"))
+		}))
+	defer server.Close()
+	mux := NewExchangeServeMux()
+	mux.Add("GET", "/users", server.URL)
+	mux.SignRequests(NewRequestSigner(s.key))
+
+	writer := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "http://example.com/users", nil)
+	request.Header.Set(AuthSubjectHeader, "admin")
+	request.Header.Set(AuthScopesHeader, "admin")
+	request.Header.Set("X-Forwarded-For", "10.0.0.1")
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(received.Get(AuthSubjectHeader), Equals, "")
+	c.Assert(received.Get(AuthScopesHeader), Equals, "")
+	c.Assert(received.Get("X-Forwarded-For"), Equals, "10.0.0.1, 192.0.2.1")
+	c.Assert(received.Get(SignatureHeader), Not(Equals), "")
+}
@@ -0,0 +1,175 @@
+package switchboard
+
+import (
+	"bytes"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/template"
+)
+
+// StaticResponse is a response an exchange sends for a route in place of
+// proxying requests to a backend service, so clients can be built against a
+// route before the service that will handle it exists.  It's only used
+// while no backend service address is registered for the route.
+type StaticResponse struct {
+	// Status is the status code of the response, from 200 to 599.  It
+	// defaults to 200 OK.
+	Status int
+
+	// Header holds the response headers.  If it has no Content-Type, the
+	// type is inferred from File's extension or the body's contents.
+	Header http.Header
+
+	// Body is a text/template executed with StaticData to produce the
+	// response body.  For example:
+	//
+	//	{"id": "{{.Params.Get "id"}}", "name": "Example"}
+	Body string
+
+	// File, if set, is the path of a fixture file sent as the response body
+	// in place of Body.  It's read for each request, so it can be edited
+	// while the exchange is running.
+	File string
+}
+
+// StaticData is the data a static response's body template is executed
+// with.
+type StaticData struct {
+	Method    string      // The HTTP method of the request.
+	Path      string      // The URL path of the request.
+	Params    url.Values  // Values captured by placeholders in the route's pattern.
+	Query     url.Values  // The request's query arguments.
+	Header    http.Header // The request's headers.
+	RequestID string      // The ID used to correlate the request.
+}
+
+// StaticResponse holds a static response and its parsed body template.
+type staticResponse struct {
+	config StaticResponse
+	body   *template.Template
+}
+
+// AddStatic registers a static response for an HTTP method and URL pattern,
+// replacing any static response already registered for it.  Requests that
+// match the pattern receive the static response until a backend service
+// address is registered for it.
+func (mux *ExchangeServeMux) AddStatic(method, pattern string, response *StaticResponse) error {
+	if response.Status != 0 && (response.Status < 200 || response.Status > 599) {
+		return errors.New("Static response status must be between 200 and 599")
+	}
+	if response.Body != "" && response.File != "" {
+		return errors.New("Static response can't have both a body and a file")
+	}
+	static := &staticResponse{config: *response}
+	if response.File != "" {
+		if _, err := os.Stat(response.File); err != nil {
+			return err
+		}
+	} else {
+		body, err := template.New(method + " " + pattern).Parse(response.Body)
+		if err != nil {
+			return err
+		}
+		static.body = body
+	}
+	if static.config.Status == 0 {
+		static.config.Status = http.StatusOK
+	}
+	static.config.Header = response.Header.Clone()
+
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	for _, handler := range mux.routes[method] {
+		if handler.pattern == pattern {
+			handler.static = static
+			return nil
+		}
+	}
+	handler := patternHandler{pattern: pattern, addresses: make([]string, 0), static: static}
+	mux.routes[method] = append(mux.routes[method], &handler)
+	return nil
+}
+
+// RemoveStatic unregisters the static response for an HTTP method and URL
+// pattern.  The pattern is removed from the route table if no backend
+// service address is registered for it.
+func (mux *ExchangeServeMux) RemoveStatic(method, pattern string) {
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	handlers := mux.routes[method]
+	for i, handler := range handlers {
+		if handler.pattern == pattern {
+			handler.static = nil
+			if len(handler.addresses) == 0 {
+				mux.routes[method] = append(handlers[:i], handlers[i+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// ServeStatic answers a request for a route with no backend service address
+// using the route's static response.
+func (mux *ExchangeServeMux) serveStatic(writer http.ResponseWriter, request *http.Request, route *Route) {
+	mux.rw.RLock()
+	var static *staticResponse
+	for _, handler := range mux.routes[route.Method] {
+		if handler.pattern == route.Pattern {
+			static = handler.static
+			break
+		}
+	}
+	mux.rw.RUnlock()
+	if static == nil {
+		route.Refusal = errors.New("No matching address")
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	route.Static = true
+	body, err := static.render(request, route)
+	if err != nil {
+		route.Refusal = err
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	for header, values := range static.config.Header {
+		for _, value := range values {
+			writer.Header().Add(header, value)
+		}
+	}
+	if writer.Header().Get("Content-Type") == "" {
+		contentType := mime.TypeByExtension(filepath.Ext(static.config.File))
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		writer.Header().Set("Content-Type", contentType)
+	}
+	writer.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	writer.WriteHeader(static.config.Status)
+	if request.Method != "HEAD" {
+		writer.Write(body)
+	}
+}
+
+// Render returns the response body for a request, read from the fixture
+// file or produced by the body template.
+func (static *staticResponse) render(request *http.Request, route *Route) ([]byte, error) {
+	if static.config.File != "" {
+		return os.ReadFile(static.config.File)
+	}
+	var body bytes.Buffer
+	err := static.body.Execute(&body, &StaticData{
+		Method:    request.Method,
+		Path:      request.URL.Path,
+		Params:    route.Params,
+		Query:     request.URL.Query(),
+		Header:    request.Header,
+		RequestID: route.RequestID})
+	return body.Bytes(), err
+}
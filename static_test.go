@@ -0,0 +1,116 @@
+package switchboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	. "gopkg.in/check.v1"
+)
+
+type StaticTest struct {
+	mux *ExchangeServeMux
+}
+
+var _ = Suite(&StaticTest{})
+
+func (s *StaticTest) SetUpTest(c *C) {
+	s.mux = NewExchangeServeMux()
+}
+
+// Get sends a request through the mux and returns the response and the
+// completed route.
+func (s *StaticTest) get(c *C, method, path string) (*httptest.ResponseRecorder, *Route) {
+	var route *Route
+	s.mux.Use(&Middleware{Complete: func(request *http.Request, completed *Route) { route = completed }})
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest(method, "http://example.com"+path, nil)
+	c.Assert(err, IsNil)
+	request.Header.Set(RequestIDHeader, "request-1")
+	s.mux.ServeHTTP(writer, request)
+	return writer, route
+}
+
+// Routes with a static response answer with its status, headers and
+// rendered body template.
+func (s *StaticTest) TestBodyTemplate(c *C) {
+	c.Assert(s.mux.AddStatic("GET", "/user/:id", &StaticResponse{
+		Status: http.StatusCreated,
+		Header: http.Header{"Content-Type": []string{"application/json"}},
+		Body:   `{"id": "{{.Params.Get "id"}}", "fields": "{{.Query.Get "fields"}}", "request": "{{.RequestID}}"}`}),
+		IsNil)
+	writer, route := s.get(c, "GET", "/user/123?fields=name")
+	c.Assert(writer.Code, Equals, http.StatusCreated)
+	c.Assert(writer.Header().Get("Content-Type"), Equals, "application/json")
+	c.Assert(writer.Body.String(), Equals, `{"id": "123", "fields": "name", "request": "request-1"}`)
+	c.Assert(route.Static, Equals, true)
+	c.Assert(route.Pattern, Equals, "/user/:id")
+
+	writer, _ = s.get(c, "HEAD", "/user/123")
+	c.Assert(writer.Code, Equals, http.StatusNotFound)
+}
+
+// Routes can be backed by a fixture file, read for each request, whose
+// content type is inferred from its extension.
+func (s *StaticTest) TestFile(c *C) {
+	path := filepath.Join(c.MkDir(), "users.json")
+	c.Assert(os.WriteFile(path, []byte(`[{"id": "123"}]`), 0644), IsNil)
+	c.Assert(s.mux.AddStatic("GET", "/users", &StaticResponse{File: path}), IsNil)
+	writer, _ := s.get(c, "GET", "/users")
+	c.Assert(writer.Code, Equals, http.StatusOK)
+	c.Assert(writer.Header().Get("Content-Type"), Equals, "application/json")
+	c.Assert(writer.Body.String(), Equals, `[{"id": "123"}]`)
+
+	c.Assert(os.WriteFile(path, []byte(`[]`), 0644), IsNil)
+	writer, _ = s.get(c, "GET", "/users")
+	c.Assert(writer.Body.String(), Equals, `[]`)
+
+	c.Assert(os.Remove(path), IsNil)
+	writer, route := s.get(c, "GET", "/users")
+	c.Assert(writer.Code, Equals, http.StatusInternalServerError)
+	c.Assert(route.Refusal, NotNil)
+}
+
+// Backend services registered for the route take over from its static
+// response, which is used again once they're gone.
+func (s *StaticTest) TestService(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(writer http.ResponseWriter, request *http.Request) {
+			writer.Write([]byte("service"))
+		}))
+	defer server.Close()
+	c.Assert(s.mux.AddStatic("GET", "/user/:id", &StaticResponse{Body: "static"}), IsNil)
+	s.mux.Add("GET", "/user/:id", server.URL)
+	writer, route := s.get(c, "GET", "/user/123")
+	c.Assert(writer.Body.String(), Equals, "service")
+	c.Assert(route.Static, Equals, false)
+
+	s.mux.Remove("GET", "/user/:id", server.URL)
+	writer, _ = s.get(c, "GET", "/user/123")
+	c.Assert(writer.Body.String(), Equals, "static")
+	c.Assert(writer.Header().Get("Content-Type"), Equals, "text/plain; charset=utf-8")
+	c.Assert(s.mux.RouteTable(), DeepEquals, []RouteState{{Method: "GET", Pattern: "/user/:id", Static: true}})
+	_, err := s.mux.Match("GET", "/user/:id")
+	c.Assert(err, ErrorMatches, "No matching address")
+	c.Assert(s.mux.Explain("GET", "", "/user/123", nil).Decision, Equals,
+		"Selected /user/:id; no addresses are registered, so its static response is sent")
+
+	s.mux.RemoveStatic("GET", "/user/:id")
+	writer, _ = s.get(c, "GET", "/user/123")
+	c.Assert(writer.Code, Equals, http.StatusNotFound)
+	c.Assert(s.mux.RouteTable(), HasLen, 0)
+}
+
+// Invalid static responses are rejected.
+func (s *StaticTest) TestInvalid(c *C) {
+	c.Assert(s.mux.AddStatic("GET", "/user", &StaticResponse{Status: 1000}), ErrorMatches,
+		"Static response status must be between 200 and 599")
+	c.Assert(s.mux.AddStatic("GET", "/user", &StaticResponse{Status: http.StatusSwitchingProtocols}), ErrorMatches,
+		"Static response status must be between 200 and 599")
+	c.Assert(s.mux.AddStatic("GET", "/user", &StaticResponse{Body: "{}", File: "user.json"}), ErrorMatches,
+		"Static response can't have both a body and a file")
+	c.Assert(s.mux.AddStatic("GET", "/user", &StaticResponse{Body: "{{.Missing"}), NotNil)
+	c.Assert(s.mux.AddStatic("GET", "/user", &StaticResponse{File: "missing.json"}), NotNil)
+	c.Assert(s.mux.RouteTable(), HasLen, 0)
+}
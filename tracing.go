@@ -0,0 +1,235 @@
+package switchboard
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers used to propagate W3C Trace Context.
+const (
+	TraceParentHeader = "Traceparent"
+	TraceStateHeader  = "Tracestate"
+)
+
+// TraceContext identifies a span within a distributed trace.
+type TraceContext struct {
+	TraceID string // 32 lowercase hex characters.
+	SpanID  string // 16 lowercase hex characters.
+	Sampled bool   // True if the caller is recording the trace.
+	State   string // Vendor-specific trace state, passed through unchanged.
+}
+
+// Propagator reads and writes trace context in HTTP headers.
+type Propagator interface {
+	// Extract returns the trace context carried by headers.  An error is
+	// returned if headers don't carry a valid trace context.
+	Extract(header http.Header) (*TraceContext, error)
+
+	// Inject writes a trace context to headers.
+	Inject(context *TraceContext, header http.Header)
+}
+
+// TraceContextPropagator propagates trace context using the traceparent and
+// tracestate headers defined by the W3C Trace Context specification.
+type TraceContextPropagator struct{}
+
+// Extract parses the traceparent and tracestate headers.
+func (propagator TraceContextPropagator) Extract(header http.Header) (*TraceContext, error) {
+	parts := strings.Split(strings.TrimSpace(header.Get(TraceParentHeader)), "-")
+	if len(parts) < 4 {
+		return nil, errors.New("Malformed traceparent header")
+	}
+	version, traceID, spanID, flags := parts[0], parts[1], parts[2], parts[3]
+	// Version 00 has exactly four fields, later versions may add more.
+	if !isHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return nil, errors.New("Unsupported traceparent version")
+	}
+	if !isHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return nil, errors.New("Invalid trace ID")
+	}
+	if !isHex(spanID, 16) || spanID == strings.Repeat("0", 16) {
+		return nil, errors.New("Invalid parent ID")
+	}
+	if !isHex(flags, 2) {
+		return nil, errors.New("Invalid trace flags")
+	}
+	bits, _ := strconv.ParseUint(flags, 16, 8)
+	return &TraceContext{
+		TraceID: traceID,
+		SpanID:  spanID,
+		Sampled: bits&1 == 1,
+		State:   strings.Join(header.Values(TraceStateHeader), ",")}, nil
+}
+
+// Inject writes the traceparent and tracestate headers.
+func (propagator TraceContextPropagator) Inject(context *TraceContext, header http.Header) {
+	flags := "00"
+	if context.Sampled {
+		flags = "01"
+	}
+	header.Set(TraceParentHeader, "00-"+context.TraceID+"-"+context.SpanID+"-"+flags)
+	header.Del(TraceStateHeader)
+	if context.State != "" {
+		header.Set(TraceStateHeader, context.State)
+	}
+}
+
+// Span records the work done by the exchange to handle a single request,
+// from matching it against registered patterns to relaying the backend
+// service's response.
+type Span struct {
+	TraceID      string            `json:"trace_id"`
+	SpanID       string            `json:"span_id"`
+	ParentSpanID string            `json:"parent_span_id,omitempty"`
+	Name         string            `json:"name"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes"`
+	Events       []SpanEvent       `json:"events,omitempty"`
+	sampled      bool              // False if the caller isn't recording the trace.
+}
+
+// SpanEvent marks the time a stage of the request completed.
+type SpanEvent struct {
+	Name string    `json:"name"`
+	Time time.Time `json:"time"`
+}
+
+// AddEvent records an event in the span.
+func (span *Span) AddEvent(name string) {
+	span.Events = append(span.Events, SpanEvent{Name: name, Time: time.Now()})
+}
+
+// SpanExporter receives spans when they finish.
+type SpanExporter interface {
+	ExportSpan(span *Span) error
+}
+
+// JSONSpanExporter writes spans to an io.Writer as JSON, one per line.  It's
+// intended for local testing.
+type JSONSpanExporter struct {
+	mutex   sync.Mutex // Serialize writes to writer.
+	encoder *json.Encoder
+}
+
+// NewJSONSpanExporter creates an exporter that writes spans to writer.
+// Pass os.Stdout to print spans to the console.
+func NewJSONSpanExporter(writer io.Writer) *JSONSpanExporter {
+	return &JSONSpanExporter{encoder: json.NewEncoder(writer)}
+}
+
+// ExportSpan writes span as a line of JSON.
+func (exporter *JSONSpanExporter) ExportSpan(span *Span) error {
+	exporter.mutex.Lock()
+	defer exporter.mutex.Unlock()
+	return exporter.encoder.Encode(span)
+}
+
+// Tracing returns middleware that records a span for each request and sends
+// it to exporter when the request completes.  Trace context received from
+// clients is continued and trace context is propagated to backend services.
+// Spans for traces the client isn't sampling are propagated but not exported.
+// Install it with Use before other middleware so the span covers them.
+func Tracing(exporter SpanExporter, propagator Propagator) *Middleware {
+	return &Middleware{
+		PreMatch: func(writer http.ResponseWriter, request *http.Request, route *Route) bool {
+			span := &Span{
+				SpanID:  randomHex(8),
+				Name:    request.Method,
+				Start:   route.Start,
+				sampled: true,
+				Attributes: map[string]string{
+					"http.method":            request.Method,
+					"http.target":            request.URL.RequestURI(),
+					"switchboard.request_id": route.RequestID}}
+			if parent, err := propagator.Extract(request.Header); err == nil {
+				span.TraceID = parent.TraceID
+				span.ParentSpanID = parent.SpanID
+				span.sampled = parent.Sampled
+				if parent.State != "" {
+					span.Attributes["tracestate"] = parent.State
+				}
+			} else {
+				span.TraceID = randomHex(16)
+			}
+			route.Span = span
+			return true
+		},
+		PostMatch: func(writer http.ResponseWriter, request *http.Request, route *Route) bool {
+			if route.Span == nil {
+				return true
+			}
+			route.Span.Name = request.Method + " " + route.Pattern
+			route.Span.Attributes["switchboard.pattern"] = route.Pattern
+			route.Span.Attributes["service.address"] = route.Address
+			if route.Service != nil {
+				route.Span.Attributes["service.id"] = route.Service.ID
+				route.Span.Attributes["service.name"] = route.Service.LogicalName()
+				if route.Service.Version != "" {
+					route.Span.Attributes["service.version"] = route.Service.Version
+				}
+			}
+			route.Span.AddEvent("matched")
+			return true
+		},
+		PreProxy: func(writer http.ResponseWriter, request *http.Request, outbound *http.Request, route *Route) bool {
+			if route.Span == nil {
+				return true
+			}
+			propagator.Inject(&TraceContext{
+				TraceID: route.Span.TraceID,
+				SpanID:  route.Span.SpanID,
+				Sampled: route.Span.sampled,
+				State:   route.Span.Attributes["tracestate"]}, outbound.Header)
+			route.Span.AddEvent("upstream.request")
+			return true
+		},
+		PostProxy: func(writer http.ResponseWriter, request *http.Request, response *http.Response, route *Route) bool {
+			if route.Span != nil {
+				route.Span.AddEvent("upstream.response")
+			}
+			return true
+		},
+		Complete: func(request *http.Request, route *Route) {
+			if route.Span == nil || !route.Span.sampled {
+				return
+			}
+			route.Span.End = time.Now()
+			route.Span.Attributes["http.status_code"] = strconv.Itoa(route.Status)
+			if route.Err != nil {
+				route.Span.Attributes["error"] = route.Err.Error()
+			} else if route.Refusal != nil {
+				route.Span.Attributes["error"] = route.Refusal.Error()
+			}
+			// Export errors are ignored so tracing never fails a request.
+			exporter.ExportSpan(route.Span)
+		}}
+}
+
+// RandomHex returns n random bytes encoded as lowercase hex.
+func randomHex(n int) string {
+	data := make([]byte, n)
+	rand.Read(data)
+	return hex.EncodeToString(data)
+}
+
+// IsHex returns true if text is length lowercase hex characters.
+func isHex(text string, length int) bool {
+	if len(text) != length {
+		return false
+	}
+	for _, char := range text {
+		if !(char >= '0' && char <= '9') && !(char >= 'a' && char <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package switchboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	. "gopkg.in/check.v1"
+)
+
+type TraceContextPropagatorTest struct{}
+
+var _ = Suite(&TraceContextPropagatorTest{})
+
+// Extract parses a version 00 traceparent header and the tracestate header.
+func (s *TraceContextPropagatorTest) TestExtract(c *C) {
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	header.Add("tracestate", "congo=t61rcWkgMzE")
+	header.Add("tracestate", "rojo=00f067aa0ba902b7")
+	context, err := TraceContextPropagator{}.Extract(header)
+	c.Assert(err, IsNil)
+	c.Assert(context, DeepEquals, &TraceContext{
+		TraceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:  "00f067aa0ba902b7",
+		Sampled: true,
+		State:   "congo=t61rcWkgMzE,rojo=00f067aa0ba902b7"})
+}
+
+// Extract returns an error for malformed and invalid traceparent headers.
+func (s *TraceContextPropagatorTest) TestExtractInvalid(c *C) {
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"} {
+		header := http.Header{}
+		header.Set("traceparent", value)
+		_, err := TraceContextPropagator{}.Extract(header)
+		c.Assert(err, NotNil, Commentf("traceparent %q", value))
+	}
+}
+
+// Inject writes traceparent and tracestate headers.
+func (s *TraceContextPropagatorTest) TestInject(c *C) {
+	header := http.Header{}
+	TraceContextPropagator{}.Inject(&TraceContext{
+		TraceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanID:  "00f067aa0ba902b7",
+		State:   "congo=t61rcWkgMzE"}, header)
+	c.Assert(header.Get("traceparent"), Equals, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	c.Assert(header.Get("tracestate"), Equals, "congo=t61rcWkgMzE")
+}
+
+type TracingTest struct{}
+
+var _ = Suite(&TracingTest{})
+
+// Tracing continues the client's trace, propagates it to the backend service
+// and exports a span describing the request.
+func (s *TracingTest) TestTracing(c *C) {
+	var traceparent string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get("traceparent")
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://example.com/user/1", nil)
+	c.Assert(err, IsNil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	request.Header.Set("X-Request-ID", "request-id")
+
+	output := &bytes.Buffer{}
+	mux := NewExchangeServeMux()
+	mux.Use(Tracing(NewJSONSpanExporter(output), TraceContextPropagator{}))
+	mux.AddService(&ServiceRecord{
+		ID:      "users",
+		Address: server.URL,
+		Routes:  Routes{"GET": []string{"/user/:id"}}})
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusOK)
+
+	var span Span
+	err = json.Unmarshal(output.Bytes(), &span)
+	c.Assert(err, IsNil)
+	c.Assert(span.TraceID, Equals, "4bf92f3577b34da6a3ce929d0e0e4736")
+	c.Assert(span.ParentSpanID, Equals, "00f067aa0ba902b7")
+	c.Assert(span.Name, Equals, "GET /user/:id")
+	c.Assert(span.Attributes, DeepEquals, map[string]string{
+		"http.method":            "GET",
+		"http.target":            "/user/1",
+		"http.status_code":       "200",
+		"switchboard.request_id": "request-id",
+		"switchboard.pattern":    "/user/:id",
+		"service.id":             "users",
+		"service.name":           "users",
+		"service.address":        server.URL})
+	c.Assert(len(span.Events), Equals, 3)
+	c.Assert(traceparent, Equals, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+span.SpanID+"-01")
+}
+
+// Tracing starts a new trace when the client doesn't send trace context and
+// exports spans for requests that don't match a route.
+func (s *TracingTest) TestTracingNewTrace(c *C) {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://example.com/unknown", nil)
+	c.Assert(err, IsNil)
+
+	output := &bytes.Buffer{}
+	mux := NewExchangeServeMux()
+	mux.Use(Tracing(NewJSONSpanExporter(output), TraceContextPropagator{}))
+	mux.ServeHTTP(writer, request)
+	c.Assert(writer.Code, Equals, http.StatusNotFound)
+
+	var span Span
+	err = json.Unmarshal(output.Bytes(), &span)
+	c.Assert(err, IsNil)
+	c.Assert(span.TraceID, Matches, "[0-9a-f]{32}")
+	c.Assert(span.ParentSpanID, Equals, "")
+	c.Assert(span.Attributes["http.status_code"], Equals, "404")
+}
+
+// Tracing doesn't export spans for traces the client isn't sampling.
+func (s *TracingTest) TestTracingUnsampled(c *C) {
+	writer := httptest.NewRecorder()
+	request, err := http.NewRequest("GET", "http://example.com/unknown", nil)
+	c.Assert(err, IsNil)
+	request.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	output := &bytes.Buffer{}
+	mux := NewExchangeServeMux()
+	mux.Use(Tracing(NewJSONSpanExporter(output), TraceContextPropagator{}))
+	mux.ServeHTTP(writer, request)
+	c.Assert(output.Len(), Equals, 0)
+}
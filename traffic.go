@@ -0,0 +1,247 @@
+package switchboard
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+// PoliciesDirectory is the directory, within an exchange's etcd namespace,
+// that holds traffic policies.
+const PoliciesDirectory = "_policies"
+
+// TrafficPolicy controls how requests for a logical service are split
+// between the versions of the service that are registered.  Matches are
+// evaluated first, in order, and the first one that matches the request
+// selects a version.  Requests that don't match are split between versions
+// by weight.  Instances of versions the policy doesn't mention only receive
+// requests if no instance of the selected version is registered.
+type TrafficPolicy struct {
+	Service string         `json:"service"`
+	Matches []VersionMatch `json:"matches,omitempty"`
+	Splits  []VersionSplit `json:"splits,omitempty"`
+}
+
+// VersionMatch routes requests that carry a header or cookie to a version.
+// Exactly one of Header and Cookie should be set.  An empty Value matches
+// any request that carries the header or cookie.
+type VersionMatch struct {
+	Header  string `json:"header,omitempty"`
+	Cookie  string `json:"cookie,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Version string `json:"version"`
+}
+
+// VersionSplit sends a share of requests to a version.  Weights are
+// relative, so splits with weights of 90 and 10 send 90% and 10% of
+// requests to each version.
+type VersionSplit struct {
+	Version string `json:"version"`
+	Weight  int    `json:"weight"`
+}
+
+// Validate returns an error if the policy can't be applied.
+func (policy *TrafficPolicy) Validate() error {
+	if policy.Service == "" {
+		return errors.New("Traffic policy has no service name")
+	}
+	for _, match := range policy.Matches {
+		if (match.Header == "") == (match.Cookie == "") {
+			return errors.New("Version match needs exactly one of header or cookie")
+		}
+	}
+	total := 0
+	for _, split := range policy.Splits {
+		if split.Weight < 0 {
+			return errors.New("Version split has a negative weight")
+		}
+		total += split.Weight
+	}
+	if len(policy.Splits) > 0 && total == 0 {
+		return errors.New("Version splits have no weight")
+	}
+	return nil
+}
+
+// Match returns the version selected by the first match for request, or
+// false if no match applies.
+func (policy *TrafficPolicy) Match(request *http.Request) (string, bool) {
+	for _, match := range policy.Matches {
+		var value string
+		var present bool
+		if match.Header != "" {
+			values := request.Header.Values(match.Header)
+			present = len(values) > 0
+			if present {
+				value = values[0]
+			}
+		} else if cookie, err := request.Cookie(match.Cookie); err == nil {
+			value, present = cookie.Value, true
+		}
+		if present && (match.Value == "" || match.Value == value) {
+			return match.Version, true
+		}
+	}
+	return "", false
+}
+
+// Split chooses a version at random according to the policy's weights.  An
+// empty string is returned if the policy has no splits.
+func (policy *TrafficPolicy) Split() string {
+	total := 0
+	for _, split := range policy.Splits {
+		total += split.Weight
+	}
+	if total == 0 {
+		return ""
+	}
+	choice := rand.Intn(total)
+	for _, split := range policy.Splits {
+		if choice < split.Weight {
+			return split.Version
+		}
+		choice -= split.Weight
+	}
+	return ""
+}
+
+// Describe summarizes the policy's weighted splits, such as "v1 90%, v2 10%".
+func (policy *TrafficPolicy) describe() string {
+	total := 0
+	for _, split := range policy.Splits {
+		total += split.Weight
+	}
+	descriptions := make([]string, 0, len(policy.Splits))
+	for _, split := range policy.Splits {
+		percent := float64(split.Weight) * 100 / float64(total)
+		descriptions = append(descriptions,
+			split.Version+" "+strconv.FormatFloat(percent, 'f', -1, 64)+"%")
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// SetTrafficPolicy installs a traffic policy, replacing any existing policy
+// for the same logical service.
+func (mux *ExchangeServeMux) SetTrafficPolicy(policy *TrafficPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	mux.policies[policy.Service] = policy
+	return nil
+}
+
+// RemoveTrafficPolicy removes the traffic policy for a logical service.
+func (mux *ExchangeServeMux) RemoveTrafficPolicy(service string) {
+	mux.rw.Lock()
+	defer mux.rw.Unlock()
+	delete(mux.policies, service)
+}
+
+// TrafficPolicies returns the installed traffic policies, sorted by service
+// name.
+func (mux *ExchangeServeMux) TrafficPolicies() []*TrafficPolicy {
+	mux.rw.RLock()
+	defer mux.rw.RUnlock()
+	policies := make([]*TrafficPolicy, 0, len(mux.policies))
+	for _, policy := range mux.policies {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Service < policies[j].Service })
+	return policies
+}
+
+// Eligible returns the addresses a request may be sent to, after applying
+// traffic policies to the addresses of each logical service.  version is
+// called to choose the version for a policy and returns false to leave the
+// service's addresses unfiltered.  The caller must hold the read lock.
+func (mux *ExchangeServeMux) eligible(addresses []string, version func(policy *TrafficPolicy) (string, bool)) []string {
+	if len(mux.policies) == 0 {
+		return addresses
+	}
+
+	// Group addresses by logical service, preserving their order.
+	names := make([]string, 0)
+	groups := make(map[string][]string)
+	for _, address := range addresses {
+		name := ""
+		if service, present := mux.services[address]; present {
+			name = service.LogicalName()
+		}
+		if _, present := groups[name]; !present {
+			names = append(names, name)
+		}
+		groups[name] = append(groups[name], address)
+	}
+
+	eligible := make([]string, 0, len(addresses))
+	for _, name := range names {
+		group := groups[name]
+		policy, present := mux.policies[name]
+		if !present || name == "" {
+			eligible = append(eligible, group...)
+			continue
+		}
+		selected := make([]string, 0, len(group))
+		if chosen, ok := version(policy); ok {
+			for _, address := range group {
+				if mux.services[address].Version == chosen {
+					selected = append(selected, address)
+				}
+			}
+		}
+		if len(selected) == 0 {
+			selected = group
+		}
+		eligible = append(eligible, selected...)
+	}
+	return eligible
+}
+
+// Choose selects the address to proxy a request to from those registered
+// with a pattern handler, or returns an empty string if the handler only
+// has a static response.  The caller must hold the read lock.
+func (mux *ExchangeServeMux) choose(handler *patternHandler, request *http.Request) string {
+	addresses := mux.eligible(handler.addresses, func(policy *TrafficPolicy) (string, bool) {
+		if version, matched := policy.Match(request); matched {
+			return version, true
+		}
+		version := policy.Split()
+		return version, version != ""
+	})
+	if len(addresses) == 0 {
+		return ""
+	}
+	return addresses[rand.Intn(len(addresses))]
+}
+
+// PublishTrafficPolicy stores a traffic policy in etcd, where exchanges
+// watching namespace will pick it up.
+func PublishTrafficPolicy(namespace string, client *etcd.Client, policy *TrafficPolicy) error {
+	if err := policy.Validate(); err != nil {
+		return err
+	}
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	key := namespace + "/" + PoliciesDirectory + "/" + policy.Service
+	_, err = client.Set(key, string(policyJSON), 0)
+	return err
+}
+
+// WithdrawTrafficPolicy deletes the traffic policy for a logical service
+// from etcd.
+func WithdrawTrafficPolicy(namespace string, client *etcd.Client, service string) error {
+	key := namespace + "/" + PoliciesDirectory + "/" + service
+	recursive := false
+	_, err := client.Delete(key, recursive)
+	return err
+}
@@ -0,0 +1,219 @@
+package switchboard
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-etcd/etcd"
+	. "gopkg.in/check.v1"
+)
+
+type TrafficTest struct {
+	mux *ExchangeServeMux
+}
+
+var _ = Suite(&TrafficTest{})
+
+func (s *TrafficTest) SetUpTest(c *C) {
+	s.mux = NewExchangeServeMux()
+	s.mux.AddService(&ServiceRecord{
+		ID:      "users-v1",
+		Name:    "users",
+		Version: "v1",
+		Address: "http://localhost:8080",
+		Routes:  Routes{"GET": []string{"/users"}}})
+	s.mux.AddService(&ServiceRecord{
+		ID:      "users-v2",
+		Name:    "users",
+		Version: "v2",
+		Address: "http://localhost:9090",
+		Routes:  Routes{"GET": []string{"/users"}}})
+}
+
+// Choose picks an address for a GET /users request.
+func (s *TrafficTest) choose(c *C, request *http.Request) string {
+	route := &Route{Method: "GET", Path: "/users"}
+	_, err := s.mux.selectRoute(route, request)
+	c.Assert(err, IsNil)
+	return route.Address
+}
+
+// Validate rejects policies without a service name, matches without exactly
+// one of a header or cookie, and splits without a positive total weight.
+func (s *TrafficTest) TestValidate(c *C) {
+	policy := &TrafficPolicy{}
+	c.Assert(policy.Validate(), ErrorMatches, "Traffic policy has no service name")
+	policy = &TrafficPolicy{Service: "users", Matches: []VersionMatch{{Version: "v2"}}}
+	c.Assert(policy.Validate(), ErrorMatches, "Version match needs exactly one of header or cookie")
+	policy = &TrafficPolicy{Service: "users", Splits: []VersionSplit{{"v1", -1}, {"v2", 2}}}
+	c.Assert(policy.Validate(), ErrorMatches, "Version split has a negative weight")
+	policy = &TrafficPolicy{Service: "users", Splits: []VersionSplit{{"v1", 0}}}
+	c.Assert(policy.Validate(), ErrorMatches, "Version splits have no weight")
+	c.Assert(s.mux.SetTrafficPolicy(policy), NotNil)
+	c.Assert(s.mux.TrafficPolicies(), HasLen, 0)
+}
+
+// Match selects the version of the first match satisfied by a request's
+// headers or cookies.  An empty value only requires the header or cookie to
+// be present.
+func (s *TrafficTest) TestMatch(c *C) {
+	policy := &TrafficPolicy{
+		Service: "users",
+		Matches: []VersionMatch{
+			{Header: "X-Canary", Value: "true", Version: "v2"},
+			{Cookie: "beta", Version: "v3"}}}
+	request, _ := http.NewRequest("GET", "/users", nil)
+	_, matched := policy.Match(request)
+	c.Assert(matched, Equals, false)
+
+	request.Header.Set("X-Canary", "false")
+	_, matched = policy.Match(request)
+	c.Assert(matched, Equals, false)
+
+	request.AddCookie(&http.Cookie{Name: "beta", Value: "yes"})
+	version, matched := policy.Match(request)
+	c.Assert(matched, Equals, true)
+	c.Assert(version, Equals, "v3")
+
+	request.Header.Set("X-Canary", "true")
+	version, matched = policy.Match(request)
+	c.Assert(matched, Equals, true)
+	c.Assert(version, Equals, "v2")
+}
+
+// Without a policy, requests are spread across every registered address.
+func (s *TrafficTest) TestChooseWithoutPolicy(c *C) {
+	request, _ := http.NewRequest("GET", "/users", nil)
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		seen[s.choose(c, request)] = true
+	}
+	c.Assert(seen, DeepEquals, map[string]bool{
+		"http://localhost:8080": true, "http://localhost:9090": true})
+}
+
+// Requests are split between versions according to the policy's weights.
+func (s *TrafficTest) TestChooseSplitsByWeight(c *C) {
+	policy := &TrafficPolicy{
+		Service: "users",
+		Splits:  []VersionSplit{{"v1", 100}, {"v2", 0}}}
+	c.Assert(s.mux.SetTrafficPolicy(policy), IsNil)
+	request, _ := http.NewRequest("GET", "/users", nil)
+	for i := 0; i < 100; i++ {
+		c.Assert(s.choose(c, request), Equals, "http://localhost:8080")
+	}
+
+	policy = &TrafficPolicy{
+		Service: "users",
+		Splits:  []VersionSplit{{"v1", 75}, {"v2", 25}}}
+	c.Assert(s.mux.SetTrafficPolicy(policy), IsNil)
+	counts := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		counts[s.choose(c, request)]++
+	}
+	c.Assert(counts["http://localhost:8080"] > 1300, Equals, true)
+	c.Assert(counts["http://localhost:9090"] > 350, Equals, true)
+}
+
+// A header match takes precedence over weighted splits.
+func (s *TrafficTest) TestChooseMatchesHeader(c *C) {
+	policy := &TrafficPolicy{
+		Service: "users",
+		Matches: []VersionMatch{{Header: "X-Canary", Version: "v2"}},
+		Splits:  []VersionSplit{{"v1", 1}}}
+	c.Assert(s.mux.SetTrafficPolicy(policy), IsNil)
+	request, _ := http.NewRequest("GET", "/users", nil)
+	c.Assert(s.choose(c, request), Equals, "http://localhost:8080")
+	request.Header.Set("X-Canary", "1")
+	for i := 0; i < 50; i++ {
+		c.Assert(s.choose(c, request), Equals, "http://localhost:9090")
+	}
+}
+
+// When no instance of the selected version is registered, requests are
+// spread across every instance of the service.
+func (s *TrafficTest) TestChooseFallsBackWhenVersionMissing(c *C) {
+	policy := &TrafficPolicy{
+		Service: "users",
+		Splits:  []VersionSplit{{"v3", 1}}}
+	c.Assert(s.mux.SetTrafficPolicy(policy), IsNil)
+	request, _ := http.NewRequest("GET", "/users", nil)
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		seen[s.choose(c, request)] = true
+	}
+	c.Assert(seen, HasLen, 2)
+}
+
+// RemoveTrafficPolicy restores random selection between instances.
+func (s *TrafficTest) TestRemoveTrafficPolicy(c *C) {
+	policy := &TrafficPolicy{Service: "users", Splits: []VersionSplit{{"v1", 1}}}
+	c.Assert(s.mux.SetTrafficPolicy(policy), IsNil)
+	c.Assert(s.mux.TrafficPolicies(), DeepEquals, []*TrafficPolicy{policy})
+	s.mux.RemoveTrafficPolicy("users")
+	c.Assert(s.mux.TrafficPolicies(), HasLen, 0)
+}
+
+// Explain applies header matches and describes weighted splits.
+func (s *TrafficTest) TestExplain(c *C) {
+	policy := &TrafficPolicy{
+		Service: "users",
+		Matches: []VersionMatch{{Header: "X-Canary", Version: "v2"}},
+		Splits:  []VersionSplit{{"v1", 90}, {"v2", 10}}}
+	c.Assert(s.mux.SetTrafficPolicy(policy), IsNil)
+
+	explanation := s.mux.Explain("GET", "", "/users", http.Header{})
+	c.Assert(explanation.Addresses, DeepEquals,
+		[]string{"http://localhost:8080", "http://localhost:9090"})
+	c.Assert(explanation.Decision, Equals, "Selected /users; one of its 2 addresses is chosen "+
+		"at random; users requests are split between versions (v1 90%, v2 10%)")
+
+	explanation = s.mux.Explain("GET", "", "/users", http.Header{"X-Canary": {"1"}})
+	c.Assert(explanation.Addresses, DeepEquals, []string{"http://localhost:9090"})
+	c.Assert(explanation.Decision, Equals, "Selected /users; one of its 1 address is chosen "+
+		"at random; users requests are sent to version v2 by header or cookie match")
+}
+
+// Exchanges load traffic policies from etcd when they start and pick up
+// changes to them while watching.
+func (s *TrafficTest) TestExchangeWatchesPolicies(c *C) {
+	client := etcd.NewClient([]string{"http://127.0.0.1:4001"})
+	client.Delete("traffic", true)
+	policy := &TrafficPolicy{Service: "users", Splits: []VersionSplit{{"v1", 1}}}
+	c.Assert(PublishTrafficPolicy("traffic", client, policy), IsNil)
+
+	mux := NewExchangeServeMux()
+	exchange := NewExchange("traffic", client, mux)
+	c.Assert(exchange.Init(), IsNil)
+	c.Assert(mux.TrafficPolicies(), DeepEquals, []*TrafficPolicy{policy})
+
+	stop := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		exchange.Watch(stop)
+		stopped <- true
+	}()
+	defer func() {
+		stop <- true
+		c.Assert(<-stopped, Equals, true)
+	}()
+
+	// Janky logic to wait for updates from etcd will fail when updates don't
+	// propagate within 500ms.
+	wait := func(expected int) bool {
+		for i := 0; i < 500; i++ {
+			policies := mux.TrafficPolicies()
+			if len(policies) == expected && (expected == 0 || len(policies[0].Splits) == 2) {
+				return true
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return false
+	}
+
+	policy = &TrafficPolicy{Service: "users", Splits: []VersionSplit{{"v1", 1}, {"v2", 1}}}
+	c.Assert(PublishTrafficPolicy("traffic", client, policy), IsNil)
+	c.Assert(wait(1), Equals, true)
+	c.Assert(WithdrawTrafficPolicy("traffic", client, "users"), IsNil)
+	c.Assert(wait(0), Equals, true)
+}
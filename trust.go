@@ -0,0 +1,175 @@
+package switchboard
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// RecordSignature is an ed25519 signature of a service record, made by the
+// service that registered it.
+type RecordSignature struct {
+	KeyID string `json:"key_id"`
+	Value string `json:"value"` // Base64-encoded signature.
+}
+
+// TrustedKey is a public key exchanges accept service record signatures
+// from.  Patterns lists the URL patterns records signed with the key may
+// claim, after their mount prefix is applied.  A pattern ending in * allows
+// any pattern that starts with the text before it.
+type TrustedKey struct {
+	ID        string
+	PublicKey ed25519.PublicKey
+	Patterns  []string
+}
+
+// UnverifiedPolicy controls what an Exchange does with service records that
+// fail verification.
+type UnverifiedPolicy int
+
+const (
+	// RefuseUnverified ignores records that fail verification.
+	RefuseUnverified UnverifiedPolicy = iota
+
+	// QuarantineUnverified holds records that fail verification without
+	// routing requests to them, so operators can inspect them.
+	QuarantineUnverified
+)
+
+// QuarantinedRecord is a service record that failed verification.
+type QuarantinedRecord struct {
+	Record *ServiceRecord `json:"record"`
+	Reason string         `json:"reason"`
+}
+
+// Sign signs the record with an ed25519 private key identified by keyID.
+// The signature covers every field of the record except the signature.
+func (record *ServiceRecord) Sign(keyID string, key ed25519.PrivateKey) error {
+	payload, err := record.signedPayload()
+	if err != nil {
+		return err
+	}
+	record.Signature = &RecordSignature{
+		KeyID: keyID,
+		Value: base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload))}
+	return nil
+}
+
+// Verify returns an error unless the record is signed by one of keys and
+// every pattern it claims is allowed for the key.
+func (record *ServiceRecord) Verify(keys []TrustedKey) error {
+	if record.Signature == nil {
+		return errors.New("Service record " + record.ID + " is not signed")
+	}
+	var trusted *TrustedKey
+	for i := range keys {
+		if keys[i].ID == record.Signature.KeyID {
+			trusted = &keys[i]
+			break
+		}
+	}
+	if trusted == nil {
+		return errors.New("Service record " + record.ID + " is signed with unknown key " +
+			record.Signature.KeyID)
+	}
+	signature, err := base64.StdEncoding.DecodeString(record.Signature.Value)
+	if err != nil {
+		return errors.New("Service record " + record.ID + " has a malformed signature")
+	}
+	payload, err := record.signedPayload()
+	if err != nil {
+		return err
+	}
+	if len(trusted.PublicKey) != ed25519.PublicKeySize ||
+		!ed25519.Verify(trusted.PublicKey, payload, signature) {
+		return errors.New("Service record " + record.ID + " has an invalid signature")
+	}
+	for _, method := range sortedMethods(record.Routes) {
+		for _, pattern := range record.Routes[method] {
+			mounted := record.MountedPattern(pattern)
+			if !trusted.allows(mounted) {
+				return errors.New("Key " + trusted.ID + " may not claim " + method + " " + mounted)
+			}
+		}
+	}
+	return nil
+}
+
+// SignedPayload returns the bytes covered by the record's signature, which
+// is its JSON encoding without the signature.  Struct fields and map keys
+// are encoded in a fixed order, so the encoding is stable.
+func (record *ServiceRecord) signedPayload() ([]byte, error) {
+	unsigned := *record
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// Allows returns true if records signed with the key may claim pattern.
+func (key *TrustedKey) allows(pattern string) bool {
+	for _, allowed := range key.Patterns {
+		if allowed == pattern {
+			return true
+		}
+		if strings.HasSuffix(allowed, "*") && strings.HasPrefix(pattern, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// SortedMethods returns the HTTP methods in routes in alphabetical order.
+func sortedMethods(routes Routes) []string {
+	methods := make([]string, 0, len(routes))
+	for method := range routes {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// RequireSignedRecords configures the exchange to only register service
+// records signed by one of keys.  Records that fail verification are
+// handled according to policy.  Records registered before this is called
+// aren't checked.
+func (exchange *Exchange) RequireSignedRecords(keys []TrustedKey, policy UnverifiedPolicy) {
+	exchange.rw.Lock()
+	defer exchange.rw.Unlock()
+	exchange.trustedKeys = keys
+	exchange.unverifiedPolicy = policy
+}
+
+// Quarantined returns the records held because they failed verification,
+// sorted by ID.
+func (exchange *Exchange) Quarantined() []QuarantinedRecord {
+	exchange.rw.RLock()
+	defer exchange.rw.RUnlock()
+	records := make([]QuarantinedRecord, 0, len(exchange.quarantine))
+	for _, record := range exchange.quarantine {
+		records = append(records, *record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Record.ID < records[j].Record.ID })
+	return records
+}
+
+// Verify checks a service record against the trusted keys, if signed
+// records are required, and quarantines it if it fails and the policy says
+// to.  A record that passes is released from quarantine.
+func (exchange *Exchange) verify(service *ServiceRecord) error {
+	exchange.rw.Lock()
+	defer exchange.rw.Unlock()
+	if exchange.trustedKeys == nil {
+		return nil
+	}
+	err := service.Verify(exchange.trustedKeys)
+	if err == nil {
+		delete(exchange.quarantine, service.ID)
+		return nil
+	}
+	if exchange.unverifiedPolicy == QuarantineUnverified {
+		exchange.quarantine[service.ID] = &QuarantinedRecord{Record: service, Reason: err.Error()}
+	}
+	return err
+}
@@ -0,0 +1,110 @@
+package switchboard
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+
+	. "gopkg.in/check.v1"
+)
+
+type TrustTest struct {
+	public   ed25519.PublicKey
+	private  ed25519.PrivateKey
+	keys     []TrustedKey
+	mux      *ExchangeServeMux
+	exchange *Exchange
+}
+
+var _ = Suite(&TrustTest{})
+
+func (s *TrustTest) SetUpTest(c *C) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	s.public = public
+	s.private = private
+	s.keys = []TrustedKey{{ID: "users-2024", PublicKey: public, Patterns: []string{"/users", "/user/*"}}}
+	s.mux = NewExchangeServeMux()
+	s.exchange = NewExchange("test", nil, s.mux)
+}
+
+// Record creates a service record signed with the test key.
+func (s *TrustTest) record(c *C, routes Routes) *ServiceRecord {
+	record := &ServiceRecord{ID: "users-1", Address: "http://localhost:8080", Routes: routes}
+	c.Assert(record.Sign("users-2024", s.private), IsNil)
+	return record
+}
+
+// Signed records claiming allowed patterns are verified.
+func (s *TrustTest) TestVerify(c *C) {
+	record := s.record(c, Routes{"GET": []string{"/users", "/user/:id"}})
+	c.Assert(record.Signature.KeyID, Equals, "users-2024")
+	c.Assert(record.Verify(s.keys), IsNil)
+}
+
+// Records that are unsigned, signed with unknown keys or changed after they
+// were signed fail verification.
+func (s *TrustTest) TestVerifyRejectsInvalidSignatures(c *C) {
+	record := &ServiceRecord{ID: "users-1", Address: "http://localhost:8080", Routes: Routes{"GET": []string{"/users"}}}
+	c.Assert(record.Verify(s.keys), ErrorMatches, "Service record users-1 is not signed")
+
+	_, other, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+	c.Assert(record.Sign("other", other), IsNil)
+	c.Assert(record.Verify(s.keys), ErrorMatches, "Service record users-1 is signed with unknown key other")
+	c.Assert(record.Sign("users-2024", other), IsNil)
+	c.Assert(record.Verify(s.keys), ErrorMatches, "Service record users-1 has an invalid signature")
+
+	record = s.record(c, Routes{"GET": []string{"/users"}})
+	record.Address = "http://attacker:8080"
+	c.Assert(record.Verify(s.keys), ErrorMatches, "Service record users-1 has an invalid signature")
+	record = s.record(c, Routes{"GET": []string{"/users"}})
+	record.Signature.Value = "!"
+	c.Assert(record.Verify(s.keys), ErrorMatches, "Service record users-1 has a malformed signature")
+}
+
+// Keys may only claim the patterns on their allowlist, after the record's
+// mount prefix is applied.
+func (s *TrustTest) TestVerifyChecksAllowedPatterns(c *C) {
+	record := s.record(c, Routes{"GET": []string{"/users"}, "POST": []string{"/admin"}})
+	c.Assert(record.Verify(s.keys), ErrorMatches, "Key users-2024 may not claim POST /admin")
+
+	record = &ServiceRecord{ID: "users-1", Address: "http://localhost:8080", Mount: "/api",
+		Routes: Routes{"GET": []string{"/users"}}}
+	c.Assert(record.Sign("users-2024", s.private), IsNil)
+	c.Assert(record.Verify(s.keys), ErrorMatches, "Key users-2024 may not claim GET /api/users")
+}
+
+// Exchanges that require signed records refuse records that fail
+// verification and leave them out of the route table.
+func (s *TrustTest) TestRefuseUnverified(c *C) {
+	s.exchange.RequireSignedRecords(s.keys, RefuseUnverified)
+	record := &ServiceRecord{ID: "users-1", Address: "http://localhost:8080", Routes: Routes{"GET": []string{"/users"}}}
+	c.Assert(s.exchange.Register(record), ErrorMatches, "Service record users-1 is not signed")
+	c.Assert(s.exchange.Services(), HasLen, 0)
+	c.Assert(s.exchange.Quarantined(), HasLen, 0)
+	_, err := s.mux.Match("GET", "/users")
+	c.Assert(err, NotNil)
+
+	c.Assert(s.exchange.Register(s.record(c, Routes{"GET": []string{"/users"}})), IsNil)
+	addresses, err := s.mux.Match("GET", "/users")
+	c.Assert(err, IsNil)
+	c.Assert(addresses, DeepEquals, &[]string{"http://localhost:8080"})
+}
+
+// Exchanges that quarantine unverified records hold them for inspection
+// until a verified record with the same ID replaces them.
+func (s *TrustTest) TestQuarantineUnverified(c *C) {
+	s.exchange.RequireSignedRecords(s.keys, QuarantineUnverified)
+	record := s.record(c, Routes{"GET": []string{"/users"}, "DELETE": []string{"/accounts"}})
+	c.Assert(s.exchange.Register(record), NotNil)
+	c.Assert(s.exchange.Services(), HasLen, 0)
+	quarantined := s.exchange.Quarantined()
+	c.Assert(quarantined, HasLen, 1)
+	c.Assert(quarantined[0].Record, Equals, record)
+	c.Assert(quarantined[0].Reason, Equals, "Key users-2024 may not claim DELETE /accounts")
+	c.Assert(s.exchange.State().Quarantined, DeepEquals, quarantined)
+
+	c.Assert(s.exchange.Register(s.record(c, Routes{"GET": []string{"/users"}})), IsNil)
+	c.Assert(s.exchange.Quarantined(), HasLen, 0)
+	c.Assert(s.exchange.Services(), HasLen, 1)
+}